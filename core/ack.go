@@ -0,0 +1,214 @@
+package core
+
+// - Acknowledgements: Inputs that need to know when an event has been written
+// (ex to commit Kafka offsets) register a callback with `OnAck`. Every event
+// holds one reference for the pipeline which is released by the component
+// that ends its journey: the last output once the event is written (`Ack`) or
+// failed to be written (`Nack`), or any component dropping it (`Ack`). Events
+// created out of others (ex flow records of a datagram) with `Derive` hold a
+// reference on the original, so it is only acked once all of them are.
+import (
+	"sync"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+type eventAck struct {
+	refs   int32
+	failed int32
+	done   func(ok bool)
+}
+
+// Register a function to be called once the event has been acked (ok) or
+// nacked by every component holding a reference on it
+func (e *Event) OnAck(done func(ok bool)) {
+	e.ack = &eventAck{1, 0, done}
+}
+
+// Take an extra reference, ex when an event is sent to more than one place.
+// Each reference is released with Ack or Nack
+func (e *Event) Retain() {
+	if e.ack != nil {
+		atomic.AddInt32(&e.ack.refs, 1)
+	}
+}
+
+// Release a reference: the event has been written or dropped on purpose
+func (e *Event) Ack() {
+	e.release(true)
+}
+
+// Release a reference marking the event as failed
+func (e *Event) Nack() {
+	e.release(false)
+}
+
+func (e *Event) release(ok bool) {
+	a := e.ack
+	if a == nil {
+		return
+	}
+	if !ok {
+		atomic.StoreInt32(&a.failed, 1)
+	}
+
+	refs := atomic.AddInt32(&a.refs, -1)
+	if refs == 0 {
+		a.done(atomic.LoadInt32(&a.failed) == 0)
+	} else if refs < 0 {
+		log.Warn("Event released more times than it was retained")
+	}
+}
+
+// Create a new event out of this one. The original is not acked before the new
+// event is (and is nacked if the new event is)
+func (e *Event) Derive(data map[string]interface{}) *Event {
+	d := NewEvent(data)
+	d.Timestamp = e.Timestamp
+	if e.ack != nil {
+		e.Retain()
+		d.OnAck(e.release)
+	}
+	return d
+}
+
+// Tracks the acknowledgements of an input's events (or of a partition) and
+// commits positions (offsets) only when all events up to them are acked, so a
+// restart from the committed position never loses an event. A nacked event
+// blocks the commits (unless SkipFailed) until the input is restarted. At most
+// MaxPending positions are tracked: above that Track blocks, pausing the input
+// instead of growing without bounds behind a nack
+type AckTracker struct {
+	lock sync.Mutex
+	cond *sync.Cond
+	// In-flight positions in the order they were tracked
+	pending []ackEntry
+	// Sequence number of pending[0]
+	base      uint64
+	committed int64
+	failed    uint64
+	commit    func(position int64)
+	// Commit past nacked events (counted in Failed) instead of blocking
+	SkipFailed bool
+	MaxPending int
+	// Closed: Track does not block anymore
+	closed bool
+}
+
+// Default maximum of positions tracked
+const AckMaxPending = 100000
+
+type ackEntry struct {
+	position int64
+	// 0: in-flight, 1: acked, -1: nacked
+	state int8
+}
+
+// Create a tracker starting at the given position. commit (if not nil) is
+// called with every new committed position
+func NewAckTracker(position int64, commit func(position int64)) *AckTracker {
+	t := &AckTracker{committed: position, commit: commit, MaxPending: AckMaxPending}
+	t.cond = sync.NewCond(&t.lock)
+	return t
+}
+
+// Track an event. position is where the input should resume from once this
+// event is acked (ex the next offset). Blocks while MaxPending positions are
+// tracked
+func (t *AckTracker) Track(e *Event, position int64) {
+	seq := t.add(position)
+	e.OnAck(func(ok bool) {
+		t.done(seq, ok)
+	})
+}
+
+// Move to position without an event (ex a line that failed to decode)
+func (t *AckTracker) Skip(position int64) {
+	t.done(t.add(position), true)
+}
+
+func (t *AckTracker) add(position int64) uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.MaxPending > 0 && len(t.pending) >= t.MaxPending && !t.closed {
+		if len(t.pending) > 0 && t.pending[0].state == -1 {
+			log.Errorf("Acks: %d events pending behind a nacked one (after position %d), pausing", len(t.pending), t.committed)
+		} else {
+			log.Warnf("Acks: %d events pending, pausing", len(t.pending))
+		}
+		for len(t.pending) >= t.MaxPending && !t.closed {
+			t.cond.Wait()
+		}
+	}
+
+	t.pending = append(t.pending, ackEntry{position, 0})
+	return t.base + uint64(len(t.pending)-1)
+}
+
+func (t *AckTracker) done(seq uint64, ok bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	i := seq - t.base
+	if ok {
+		t.pending[i].state = 1
+	} else {
+		t.pending[i].state = -1
+		t.failed++
+	}
+
+	// Commit the acked (or skipped failed) head of the queue
+	n := 0
+	for n < len(t.pending) && (t.pending[n].state == 1 || (t.SkipFailed && t.pending[n].state == -1)) {
+		n++
+	}
+	if n == 0 {
+		return
+	}
+
+	t.committed = t.pending[n-1].position
+	t.pending = t.pending[n:]
+	t.base += uint64(n)
+	t.cond.Broadcast()
+	if t.commit != nil {
+		t.commit(t.committed)
+	}
+}
+
+// Stop blocking Track (ex the input is stopping)
+func (t *AckTracker) Close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closed = true
+	t.cond.Broadcast()
+}
+
+// Whether a nacked event blocks the commits
+func (t *AckTracker) Blocked() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending) > 0 && t.pending[0].state == -1
+}
+
+// The position up to which all events are acked
+func (t *AckTracker) Committed() int64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.committed
+}
+
+// Number of events not committed yet
+func (t *AckTracker) Pending() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.pending)
+}
+
+// Number of nacked events
+func (t *AckTracker) Failed() uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.failed
+}
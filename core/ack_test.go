@@ -0,0 +1,119 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAckTracker(t *testing.T) {
+	commits := []int64{}
+	tr := NewAckTracker(10, func(pos int64) { commits = append(commits, pos) })
+
+	events := []*Event{}
+	for i := 0; i < 4; i++ {
+		e := NewEvent(map[string]interface{}{})
+		tr.Track(e, int64(11+i))
+		events = append(events, e)
+	}
+
+	// Out of order: nothing to commit until the first one is acked
+	events[1].Ack()
+	if tr.Committed() != 10 || len(commits) != 0 {
+		t.Error("Acks: committed past an in-flight event ", tr.Committed())
+	}
+	events[0].Ack()
+	if tr.Committed() != 12 || len(commits) != 1 {
+		t.Error("Acks: wrong commit ", tr.Committed(), commits)
+	}
+
+	// A nack blocks the commits
+	events[2].Nack()
+	events[3].Ack()
+	tr.Skip(20)
+	if tr.Committed() != 12 || tr.Failed() != 1 || tr.Pending() != 3 {
+		t.Error("Acks: committed past a nacked event ", tr.Committed())
+	}
+}
+
+func TestAckTrackerSkipFailed(t *testing.T) {
+	tr := NewAckTracker(0, nil)
+	tr.SkipFailed = true
+
+	a, b := NewEvent(map[string]interface{}{}), NewEvent(map[string]interface{}{})
+	tr.Track(a, 1)
+	tr.Track(b, 2)
+	a.Nack()
+	b.Ack()
+	if tr.Committed() != 2 || tr.Failed() != 1 || tr.Pending() != 0 || tr.Blocked() {
+		t.Error("Acks: failed event not skipped ", tr.Committed())
+	}
+}
+
+func TestAckTrackerMaxPending(t *testing.T) {
+	tr := NewAckTracker(0, nil)
+	tr.MaxPending = 2
+
+	a := NewEvent(map[string]interface{}{})
+	tr.Track(a, 1)
+	tr.Track(NewEvent(map[string]interface{}{}), 2)
+	a.Nack()
+	if !tr.Blocked() {
+		t.Error("Acks: not blocked by a nack")
+	}
+
+	// Full: the input is paused until closed
+	tracked := make(chan bool)
+	go func() {
+		tr.Track(NewEvent(map[string]interface{}{}), 3)
+		tracked <- true
+	}()
+	select {
+	case <-tracked:
+		t.Error("Acks: tracked above the maximum")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	tr.Close()
+	select {
+	case <-tracked:
+	case <-time.After(time.Second):
+		t.Error("Acks: still blocked after close")
+	}
+}
+
+func TestAckDerive(t *testing.T) {
+	result := []bool{}
+	e := NewEvent(map[string]interface{}{})
+	e.OnAck(func(ok bool) { result = append(result, ok) })
+
+	// Fan out to two records, then the original is done
+	a := e.Derive(map[string]interface{}{"a": 1})
+	b := e.Derive(map[string]interface{}{"b": 1})
+	e.Ack()
+
+	a.Ack()
+	if len(result) != 0 {
+		t.Error("Acks: acked before all derived events")
+	}
+	b.Nack()
+	if len(result) != 1 || result[0] {
+		t.Error("Acks: a nacked derived event should nack the original ", result)
+	}
+
+	// Retain: one more reference
+	result = result[:0]
+	e = NewEvent(map[string]interface{}{})
+	e.OnAck(func(ok bool) { result = append(result, ok) })
+	e.Retain()
+	e.Ack()
+	if len(result) != 0 {
+		t.Error("Acks: acked with a reference left")
+	}
+	e.Ack()
+	if len(result) != 1 || !result[0] {
+		t.Error("Acks: not acked ", result)
+	}
+
+	// No callback, nothing happens
+	NewEvent(map[string]interface{}{}).Ack()
+}
@@ -9,6 +9,7 @@ package core
 import (
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
@@ -32,6 +33,13 @@ type Component interface {
 	Signal(string)
 }
 
+// Sends a signal to the component at the given index of the pipeline. The main
+// program sets this once all components are created, so components can signal
+// others the same way tasks do (ex when a file is rotated)
+var SignalComponent = func(mod int, signal string) {
+	log.Errorf("Cannot signal component %d: no pipeline", mod)
+}
+
 // Each component's processing stats
 type ComponentStats struct {
 	MsgCount    uint64
@@ -90,19 +98,32 @@ type ComponentBase struct {
 	MustStop bool
 	Stats    ComponentStats
 	Tag      string
+	// Set once the output channel has been closed
+	eos bool
+	// Closed by Stop, once (it may be called concurrently)
+	stopping chan bool
+	stopOnce *sync.Once
 }
 
 // Create a new component given an input channel, an output channel and the
 // component's config
 func NewComponentBase(inQ chan *Event, outQ chan *Event, cfg Config) *ComponentBase {
-	m := &ComponentBase{inQ, outQ, cfg, false, NewComponentStats(), "Base"}
+	m := &ComponentBase{inQ, outQ, cfg, false, NewComponentStats(), "Base", false, make(chan bool), &sync.Once{}}
 	return m
 }
 
 // By default, just set MustStop to false. Component implementations should be
-// taking this into consideration in their Run() methods
+// taking this into consideration in their Run() methods. Overrides must call
+// this as well, so components waiting for events wake up
 func (p *ComponentBase) Stop() {
 	p.MustStop = true
+	p.stopOnce.Do(func() { close(p.stopping) })
+}
+
+// Closed once the component is stopped. Components reading the inQ themselves
+// should select on it too, so they return as soon as they are stopped
+func (p *ComponentBase) Stopping() <-chan bool {
+	return p.stopping
 }
 
 // Wrapper around p.Stats
@@ -167,26 +188,84 @@ func (p *ComponentBase) GetTag() string {
 	return p.Tag
 }
 
+// Returned when the previous component has closed our input channel
+var ErrEndOfStream = errors.New("End of stream")
+
+// Returned when the component was stopped while waiting for an event
+var ErrStopped = errors.New("Stopped")
+
+// Gets the next event out of the inQ. If the previous component has signaled
+// the end of the stream (closed the channel), this component is stopped and
+// the end of the stream is passed down to the next one
+func (p *ComponentBase) Receive() (*Event, error) {
+	select {
+	case e, ok := <-p.InQ:
+		if !ok {
+			p.EndOfStream()
+			return nil, ErrEndOfStream
+		}
+		return e, nil
+	case <-p.stopping:
+		return nil, ErrStopped
+	}
+}
+
+// Stops the component and closes the outQ so the next component stops as soon
+// as it has processed all pending events. Inputs with a finite source (ex stdin)
+// should call this when the source is exhausted
+func (p *ComponentBase) EndOfStream() {
+	p.MustStop = true
+	if p.OutQ != nil && !p.eos {
+		close(p.OutQ)
+	}
+	p.eos = true
+}
+
+// Whether the component has reached the end of the stream, rather than being
+// stopped or giving up (ex it could not connect)
+func (p *ComponentBase) AtEndOfStream() bool {
+	return p.eos
+}
+
 // Gets an event out of the inQ and checks if the module should run based on
 // the ShouldRun state (if/else). If the module should run, this method returns
 // the event to be processes. If not, the event will be passed down to the outQ
 // of the component
 func (p *ComponentBase) ShouldRun() (*Event, error) {
 
-	e := <-p.InQ
+	e, err := p.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.Skip(e) {
+		return nil, errors.New("No need to run")
+	}
+
+	return e, nil
+}
+
+// Checks the ShouldRun state (if/else) of an event. If the module should not
+// run, the event is passed down to the outQ and true is returned. Used by
+// components that do not read their inQ with ShouldRun
+func (p *ComponentBase) Skip(e *Event) bool {
 	if e.ShouldRun.Size() == 0 {
-		return e, nil
+		return false
 	}
 
 	// Here we have a state! Check it
 	state, _ := e.ShouldRun.Top()
 	log.Debug("ShouldRun State ", state)
 
-	// Found false...
+	// Found false... (the end of the pipeline drops it)
 	if !state {
-		p.OutQ <- e
-		return nil, errors.New("No need to run")
+		if p.OutQ != nil {
+			p.OutQ <- e
+		} else {
+			e.Ack()
+		}
+		return true
 	}
 
-	return e, nil
+	return false
 }
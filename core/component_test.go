@@ -0,0 +1,68 @@
+package core
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReceiveStopped(t *testing.T) {
+	in := make(chan *Event, 1)
+	p := NewComponentBase(in, nil, Config{})
+
+	done := make(chan error)
+	go func() {
+		_, err := p.Receive()
+		done <- err
+	}()
+
+	// Waiting for an event until stopped
+	p.Stop()
+	p.Stop()
+	select {
+	case err := <-done:
+		if err != ErrStopped {
+			t.Error("Receive: wrong error ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Receive: not woken up by Stop")
+	}
+	if p.AtEndOfStream() {
+		t.Error("Receive: stopped is not the end of the stream")
+	}
+}
+
+func TestReceiveEndOfStream(t *testing.T) {
+	in := make(chan *Event, 1)
+	p := NewComponentBase(in, nil, Config{})
+
+	in <- NewEvent(map[string]interface{}{})
+	close(in)
+	if _, err := p.Receive(); err != nil {
+		t.Error("Receive: wrong error ", err)
+	}
+	if _, err := p.Receive(); err != ErrEndOfStream || !p.AtEndOfStream() {
+		t.Error("Receive: end of stream not reached ", err)
+	}
+}
+
+func TestStopConcurrent(t *testing.T) {
+	p := NewComponentBase(nil, nil, Config{})
+
+	// Stopped from the component and on shutdown at the same time
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			p.Stop()
+			done <- true
+		}()
+	}
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+
+	select {
+	case <-p.Stopping():
+	default:
+		t.Error("Stop: stopping not closed")
+	}
+}
@@ -14,11 +14,13 @@ type Event struct {
 	Timestamp time.Time
 	Data      map[string]interface{}
 	ShouldRun *BoolStack
+	// Acknowledgement state (nil unless the input asked for acks)
+	ack *eventAck
 }
 
 // Create a new event with the given data
 func NewEvent(data map[string]interface{}) *Event {
-	return &Event{time.Now(), data, &BoolStack{}}
+	return &Event{time.Now(), data, &BoolStack{}, nil}
 }
 
 // Get the string replresentation of this event
@@ -7,7 +7,11 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
 	"strconv"
+	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -149,6 +153,217 @@ func (c *StringLineCodec) ToBytes(data map[string]interface{}) ([]byte, error) {
 	return []byte(data["message"].(string)), nil
 }
 
+// InfluxDB line protocol codec. Events are mapped to a measurement (static or
+// taken from a field), tags and fields. When no fields are given, all fields
+// that are not tags (or metadata, starting with `_`) are written. The point time
+// is taken from TimeField (unix time in Precision units or RFC3339), or is left
+// to the server
+type InfluxLineCodec struct {
+	Measurement      string   `json:"measurement"`
+	MeasurementField string   `json:"measurement_field"`
+	Tags             []string `json:"tags"`
+	Fields           []string `json:"fields"`
+	TimeField        string   `json:"time_field"`
+	// ns (default), us, ms or s
+	Precision string `json:"precision"`
+}
+
+var (
+	influxMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\n`)
+	influxKeyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\n`)
+	influxStringEscaper      = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+)
+
+// Create an Influx codec from a component config
+func NewInfluxLineCodec(cfg map[string]interface{}) (*InfluxLineCodec, error) {
+	c := &InfluxLineCodec{Precision: "ns"}
+	cfgbytes, _ := json.Marshal(cfg)
+	if err := json.Unmarshal(cfgbytes, c); err != nil {
+		return nil, err
+	}
+
+	if c.Measurement == "" && c.MeasurementField == "" {
+		return nil, errors.New("InfluxLineCodec: 'measurement' or 'measurement_field' is required")
+	}
+	if _, err := influxPrecision(c.Precision); err != nil {
+		return nil, err
+	}
+	sort.Strings(c.Tags)
+	return c, nil
+}
+
+func influxPrecision(p string) (time.Duration, error) {
+	switch p {
+	case "", "ns":
+		return time.Nanosecond, nil
+	case "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	}
+	return 0, fmt.Errorf("InfluxLineCodec: Unknown precision '%s'", p)
+}
+
+func (c *InfluxLineCodec) FromBytes(data []byte) (map[string]interface{}, error) {
+	return nil, errors.New("InfluxLineCodec.FromBytes: Decoding line protocol is not supported")
+}
+
+// Return a line (with a \n at the end). The time is taken from TimeField only
+func (c *InfluxLineCodec) ToBytes(data map[string]interface{}) ([]byte, error) {
+	b, err := c.Encode(data, time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, byte('\n')), nil
+}
+
+// Encode a point without the new line. The time is taken from TimeField if set,
+// otherwise ts is used (if not zero)
+func (c *InfluxLineCodec) Encode(data map[string]interface{}, ts time.Time) ([]byte, error) {
+	var b bytes.Buffer
+
+	measurement := c.Measurement
+	if c.MeasurementField != "" {
+		if tmp, ok := data[c.MeasurementField].(string); ok && tmp != "" {
+			measurement = tmp
+		}
+	}
+	if measurement == "" {
+		return nil, errors.New("InfluxLineCodec: No measurement")
+	}
+	b.WriteString(influxMeasurementEscaper.Replace(measurement))
+
+	// Empty tag values are not allowed
+	istag := map[string]bool{}
+	for _, tag := range c.Tags {
+		istag[tag] = true
+		v, ok := data[tag]
+		if !ok || v == nil {
+			continue
+		}
+		value := fmt.Sprint(v)
+		if value == "" {
+			continue
+		}
+		b.WriteByte(',')
+		b.WriteString(influxKeyEscaper.Replace(tag))
+		b.WriteByte('=')
+		b.WriteString(influxKeyEscaper.Replace(value))
+	}
+
+	fields := c.Fields
+	if len(fields) == 0 {
+		for k := range data {
+			if istag[k] || k == c.MeasurementField || k == c.TimeField || strings.HasPrefix(k, "_") {
+				continue
+			}
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+	}
+
+	sep := byte(' ')
+	for _, field := range fields {
+		value, ok := influxValue(data[field])
+		if !ok {
+			continue
+		}
+		b.WriteByte(sep)
+		b.WriteString(influxKeyEscaper.Replace(field))
+		b.WriteByte('=')
+		b.WriteString(value)
+		sep = ','
+	}
+	if sep == ' ' {
+		return nil, errors.New("InfluxLineCodec: No fields to write")
+	}
+
+	if c.TimeField != "" {
+		var err error
+		if ts, err = c.pointTime(data[c.TimeField]); err != nil {
+			return nil, err
+		}
+	}
+	if !ts.IsZero() {
+		precision, _ := influxPrecision(c.Precision)
+		b.WriteByte(' ')
+		b.WriteString(strconv.FormatInt(ts.UnixNano()/int64(precision), 10))
+	}
+
+	return b.Bytes(), nil
+}
+
+// Format a field value. Values of other types (ex. lists) are skipped
+func influxValue(v interface{}) (string, bool) {
+	switch t := v.(type) {
+	case string:
+		return `"` + influxStringEscaper.Replace(t) + `"`, true
+	case bool:
+		return strconv.FormatBool(t), true
+	case int:
+		return strconv.FormatInt(int64(t), 10) + "i", true
+	case int32:
+		return strconv.FormatInt(int64(t), 10) + "i", true
+	case int64:
+		return strconv.FormatInt(t, 10) + "i", true
+	case uint32:
+		return strconv.FormatUint(uint64(t), 10) + "i", true
+	case uint64:
+		if t > math.MaxInt64 {
+			return strconv.FormatUint(t, 10) + "u", true
+		}
+		return strconv.FormatUint(t, 10) + "i", true
+	case float32:
+		return influxValue(float64(t))
+	case float64:
+		if math.IsNaN(t) || math.IsInf(t, 0) {
+			return "", false
+		}
+		return strconv.FormatFloat(t, 'g', -1, 64), true
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return influxValue(i)
+		}
+		if f, err := t.Float64(); err == nil {
+			return influxValue(f)
+		}
+	}
+	return "", false
+}
+
+// The point time out of a field: unix time in Precision units or RFC3339
+func (c *InfluxLineCodec) pointTime(v interface{}) (time.Time, error) {
+	precision, _ := influxPrecision(c.Precision)
+
+	var n int64
+	switch t := v.(type) {
+	case string:
+		return time.Parse(time.RFC3339Nano, t)
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		n = int64(f)
+		if i, err := t.Int64(); err == nil {
+			n = i
+		}
+	case float64:
+		n = int64(t)
+	case int64:
+		n = t
+	case uint64:
+		n = int64(t)
+	case int:
+		n = int64(t)
+	default:
+		return time.Time{}, fmt.Errorf("InfluxLineCodec: Invalid time '%v'", v)
+	}
+	return time.Unix(0, n*int64(precision)), nil
+}
+
 // Helper to extract a []interface}{} to a []string
 // TODO: Consider using a higher level JSON lib
 type InterfaceArray []interface{}
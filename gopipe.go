@@ -73,7 +73,7 @@ func runTask(name string, parts []string, intervalSeconds uint64, signals []inte
 			mod := int(signal.(core.Config)["mod"].(float64))
 			sig := signal.(core.Config)["signal"].(string)
 			log.Infof("Invoking signal '%s' on component %d", sig, mod)
-			mods[mod].Signal(sig)
+			core.SignalComponent(mod, sig)
 		}
 		time.Sleep(time.Duration(intervalSeconds) * time.Second)
 	}
@@ -159,6 +159,13 @@ func main() {
 			core.STATS_EVERY = uint64(tmpF64)
 		}
 
+		// How long to wait for the components to stop (flush, close files...)
+		stopTimeout := 30 * time.Second
+		tmpF64, ok = CFG["main"].(core.Config)["stop_timeout_seconds"].(float64)
+		if ok {
+			stopTimeout = time.Duration(tmpF64) * time.Second
+		}
+
 		// Load registry
 		reg := core.GetRegistryInstance()
 
@@ -215,6 +222,15 @@ func main() {
 		mods = append(mods, tmp)
 		log.Info("Created ", len(chans), " channels")
 
+		// Let components signal each other
+		core.SignalComponent = func(mod int, signal string) {
+			if mod < 0 || mod >= len(mods) {
+				log.Errorf("Cannot signal component %d: no such component", mod)
+				return
+			}
+			mods[mod].Signal(signal)
+		}
+
 		// Start the HTTP server
 		tmpport, ok := CFG["main"].(core.Config)["apiport"].(float64)
 		var apiport string
@@ -245,9 +261,19 @@ func main() {
 				task.(core.Config)["signals"].([]interface{}))
 		}
 
-		// Start all
-		for _, mod := range mods {
-			go mod.Run()
+		// Start all. When the last component returns, the input has signaled
+		// the end of the stream (ex stdin closed) and everything is drained
+		finished := make(chan bool, 1)
+		stopped := make([]chan bool, len(mods))
+		for i, mod := range mods {
+			stopped[i] = make(chan bool)
+			go func(i int, mod core.Component) {
+				mod.Run()
+				close(stopped[i])
+				if i == len(mods)-1 {
+					finished <- true
+				}
+			}(i, mod)
 		}
 
 		chExit := make(chan os.Signal, 1)
@@ -257,6 +283,7 @@ func main() {
 
 		// Now loop forever
 		run := true
+		failed := false
 		for run {
 			select {
 			case <-chExit:
@@ -280,6 +307,20 @@ func main() {
 				log.Info("gopipe exiting...")
 				run = false
 				break
+			case <-finished:
+				// Any other reason is a failure
+				last, ok := mods[len(mods)-1].(interface{ AtEndOfStream() bool })
+				if ok && !last.AtEndOfStream() {
+					log.Error("gopipe last component stopped before the end of stream, exiting...")
+					failed = true
+				} else {
+					log.Info("gopipe end of stream, exiting...")
+				}
+				for _, mod := range mods {
+					mod.Stop()
+				}
+				run = false
+				break
 			case sig := <-chInst:
 				switch sig {
 				case syscall.SIGUSR1:
@@ -296,6 +337,20 @@ func main() {
 
 		}
 
+		// Let the components finish what they were doing (ex outputs flush
+		// and close their files)
+		deadline := time.Now().Add(stopTimeout)
+		for i, mod := range mods {
+			select {
+			case <-stopped[i]:
+			case <-time.After(time.Until(deadline)):
+				log.Warnf("Component %d (%s) did not stop in %v", i, mod.GetTag(), stopTimeout)
+			}
+		}
+
+		if failed {
+			return cli.NewExitError("The last component stopped before the end of stream", -3)
+		}
 		return nil
 	}
 
@@ -0,0 +1,603 @@
+/*
+   - FILETAIL: Follow files matching glob patterns (like `tail -F`). Each line
+   is processed as a separate message. Rotation by rename and by truncation is
+   detected, and optionally gzip-rotated files are read once. Read positions are
+   stored per file (device/inode) in a state file so a restart resumes where it
+   stopped
+*/
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering FileTailJSONInput")
+	core.GetRegistryInstance()["FileTailJSONInput"] = NewFileTailJSONInput
+
+	log.Info("Registering FileTailCSVInput")
+	core.GetRegistryInstance()["FileTailCSVInput"] = NewFileTailCSVInput
+
+	log.Info("Registering FileTailStrInput")
+	core.GetRegistryInstance()["FileTailStrInput"] = NewFileTailStrInput
+
+	log.Info("Registering FileTailRawInput")
+	core.GetRegistryInstance()["FileTailRawInput"] = NewFileTailRawInput
+}
+
+// Longer lines are skipped (same as TCP)
+const fileTailMaxLine = 65000
+
+// The persisted position of a single file. Offset only moves past lines that
+// have been acked by the outputs
+type FileTailState struct {
+	Path   string `json:"path"`
+	Offset int64  `json:"offset"`
+	// Set for gzip files that have been read (and acked) completely
+	Done bool `json:"done,omitempty"`
+	acks *core.AckTracker
+	// gzip files: reached the end
+	eof bool
+}
+
+// A file matching the globs
+type fileMatch struct {
+	path string
+	fi   os.FileInfo
+}
+
+// An open file we are following
+type fileTailer struct {
+	id     string
+	path   string
+	fd     *os.File
+	reader *bufio.Reader
+	// Offset of the last complete line we have read
+	offset int64
+	// Incomplete line (no \n yet)
+	partial []byte
+	// Bytes dropped from the incomplete line once it is too long
+	dropped int64
+	// Whether the file still matched the globs in the last scan
+	seen bool
+}
+
+// The base structure for file tailing. The default implementation is using
+// JSON message format
+type FileTailJSONInput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for decoding...
+	Decoder   core.LineCodec
+	Paths     []string
+	StateFile string
+	PollMs    int
+	FromEnd   bool
+	ReadGzip  bool
+	// Lines tracked per file before pausing and whether to move past failed
+	// ones (see core.AckTracker)
+	MaxPending int
+	SkipFailed bool
+	State      map[string]*FileTailState
+	// The trackers of State, to release them from Stop
+	trackers map[string]*core.AckTracker
+	lock     *sync.Mutex
+	tailers  map[string]*fileTailer
+	// Tailer ids in the order the files were found, so a rotated file is
+	// always read before the file that replaced it
+	order []string
+	// The state last written, to skip writes when nothing moved
+	saved []byte
+}
+
+func NewFileTailJSONInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating FileTailJSONInput")
+
+	tmp, ok := cfg["paths"].([]interface{})
+	if !ok || len(tmp) == 0 {
+		panic("FileTailJSONInput: 'paths' (list of glob patterns) is required")
+	}
+	paths := core.InterfaceToStringArray(tmp)
+
+	state_file, _ := cfg["state_file"].(string)
+
+	poll_ms := 1000
+	if tmp, ok := cfg["poll_ms"].(float64); ok {
+		poll_ms = int(tmp)
+	}
+
+	from_end := false
+	if tmp, ok := cfg["start_from"].(string); ok {
+		switch tmp {
+		case "beginning":
+		case "end":
+			from_end = true
+		default:
+			panic("FileTailJSONInput: 'start_from' must be 'beginning' or 'end'")
+		}
+	}
+
+	read_gzip, _ := cfg["read_gzip"].(bool)
+
+	max_pending := core.AckMaxPending
+	if tmp, ok := cfg["max_pending"].(float64); ok {
+		max_pending = int(tmp)
+	}
+	skip_failed, _ := cfg["skip_failed"].(bool)
+
+	m := FileTailJSONInput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{},
+		paths, state_file, poll_ms, from_end, read_gzip, max_pending, skip_failed,
+		map[string]*FileTailState{}, map[string]*core.AckTracker{}, &sync.Mutex{},
+		map[string]*fileTailer{}, nil, nil}
+
+	m.Tag = "IN-FILETAIL-JSON"
+
+	return &m
+}
+
+func (p *FileTailJSONInput) Signal(string) {}
+
+// Stop, releasing the loop if it is paused on a full tracker
+func (p *FileTailJSONInput) Stop() {
+	p.ComponentBase.Stop()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, acks := range p.trackers {
+		acks.Close()
+	}
+}
+
+// A new tracker for a file
+func (p *FileTailJSONInput) newTracker(id string, offset int64) *core.AckTracker {
+	acks := core.NewAckTracker(offset, nil)
+	acks.MaxPending = p.MaxPending
+	acks.SkipFailed = p.SkipFailed
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.MustStop {
+		acks.Close()
+	}
+	p.trackers[id] = acks
+	return acks
+}
+
+// Forget the position and tracker of a file
+func (p *FileTailJSONInput) forget(id string) {
+	delete(p.State, id)
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	delete(p.trackers, id)
+}
+
+func (p *FileTailJSONInput) Run() {
+	p.MustStop = false
+	p.loadState()
+
+	// Only files found on the very first scan honour start_from. Anything that
+	// appears later is a new (rotated) file and is read from the start
+	first := true
+	for !p.MustStop {
+		p.scan(first)
+		first = false
+
+		for _, id := range p.order {
+			p.readLines(p.tailers[id])
+		}
+
+		p.closeGone()
+		p.saveState()
+
+		time.Sleep(time.Duration(p.PollMs) * time.Millisecond)
+	}
+
+	for _, t := range p.tailers {
+		t.fd.Close()
+	}
+	p.saveState()
+	log.Infof("%s: Stopping...", p.Tag)
+}
+
+// Expand the globs and start following any new files
+func (p *FileTailJSONInput) scan(first bool) {
+	for _, t := range p.tailers {
+		t.seen = false
+	}
+
+	paths := []string{}
+	for _, pattern := range p.Paths {
+		m, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Error("FileTail: Invalid pattern ", pattern, ": ", err.Error())
+			continue
+		}
+		paths = append(paths, m...)
+	}
+	sort.Strings(paths)
+
+	matches := []fileMatch{}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		matches = append(matches, fileMatch{path, fi})
+	}
+	// Oldest (last modified) first, so rotated files (ex app.log.1) are read
+	// before the file that replaced them (app.log) whatever their names
+	sort.SliceStable(matches, func(i, j int) bool {
+		return matches[i].fi.ModTime().Before(matches[j].fi.ModTime())
+	})
+
+	matched := map[string]bool{}
+	defer func() {
+		// Forget positions of files that no longer exist
+		for id := range p.State {
+			if _, ok := p.tailers[id]; !ok && !matched[id] {
+				p.forget(id)
+			}
+		}
+	}()
+
+	for _, match := range matches {
+		path, fi := match.path, match.fi
+		id := fileID(path, fi)
+		matched[id] = true
+
+		if t, ok := p.tailers[id]; ok {
+			t.seen = true
+			if t.path != path {
+				log.Info("FileTail: ", t.path, " was renamed to ", path)
+				t.path = path
+			}
+
+			// Truncated in place (copytruncate)
+			if fi.Size() < t.offset+t.dropped+int64(len(t.partial)) {
+				log.Info("FileTail: ", path, " was truncated")
+				t.fd.Seek(0, io.SeekStart)
+				t.reader.Reset(t.fd)
+				t.offset = 0
+				t.partial = nil
+				t.dropped = 0
+				p.State[id].acks = p.newTracker(id, 0)
+			}
+			continue
+		}
+
+		if strings.HasSuffix(path, ".gz") {
+			// Compressed after rotation (ex delaycompress): the content has
+			// been read from the uncompressed file already
+			if p.ReadGzip && p.tracked(strings.TrimSuffix(path, ".gz"), paths) {
+				if st, ok := p.State[id]; !ok || !st.Done {
+					log.Info("FileTail: Skipping ", path, ", read uncompressed")
+					p.State[id] = &FileTailState{path, 0, true, nil, false}
+				}
+			} else if p.ReadGzip {
+				p.readGzip(id, path)
+			}
+			continue
+		}
+
+		p.follow(id, path, fi, first)
+	}
+}
+
+// Whether a file is (or has been) followed: it is open or matches the globs
+func (p *FileTailJSONInput) tracked(path string, paths []string) bool {
+	for _, t := range p.tailers {
+		if t.path == path {
+			return true
+		}
+	}
+	i := sort.SearchStrings(paths, path)
+	return i < len(paths) && paths[i] == path
+}
+
+// Open a file and position it based on the state or the config
+func (p *FileTailJSONInput) follow(id string, path string, fi os.FileInfo, first bool) {
+	fd, err := os.Open(path)
+	if err != nil {
+		log.Error("FileTail: Failed to open ", path, ": ", err.Error())
+		return
+	}
+
+	var offset int64
+	if st, ok := p.State[id]; ok && st.Offset <= fi.Size() {
+		offset = st.Offset
+	} else if first && p.FromEnd {
+		offset = fi.Size()
+	}
+
+	if _, err := fd.Seek(offset, io.SeekStart); err != nil {
+		log.Error("FileTail: Failed to seek ", path, ": ", err.Error())
+		fd.Close()
+		return
+	}
+
+	log.Info("FileTail: Following ", path, " from offset ", offset)
+	p.tailers[id] = &fileTailer{id, path, fd, bufio.NewReader(fd), offset, nil, 0, true}
+	p.order = append(p.order, id)
+	p.State[id] = &FileTailState{path, offset, false, p.newTracker(id, offset), false}
+}
+
+// Read all complete lines available in the file
+func (p *FileTailJSONInput) readLines(t *fileTailer) {
+	for !p.MustStop {
+		line, err := t.reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			t.keep(line)
+			continue
+		}
+
+		if err != nil {
+			// EOF: keep the incomplete line until the rest is written
+			t.keep(line)
+			if err != io.EOF {
+				log.Error("FileTail: Failed to read ", t.path, ": ", err.Error())
+			}
+			break
+		}
+
+		st := p.State[t.id]
+		st.Path = t.path
+
+		// Max line protection
+		if t.dropped > 0 || len(t.partial)+len(line) > fileTailMaxLine {
+			t.offset += t.dropped + int64(len(t.partial)+len(line))
+			t.partial = nil
+			t.dropped = 0
+			log.Warnf("FileTail: Skipping line longer than %d bytes in %s", fileTailMaxLine, t.path)
+			st.acks.Skip(t.offset)
+			continue
+		}
+
+		data := append(t.partial, line...)
+		t.partial = nil
+		t.offset += int64(len(data))
+		p.emit(st.acks, t.path, data, t.offset)
+	}
+}
+
+// Keep part of an incomplete line, dropping it once it is too long to be
+// emitted, so a line without an end does not grow forever
+func (t *fileTailer) keep(line []byte) {
+	if t.dropped > 0 || len(t.partial)+len(line) > fileTailMaxLine {
+		t.dropped += int64(len(t.partial) + len(line))
+		t.partial = nil
+		return
+	}
+	t.partial = append(t.partial, line...)
+}
+
+// Read a compressed (rotated) file in one go
+func (p *FileTailJSONInput) readGzip(id string, path string) {
+	st, ok := p.State[id]
+	if ok && (st.Done || st.eof) {
+		return
+	}
+	if !ok {
+		st = &FileTailState{path, 0, false, nil, false}
+		p.State[id] = st
+	}
+	st.acks = p.newTracker(id, st.Offset)
+
+	fd, err := os.Open(path)
+	if err != nil {
+		log.Error("FileTail: Failed to open ", path, ": ", err.Error())
+		return
+	}
+	defer fd.Close()
+
+	gz, err := gzip.NewReader(fd)
+	if err != nil {
+		log.Error("FileTail: Failed to read gzip ", path, ": ", err.Error())
+		return
+	}
+	defer gz.Close()
+
+	log.Info("FileTail: Reading compressed ", path, " from offset ", st.Offset)
+
+	// Offsets of gzip files count uncompressed bytes
+	offset := st.Offset
+	if _, err := io.CopyN(ioutil.Discard, gz, offset); err != nil {
+		log.Error("FileTail: Failed to skip in ", path, ": ", err.Error())
+		return
+	}
+
+	reader := bufio.NewReaderSize(gz, 65536)
+	for !p.MustStop {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			offset += int64(len(line))
+			p.emit(st.acks, path, line, offset)
+		}
+		if err == io.EOF {
+			// Done once everything is acked (see saveState)
+			st.eof = true
+			break
+		}
+		if err != nil {
+			log.Error("FileTail: Failed to read gzip ", path, ": ", err.Error())
+			break
+		}
+	}
+}
+
+// Decode a line and push it downstream. offset is the position right after
+// the line
+func (p *FileTailJSONInput) emit(acks *core.AckTracker, path string, line []byte, offset int64) {
+	line = []byte(strings.TrimRight(string(line), "\r\n"))
+	if len(line) == 0 {
+		acks.Skip(offset)
+		return
+	}
+
+	json_data, err := p.Decoder.FromBytes(line)
+	if err != nil {
+		log.Error("Failed to decode data from " + path)
+		log.Error("   data: " + string(line))
+		log.Error(err.Error())
+		acks.Skip(offset)
+		return
+	}
+
+	json_data["_file"] = path
+
+	e := core.NewEvent(json_data)
+	acks.Track(e, offset)
+	p.OutQ <- e
+
+	// Stats
+	p.StatsAddMesg()
+	p.PrintStats()
+}
+
+// Stop following files that have been rotated away (or deleted) once they are
+// fully read
+func (p *FileTailJSONInput) closeGone() {
+	order := p.order[:0]
+	for _, id := range p.order {
+		t := p.tailers[id]
+		if t.seen {
+			order = append(order, id)
+			continue
+		}
+		log.Info("FileTail: Done with ", t.path)
+		t.fd.Close()
+		delete(p.tailers, id)
+		p.forget(id)
+	}
+	p.order = order
+}
+
+// Load the read positions from the state file
+func (p *FileTailJSONInput) loadState() {
+	if p.StateFile == "" {
+		return
+	}
+
+	raw, err := ioutil.ReadFile(p.StateFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Error("FileTail: Failed to read state file: ", err.Error())
+		return
+	}
+
+	if err := json.Unmarshal(raw, &p.State); err != nil {
+		log.Error("FileTail: Invalid state file: ", err.Error())
+		p.State = map[string]*FileTailState{}
+	}
+}
+
+// Write the read positions to the state file (atomically), if they moved
+func (p *FileTailJSONInput) saveState() {
+	if p.StateFile == "" {
+		return
+	}
+
+	for _, st := range p.State {
+		if st.acks == nil {
+			continue
+		}
+		st.Offset = st.acks.Committed()
+		if st.eof && st.acks.Pending() == 0 {
+			st.Done = true
+		}
+	}
+
+	raw, err := json.Marshal(p.State)
+	if err != nil {
+		log.Error("FileTail: Failed to encode state: ", err.Error())
+		return
+	}
+	if bytes.Equal(raw, p.saved) {
+		return
+	}
+
+	tmp := p.StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, raw, 0644); err != nil {
+		log.Error("FileTail: Failed to write state file: ", err.Error())
+		return
+	}
+	if err := os.Rename(tmp, p.StateFile); err != nil {
+		log.Error("FileTail: Failed to write state file: ", err.Error())
+		return
+	}
+	p.saved = raw
+}
+
+// File tail CSV implementation
+type FileTailCSVInput struct {
+	*FileTailJSONInput
+}
+
+func NewFileTailCSVInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating FileTailCSVInput")
+
+	// Defaults...
+	m := FileTailCSVInput{NewFileTailJSONInput(inQ, outQ, cfg).(*FileTailJSONInput)}
+
+	m.Tag = "IN-FILETAIL-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Decoder = c
+
+	return &m
+}
+
+// File tail Raw implementation
+type FileTailRawInput struct {
+	*FileTailJSONInput
+}
+
+func NewFileTailRawInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating FileTailRawInput")
+
+	// Defaults...
+	m := FileTailRawInput{NewFileTailJSONInput(inQ, outQ, cfg).(*FileTailJSONInput)}
+
+	m.Tag = "IN-FILETAIL-RAW"
+
+	m.Decoder = &core.RawLineCodec{}
+
+	return &m
+}
+
+// File tail String implementation
+type FileTailStrInput struct {
+	*FileTailJSONInput
+}
+
+func NewFileTailStrInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating FileTailStrInput")
+
+	// Defaults...
+	m := FileTailStrInput{NewFileTailJSONInput(inQ, outQ, cfg).(*FileTailJSONInput)}
+
+	m.Tag = "IN-FILETAIL-STR"
+
+	m.Decoder = &core.StringLineCodec{}
+
+	return &m
+}
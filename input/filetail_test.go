@@ -0,0 +1,254 @@
+package input
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func appendFile(t *testing.T, path string, data string) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(data)
+	f.Close()
+}
+
+func expectMessage(t *testing.T, ch chan *core.Event, msg string) {
+	select {
+	case e := <-ch:
+		if e.Data["message"] != msg {
+			t.Errorf("FileTail: expected '%s' got '%v'", msg, e.Data["message"])
+		}
+	case <-time.After(time.Duration(3) * time.Second):
+		t.Errorf("FileTail: timed out waiting for '%s'", msg)
+	}
+}
+
+func TestFileTailRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "one\ntwo\n")
+
+	out := make(chan *core.Event, 10)
+	comp := NewFileTailStrInput(nil, out, GetConfig(`{
+		"paths": ["`+filepath.Join(dir, "*.log")+`"], "poll_ms": 50
+	}`))
+	go comp.Run()
+	defer comp.Stop()
+
+	expectMessage(t, out, "one")
+	expectMessage(t, out, "two")
+
+	// Partial lines are held back
+	appendFile(t, path, "thr")
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	if len(out) != 0 {
+		t.Error("FileTail: emitted an incomplete line")
+	}
+	appendFile(t, path, "ee\n")
+	expectMessage(t, out, "three")
+
+	// Rename rotation: the rest of the old file is still read
+	appendFile(t, path, "four\n")
+	os.Rename(path, filepath.Join(dir, "app.log.1"))
+	appendFile(t, path, "five\n")
+	expectMessage(t, out, "four")
+	expectMessage(t, out, "five")
+
+	// Truncation
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	os.Truncate(path, 0)
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	appendFile(t, path, "six\n")
+	expectMessage(t, out, "six")
+}
+
+func TestFileTailState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	state := filepath.Join(dir, "state.json")
+	appendFile(t, path, `{"a": 1}`+"\n")
+
+	cfg := `{"paths": ["` + path + `"], "poll_ms": 50, "state_file": "` + state + `"}`
+
+	out := make(chan *core.Event, 10)
+	comp := NewFileTailJSONInput(nil, out, GetConfig(cfg))
+	go comp.Run()
+
+	e := <-out
+	if e.Data["_file"] != path {
+		t.Error("FileTail: missing _file", e.Data)
+	}
+	comp.Stop()
+	time.Sleep(time.Duration(200) * time.Millisecond)
+
+	// Not acked: read again after a restart
+	comp = NewFileTailJSONInput(nil, out, GetConfig(cfg))
+	go comp.Run()
+
+	e = <-out
+	if e.Data["a"].(json.Number).String() != "1" {
+		t.Error("FileTail: unacked line was not read again", e.Data)
+	}
+	e.Ack()
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	comp.Stop()
+	time.Sleep(time.Duration(200) * time.Millisecond)
+
+	// While we are down...
+	appendFile(t, path, `{"a": 2}`+"\n")
+
+	comp = NewFileTailJSONInput(nil, out, GetConfig(cfg))
+	go comp.Run()
+	defer comp.Stop()
+
+	select {
+	case e = <-out:
+		if e.Data["a"].(json.Number).String() != "2" {
+			t.Error("FileTail: did not resume from the saved offset", e.Data)
+		}
+	case <-time.After(time.Duration(3) * time.Second):
+		t.Error("FileTail: timed out after restart")
+	}
+}
+
+func TestFileTailOrder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	state := filepath.Join(dir, "state.json")
+
+	// Rotated before we started: the older file is read first
+	appendFile(t, path+".1", "one\n")
+	appendFile(t, path, "two\n")
+	old := time.Now().Add(-time.Minute)
+	os.Chtimes(path+".1", old, old)
+
+	out := make(chan *core.Event, 10)
+	comp := NewFileTailStrInput(nil, out, GetConfig(`{
+		"paths": ["`+path+`*"], "poll_ms": 50, "state_file": "`+state+`"
+	}`))
+	go comp.Run()
+	defer comp.Stop()
+
+	for _, msg := range []string{"one", "two"} {
+		select {
+		case e := <-out:
+			if e.Data["message"] != msg {
+				t.Errorf("FileTail: expected '%s' got '%v'", msg, e.Data["message"])
+			}
+			e.Ack()
+		case <-time.After(3 * time.Second):
+			t.Fatalf("FileTail: timed out waiting for '%s'", msg)
+		}
+	}
+
+	// The state is only written when positions move
+	time.Sleep(200 * time.Millisecond)
+	os.Remove(state)
+	time.Sleep(200 * time.Millisecond)
+	if _, err := os.Stat(state); err == nil {
+		t.Error("FileTail: state written without changes")
+	}
+	appendFile(t, path, "three\n")
+	expectMessage(t, out, "three")
+}
+
+func TestFileTailGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	f, _ := os.Create(filepath.Join(dir, "app.log.1.gz"))
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte("old\n"))
+	gz.Close()
+	f.Close()
+
+	out := make(chan *core.Event, 10)
+	comp := NewFileTailStrInput(nil, out, GetConfig(`{
+		"paths": ["`+filepath.Join(dir, "app.log*")+`"], "poll_ms": 50, "read_gzip": true
+	}`))
+	go comp.Run()
+	defer comp.Stop()
+
+	expectMessage(t, out, "old")
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	if len(out) != 0 {
+		t.Error("FileTail: gzip file was read more than once")
+	}
+
+	// Compressed after rotation (delaycompress): not read again
+	appendFile(t, filepath.Join(dir, "app.log.2"), "rotated\n")
+	expectMessage(t, out, "rotated")
+	f, _ = os.Create(filepath.Join(dir, "app.log.2.gz"))
+	gz = gzip.NewWriter(f)
+	gz.Write([]byte("rotated\n"))
+	gz.Close()
+	f.Close()
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	os.Remove(filepath.Join(dir, "app.log.2"))
+	time.Sleep(time.Duration(200) * time.Millisecond)
+	if len(out) != 0 {
+		t.Error("FileTail: compressed copy of a read file was read")
+	}
+}
+
+func TestFileTailLongLine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-tail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "app.log")
+	appendFile(t, path, "")
+
+	out := make(chan *core.Event, 10)
+	p := NewFileTailStrInput(nil, out, GetConfig(`{
+		"paths": ["`+path+`"]
+	}`)).(*FileTailStrInput)
+	p.scan(true)
+	if len(p.tailers) != 1 {
+		t.Fatal("FileTail: file not followed")
+	}
+	tailer := p.tailers[p.order[0]]
+
+	// Dropped while it is written, not buffered until it ends
+	long := make([]byte, 70000)
+	for i := range long {
+		long[i] = 'x'
+	}
+	appendFile(t, path, string(long))
+	p.readLines(tailer)
+	if len(tailer.partial) > fileTailMaxLine {
+		t.Error("FileTail: buffered ", len(tailer.partial), " bytes of a long line")
+	}
+
+	appendFile(t, path, "x\nshort\n")
+	p.readLines(tailer)
+	expectMessage(t, out, "short")
+	if tailer.offset != int64(len(long))+8 {
+		t.Error("FileTail: wrong offset ", tailer.offset)
+	}
+}
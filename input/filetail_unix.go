@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package input
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Identify a file by device and inode so renames do not confuse us
+func fileID(path string, fi os.FileInfo) string {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", st.Dev, st.Ino)
+	}
+	return path
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package input
+
+import (
+	"os"
+)
+
+// There are no inodes on windows, fall back to the path
+func fileID(path string, fi os.FileInfo) string {
+	return path
+}
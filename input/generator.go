@@ -0,0 +1,283 @@
+/*
+   - GENERATOR: Produce synthetic events for load testing and demos. Each field
+   is generated according to its type (sequence, random IP from CIDRs, random
+   choice, timestamp or fixed value). Events are produced at the given rate and
+   after `count` events the end of the stream is signaled. The random generator
+   is seeded so runs are reproducible.
+
+       {
+           "module": "GeneratorInput",
+           "rate": 1000,
+           "count": 100000,
+           "seed": 42,
+           "fields": {
+               "id": {"type": "sequence", "start": 1},
+               "src": {"type": "ip", "cidrs": ["10.0.0.0/8"]},
+               "method": {"type": "choice", "values": ["GET", "POST"]}
+           }
+       }
+*/
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering GeneratorInput")
+	core.GetRegistryInstance()["GeneratorInput"] = NewGeneratorInput
+}
+
+// Field description as found in the config
+type generatorFieldConfig struct {
+	Type string `json:"type"`
+	// sequence: first value (number), timestamp: first time (RFC3339)
+	Start interface{} `json:"start"`
+	// sequence: increment, timestamp: milliseconds between events
+	Step float64 `json:"step"`
+	// ip
+	CIDRs []string `json:"cidrs"`
+	// choice
+	Values  []interface{} `json:"values"`
+	Weights []float64     `json:"weights"`
+	// int
+	Min int64 `json:"min"`
+	Max int64 `json:"max"`
+	// timestamp: unix, unix_ms or a Go time layout
+	Format string `json:"format"`
+	// fixed
+	Value interface{} `json:"value"`
+}
+
+// Generates the value of a field for the n-th event
+type generatorFunc func(r *rand.Rand, n int64) interface{}
+
+type generatorField struct {
+	Name     string
+	Generate generatorFunc
+}
+
+type GeneratorInput struct {
+	*core.ComponentBase
+	// Events per second, 0 for as fast as possible
+	Rate float64
+	// Total events, 0 for no limit
+	Count int64
+	Seed  int64
+	// Optional template for Data["message"], ex "{src} {method}"
+	Message string
+	// Sorted by name so the random sequence does not depend on map order
+	fields []generatorField
+}
+
+func NewGeneratorInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating GeneratorInput")
+
+	rate, _ := cfg["rate"].(float64)
+	count, _ := cfg["count"].(float64)
+	message, _ := cfg["message"].(string)
+
+	seed := time.Now().UnixNano()
+	if tmp, ok := cfg["seed"].(float64); ok {
+		seed = int64(tmp)
+	}
+
+	fieldcfg := map[string]generatorFieldConfig{}
+	cfgbytes, _ := json.Marshal(cfg["fields"])
+	if err := json.Unmarshal(cfgbytes, &fieldcfg); err != nil {
+		panic("GeneratorInput: Invalid 'fields': " + err.Error())
+	}
+	if len(fieldcfg) == 0 {
+		panic("GeneratorInput: 'fields' is required")
+	}
+
+	names := []string{}
+	for name := range fieldcfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := []generatorField{}
+	for _, name := range names {
+		gen, err := newGeneratorFunc(fieldcfg[name])
+		if err != nil {
+			panic("GeneratorInput: Field '" + name + "': " + err.Error())
+		}
+		fields = append(fields, generatorField{name, gen})
+	}
+
+	m := &GeneratorInput{core.NewComponentBase(inQ, outQ, cfg),
+		rate, int64(count), seed, message, fields}
+
+	m.Tag = "IN-GENERATOR"
+
+	return m
+}
+
+func (p *GeneratorInput) Signal(string) {}
+
+func (p *GeneratorInput) Run() {
+	p.MustStop = false
+	log.Info("GENERATOR: Starting with seed ", p.Seed)
+
+	r := rand.New(rand.NewSource(p.Seed))
+	start := time.Now()
+
+	for n := int64(0); !p.MustStop && (p.Count == 0 || n < p.Count); n++ {
+		// Wait until it is time for the n-th event
+		if p.Rate > 0 {
+			due := start.Add(time.Duration(float64(n) / p.Rate * float64(time.Second)))
+			if wait := time.Until(due); wait > time.Millisecond {
+				time.Sleep(wait)
+			}
+		}
+
+		data := p.Generate(r, n)
+		p.OutQ <- core.NewEvent(data)
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	log.Info("GENERATOR: Done")
+	p.MustPrintStats()
+	p.EndOfStream()
+}
+
+// Generate the data of the n-th event
+func (p *GeneratorInput) Generate(r *rand.Rand, n int64) map[string]interface{} {
+	data := map[string]interface{}{}
+	for _, f := range p.fields {
+		data[f.Name] = f.Generate(r, n)
+	}
+
+	if p.Message == "" {
+		return data
+	}
+
+	pairs := []string{}
+	for k, v := range data {
+		pairs = append(pairs, "{"+k+"}", fmt.Sprint(v))
+	}
+	return map[string]interface{}{
+		"message": strings.NewReplacer(pairs...).Replace(p.Message)}
+}
+
+func newGeneratorFunc(c generatorFieldConfig) (generatorFunc, error) {
+	switch c.Type {
+	case "sequence":
+		first, _ := c.Start.(float64)
+		step := c.Step
+		if step == 0 {
+			step = 1
+		}
+		return func(r *rand.Rand, n int64) interface{} {
+			return int64(first + float64(n)*step)
+		}, nil
+
+	case "ip":
+		if len(c.CIDRs) == 0 {
+			return nil, fmt.Errorf("'cidrs' is required")
+		}
+		nets := []*net.IPNet{}
+		for _, cidr := range c.CIDRs {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, err
+			}
+			nets = append(nets, ipnet)
+		}
+		return func(r *rand.Rand, n int64) interface{} {
+			ipnet := nets[r.Intn(len(nets))]
+			ip := make(net.IP, len(ipnet.IP))
+			for i := range ip {
+				ip[i] = ipnet.IP[i] | byte(r.Intn(256))&^ipnet.Mask[i]
+			}
+			return ip.String()
+		}, nil
+
+	case "choice":
+		if len(c.Values) == 0 {
+			return nil, fmt.Errorf("'values' is required")
+		}
+		if c.Weights == nil {
+			return func(r *rand.Rand, n int64) interface{} {
+				return c.Values[r.Intn(len(c.Values))]
+			}, nil
+		}
+		if len(c.Weights) != len(c.Values) {
+			return nil, fmt.Errorf("'weights' and 'values' differ in length")
+		}
+		total := 0.0
+		for _, w := range c.Weights {
+			if w < 0 {
+				return nil, fmt.Errorf("negative weight")
+			}
+			total += w
+		}
+		return func(r *rand.Rand, n int64) interface{} {
+			x := r.Float64() * total
+			for i, w := range c.Weights {
+				if x < w {
+					return c.Values[i]
+				}
+				x -= w
+			}
+			return c.Values[len(c.Values)-1]
+		}, nil
+
+	case "int":
+		if c.Max < c.Min {
+			return nil, fmt.Errorf("'max' is less than 'min'")
+		}
+		// Int63n takes up to MaxInt64 values
+		if uint64(c.Max)-uint64(c.Min) >= math.MaxInt64 {
+			return nil, fmt.Errorf("the range of 'min' to 'max' is too large")
+		}
+		return func(r *rand.Rand, n int64) interface{} {
+			return c.Min + r.Int63n(c.Max-c.Min+1)
+		}, nil
+
+	case "timestamp":
+		// Without a start the current time is used
+		var first time.Time
+		if tmp, ok := c.Start.(string); ok {
+			var err error
+			if first, err = time.Parse(time.RFC3339, tmp); err != nil {
+				return nil, err
+			}
+		}
+		step := time.Duration(c.Step * float64(time.Millisecond))
+		return func(r *rand.Rand, n int64) interface{} {
+			ts := time.Now()
+			if !first.IsZero() {
+				ts = first.Add(time.Duration(n) * step)
+			}
+			switch c.Format {
+			case "", "unix":
+				return ts.Unix()
+			case "unix_ms":
+				return ts.UnixNano() / int64(time.Millisecond)
+			}
+			return ts.Format(c.Format)
+		}, nil
+
+	case "fixed":
+		return func(r *rand.Rand, n int64) interface{} {
+			return c.Value
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown type '%s'", c.Type)
+}
@@ -0,0 +1,110 @@
+package input
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+var generatorConfig = `{
+	"count": 20,
+	"seed": 7,
+	"fields": {
+		"id": {"type": "sequence", "start": 10, "step": 2},
+		"src": {"type": "ip", "cidrs": ["10.1.0.0/16", "2001:db8::/64"]},
+		"method": {"type": "choice", "values": ["GET", "POST"], "weights": [1, 0]},
+		"port": {"type": "int", "min": 1024, "max": 2048},
+		"ts": {"type": "timestamp", "start": "2017-07-14T02:40:00Z", "step": 1000, "format": "unix_ms"},
+		"host": {"type": "fixed", "value": "gen"}
+	}
+}`
+
+func generate(cfg string) []*core.Event {
+	out := make(chan *core.Event, 100)
+	NewGeneratorInput(nil, out, GetConfig(cfg)).Run()
+	return readAll(out)
+}
+
+func TestGenerator(t *testing.T) {
+	events := generate(generatorConfig)
+	if len(events) != 20 {
+		t.Fatal("Generator: expected 20 events, got ", len(events))
+	}
+
+	_, v4, _ := net.ParseCIDR("10.1.0.0/16")
+	_, v6, _ := net.ParseCIDR("2001:db8::/64")
+	for i, e := range events {
+		d := e.Data
+		if d["id"] != int64(10+2*i) || d["host"] != "gen" || d["method"] != "GET" {
+			t.Error("Generator: wrong fields ", d)
+		}
+		if d["ts"] != int64(1500000000000+1000*i) {
+			t.Error("Generator: wrong timestamp ", d["ts"])
+		}
+		if port := d["port"].(int64); port < 1024 || port > 2048 {
+			t.Error("Generator: int out of range ", port)
+		}
+		ip := net.ParseIP(d["src"].(string))
+		if !v4.Contains(ip) && !v6.Contains(ip) {
+			t.Error("Generator: IP out of range ", ip)
+		}
+	}
+
+	// Same seed, same events
+	again := generate(generatorConfig)
+	for i := range events {
+		if !reflect.DeepEqual(events[i].Data, again[i].Data) {
+			t.Error("Generator: not reproducible ", events[i].Data, again[i].Data)
+		}
+	}
+}
+
+func TestGeneratorMessage(t *testing.T) {
+	events := generate(`{
+		"count": 1,
+		"message": "{host} port {port}",
+		"fields": {
+			"host": {"type": "fixed", "value": "a"},
+			"port": {"type": "sequence", "start": 80}
+		}
+	}`)
+	if len(events) != 1 || events[0].Data["message"] != "a port 80" || len(events[0].Data) != 1 {
+		t.Error("Generator: wrong message ", events)
+	}
+}
+
+func TestGeneratorRate(t *testing.T) {
+	start := time.Now()
+	events := generate(`{"count": 11, "rate": 50, "fields": {"a": {"type": "fixed", "value": 1}}}`)
+	elapsed := time.Since(start)
+
+	if len(events) != 11 {
+		t.Error("Generator: expected 11 events, got ", len(events))
+	}
+	if elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Error("Generator: 11 events at 50/s took ", elapsed)
+	}
+}
+
+func TestGeneratorInvalid(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Generator: accepted unknown field type")
+		}
+	}()
+	NewGeneratorInput(nil, nil, GetConfig(`{"fields": {"a": {"type": "nope"}}}`))
+}
+
+func TestGeneratorIntRange(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Generator: accepted a range larger than int64")
+		}
+	}()
+	NewGeneratorInput(nil, nil, GetConfig(`{"fields": {"a": {"type": "int",
+		"min": -4611686018427387904, "max": 4611686018427387904}}}`))
+}
@@ -0,0 +1,450 @@
+/*
+   - HTTP: Listens for HTTP requests (webhooks). The body can be a single JSON
+   object, a JSON array (one event per element), new line delimited messages
+   (decoded with the component's LineCodec) or a url-encoded form. When the
+   pipeline is saturated, requests are rejected with 429/413 instead of
+   blocking. With `wait_for_ack` the response is only sent once all the events
+   of the request have been written by the outputs
+*/
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering HTTPJSONInput")
+	core.GetRegistryInstance()["HTTPJSONInput"] = NewHTTPJSONInput
+
+	log.Info("Registering HTTPCSVInput")
+	core.GetRegistryInstance()["HTTPCSVInput"] = NewHTTPCSVInput
+
+	log.Info("Registering HTTPStrInput")
+	core.GetRegistryInstance()["HTTPStrInput"] = NewHTTPStrInput
+
+	log.Info("Registering HTTPRawInput")
+	core.GetRegistryInstance()["HTTPRawInput"] = NewHTTPRawInput
+}
+
+// The base structure for HTTP inputs. The default implementation accepts JSON
+// objects, arrays and NDJSON
+type HTTPJSONInput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for decoding lines...
+	Decoder core.LineCodec
+	// Whether bodies starting with { or [ are parsed as JSON documents
+	DetectJSON   bool
+	Addr         string
+	Paths        []string
+	Methods      map[string]bool
+	AuthType     string
+	Username     string
+	Password     string
+	Token        string
+	MaxBodyBytes int64
+	// How long to wait for space in the queue before giving up
+	QueueTimeout time.Duration
+	// Answer only once the events are acked, waiting up to AckTimeout
+	WaitForAck bool
+	AckTimeout time.Duration
+	Server     *http.Server
+	lock       *sync.Mutex
+	// Held while a request is queued, so the space checked for a batch is
+	// not taken by another request
+	queueLock *sync.Mutex
+}
+
+func NewHTTPJSONInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating HTTPJSONInput")
+
+	host := "0.0.0.0"
+	if tmp, ok := cfg["listen"].(string); ok {
+		host = tmp
+	}
+
+	port, ok := cfg["port"].(float64)
+	if !ok {
+		panic("HTTPJSONInput: 'port' is required")
+	}
+
+	paths := []string{"/"}
+	if tmp, ok := cfg["paths"].([]interface{}); ok {
+		paths = core.InterfaceToStringArray(tmp)
+	}
+
+	methods := map[string]bool{"POST": true, "PUT": true}
+	if tmp, ok := cfg["methods"].([]interface{}); ok {
+		methods = map[string]bool{}
+		for _, m := range core.InterfaceToStringArray(tmp) {
+			methods[strings.ToUpper(m)] = true
+		}
+	}
+
+	auth_type, username, password, token := "", "", "", ""
+	if auth, ok := cfg["auth"].(map[string]interface{}); ok {
+		auth_type, _ = auth["type"].(string)
+		username, _ = auth["username"].(string)
+		password, _ = auth["password"].(string)
+		token, _ = auth["token"].(string)
+		switch auth_type {
+		case "basic", "bearer":
+		default:
+			panic("HTTPJSONInput: auth 'type' must be 'basic' or 'bearer'")
+		}
+	}
+
+	max_body := int64(10 * 1024 * 1024)
+	if tmp, ok := cfg["max_body_bytes"].(float64); ok {
+		max_body = int64(tmp)
+	}
+
+	queue_timeout := 1000
+	if tmp, ok := cfg["queue_timeout_ms"].(float64); ok {
+		queue_timeout = int(tmp)
+	}
+
+	wait_for_ack, _ := cfg["wait_for_ack"].(bool)
+
+	ack_timeout := 30000
+	if tmp, ok := cfg["ack_timeout_ms"].(float64); ok {
+		ack_timeout = int(tmp)
+	}
+
+	m := HTTPJSONInput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, true,
+		net.JoinHostPort(host, strconv.Itoa(int(port))),
+		paths, methods, auth_type, username, password, token, max_body,
+		time.Duration(queue_timeout) * time.Millisecond, wait_for_ack,
+		time.Duration(ack_timeout) * time.Millisecond, nil, &sync.Mutex{}, &sync.Mutex{}}
+
+	m.Tag = "IN-HTTP-JSON"
+
+	return &m
+}
+
+func (p *HTTPJSONInput) Signal(string) {}
+
+// Stop shuts the HTTP server down
+func (p *HTTPJSONInput) Stop() {
+	p.ComponentBase.Stop()
+	if p.Server != nil {
+		p.Server.Close()
+	}
+}
+
+func (p *HTTPJSONInput) Run() {
+	mux := http.NewServeMux()
+	for _, path := range p.Paths {
+		mux.HandleFunc(path, p.handle)
+	}
+
+	p.Server = &http.Server{Addr: p.Addr, Handler: mux}
+
+	log.Info("Listening on http://" + p.Addr)
+	err := p.Server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Error("Error listening:", err.Error())
+		return
+	}
+	log.Infof("%s: Stopping...", p.Tag)
+}
+
+// Check the credentials of a request
+func (p *HTTPJSONInput) authorized(r *http.Request) bool {
+	switch p.AuthType {
+	case "basic":
+		user, pass, ok := r.BasicAuth()
+		return ok &&
+			subtle.ConstantTimeCompare([]byte(user), []byte(p.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(pass), []byte(p.Password)) == 1
+	case "bearer":
+		h := r.Header.Get("Authorization")
+		if !strings.HasPrefix(h, "Bearer ") {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(h[7:]), []byte(p.Token)) == 1
+	}
+	return true
+}
+
+func (p *HTTPJSONInput) handle(w http.ResponseWriter, r *http.Request) {
+	if !p.Methods[r.Method] {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !p.authorized(r) {
+		if p.AuthType == "basic" {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gopipe"`)
+		}
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var body io.Reader = http.MaxBytesReader(w, r.Body, p.MaxBodyBytes)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			http.Error(w, "Invalid gzip body", http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		// Protect against gzip bombs as well
+		body = io.LimitReader(gz, p.MaxBodyBytes)
+	}
+
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, "Failed to read body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	records, err := p.decode(r.Header.Get("Content-Type"), raw)
+	if err != nil {
+		log.Error("Failed to decode data from " + r.RemoteAddr)
+		log.Error(err.Error())
+		http.Error(w, "Failed to decode body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// A batch is queued as a whole or not at all, so a sender can always retry
+	// a refused request without duplicating events
+	if len(records) > cap(p.OutQ) {
+		http.Error(w, fmt.Sprintf("Too many events in one request (%d, the queue holds %d)", len(records), cap(p.OutQ)),
+			http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Buffered, so late acks of a failed request do not block
+	acks := make(chan bool, len(records))
+
+	addr, port, _ := net.SplitHostPort(r.RemoteAddr)
+	events := make([]*core.Event, len(records))
+	for i, json_data := range records {
+		json_data["_from_addr"], json_data["_from_port"] = addr, port
+
+		events[i] = core.NewEvent(json_data)
+		if p.WaitForAck {
+			events[i].OnAck(func(ok bool) { acks <- ok })
+		}
+	}
+
+	// Wait for space for the whole batch, up to QueueTimeout
+	deadline := time.Now().Add(p.QueueTimeout)
+	for !p.enqueue(events) {
+		if time.Now().After(deadline) {
+			log.Warn("HTTP input: pipeline saturated, rejecting request from ", r.RemoteAddr)
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		time.Sleep(time.Duration(10) * time.Millisecond)
+	}
+	accepted := len(events)
+
+	if p.WaitForAck {
+		timeout := time.After(p.AckTimeout)
+		failed := 0
+		for i := 0; i < accepted; i++ {
+			select {
+			case ok := <-acks:
+				if !ok {
+					failed++
+				}
+			case <-timeout:
+				http.Error(w, fmt.Sprintf("Timed out waiting for %d of %d events to be written", accepted-i, accepted),
+					http.StatusGatewayTimeout)
+				return
+			}
+		}
+		if failed > 0 {
+			http.Error(w, fmt.Sprintf("Failed to write %d of %d events", failed, accepted),
+				http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"accepted": %d}`, accepted)
+}
+
+// Queue all the events if there is space for them. We are the only writer of
+// the queue, so once checked (under queueLock) the space cannot be taken
+func (p *HTTPJSONInput) enqueue(events []*core.Event) bool {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+
+	if cap(p.OutQ)-len(p.OutQ) < len(events) {
+		return false
+	}
+	for _, e := range events {
+		p.OutQ <- e
+	}
+
+	// Stats (handlers run concurrently)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for range events {
+		p.StatsAddMesg()
+	}
+	p.PrintStats()
+	return true
+}
+
+// Turn a request body into event data
+func (p *HTTPJSONInput) decode(contentType string, raw []byte) ([]map[string]interface{}, error) {
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") {
+		values, err := url.ParseQuery(string(raw))
+		if err != nil {
+			return nil, err
+		}
+		json_data := map[string]interface{}{}
+		for k, v := range values {
+			if len(v) == 1 {
+				json_data[k] = v[0]
+			} else {
+				json_data[k] = v
+			}
+		}
+		return []map[string]interface{}{json_data}, nil
+	}
+
+	trimmed := bytes.TrimSpace(raw)
+	isNDJSON := strings.HasPrefix(contentType, "application/x-ndjson")
+
+	if p.DetectJSON && !isNDJSON && len(trimmed) > 0 {
+		switch trimmed[0] {
+		case '[':
+			return decodeJSONArray(trimmed)
+		case '{':
+			// A single object, unless there is more after it (NDJSON)
+			var json_data map[string]interface{}
+			d := json.NewDecoder(bytes.NewReader(trimmed))
+			d.UseNumber()
+			if err := d.Decode(&json_data); err != nil {
+				return nil, err
+			}
+			if !d.More() {
+				return []map[string]interface{}{json_data}, nil
+			}
+		}
+	}
+
+	// One message per line
+	records := []map[string]interface{}{}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 65536), len(raw)+1)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		// Codecs may keep a reference (Raw)
+		line = append([]byte{}, line...)
+		json_data, err := p.Decoder.FromBytes(line)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, json_data)
+	}
+	return records, scanner.Err()
+}
+
+// Decode a JSON array of objects
+func decodeJSONArray(raw []byte) ([]map[string]interface{}, error) {
+	var items []interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&items); err != nil {
+		return nil, err
+	}
+
+	records := []map[string]interface{}{}
+	for _, item := range items {
+		json_data, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("JSON array elements must be objects")
+		}
+		records = append(records, json_data)
+	}
+	return records, nil
+}
+
+// HTTP CSV implementation: Each line of the body is a CSV record
+type HTTPCSVInput struct {
+	*HTTPJSONInput
+}
+
+func NewHTTPCSVInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating HTTPCSVInput")
+
+	// Defaults...
+	m := HTTPCSVInput{NewHTTPJSONInput(inQ, outQ, cfg).(*HTTPJSONInput)}
+
+	m.Tag = "IN-HTTP-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Decoder = c
+	m.DetectJSON = false
+
+	return &m
+}
+
+// HTTP Raw implementation: Each line of the body is a message
+type HTTPRawInput struct {
+	*HTTPJSONInput
+}
+
+func NewHTTPRawInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating HTTPRawInput")
+
+	// Defaults...
+	m := HTTPRawInput{NewHTTPJSONInput(inQ, outQ, cfg).(*HTTPJSONInput)}
+
+	m.Tag = "IN-HTTP-RAW"
+
+	m.Decoder = &core.RawLineCodec{}
+	m.DetectJSON = false
+
+	return &m
+}
+
+// HTTP String implementation: Each line of the body is a message
+type HTTPStrInput struct {
+	*HTTPJSONInput
+}
+
+func NewHTTPStrInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating HTTPStrInput")
+
+	// Defaults...
+	m := HTTPStrInput{NewHTTPJSONInput(inQ, outQ, cfg).(*HTTPJSONInput)}
+
+	m.Tag = "IN-HTTP-STR"
+
+	m.Decoder = &core.StringLineCodec{}
+	m.DetectJSON = false
+
+	return &m
+}
@@ -0,0 +1,200 @@
+package input
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func httpPost(p *HTTPJSONInput, ctype string, body []byte, hdr map[string]string) int {
+	req := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	req.Header.Set("Content-Type", ctype)
+	for k, v := range hdr {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	p.handle(w, req)
+	return w.Code
+}
+
+func TestHTTPJSONBodies(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewHTTPJSONInput(nil, out, GetConfig(`{"port": 0}`)).(*HTTPJSONInput)
+
+	if code := httpPost(comp, "application/json", []byte(`{"a": 1}`), nil); code != 200 {
+		t.Error("HTTP: single object rejected ", code)
+	}
+	if len(out) != 1 {
+		t.Error("HTTP: expected 1 event, got ", len(out))
+	}
+	<-out
+
+	if code := httpPost(comp, "application/json", []byte(`[{"a": 1}, {"a": 2}]`), nil); code != 200 {
+		t.Error("HTTP: array rejected ", code)
+	}
+	if len(out) != 2 {
+		t.Error("HTTP: expected 2 events, got ", len(out))
+	}
+	<-out
+	e := <-out
+	if e.Data["a"].(json.Number).String() != "2" {
+		t.Error("HTTP: wrong array element ", e.Data)
+	}
+
+	if code := httpPost(comp, "application/x-ndjson", []byte("{\"a\": 1}\n{\"a\": 2}\n{\"a\": 3}\n"), nil); code != 200 {
+		t.Error("HTTP: NDJSON rejected ", code)
+	}
+	if len(out) != 3 {
+		t.Error("HTTP: expected 3 events, got ", len(out))
+	}
+	<-out
+	<-out
+	<-out
+
+	if code := httpPost(comp, "application/x-www-form-urlencoded", []byte("a=1&b=2&b=3"), nil); code != 200 {
+		t.Error("HTTP: form rejected ", code)
+	}
+	e = <-out
+	if e.Data["a"] != "1" || len(e.Data["b"].([]string)) != 2 {
+		t.Error("HTTP: wrong form decoding ", e.Data)
+	}
+
+	if code := httpPost(comp, "application/json", []byte(`{"a": `), nil); code != 400 {
+		t.Error("HTTP: invalid JSON accepted ", code)
+	}
+}
+
+func TestHTTPGzip(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewHTTPJSONInput(nil, out, GetConfig(`{"port": 0}`)).(*HTTPJSONInput)
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(`{"a": 1}`))
+	gz.Close()
+
+	if code := httpPost(comp, "application/json", buf.Bytes(), map[string]string{"Content-Encoding": "gzip"}); code != 200 {
+		t.Error("HTTP: gzip body rejected ", code)
+	}
+	if len(out) != 1 {
+		t.Error("HTTP: expected 1 event, got ", len(out))
+	}
+}
+
+func TestHTTPAuth(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewHTTPJSONInput(nil, out, GetConfig(`{
+		"port": 0, "auth": {"type": "bearer", "token": "s3cr3t"}
+	}`)).(*HTTPJSONInput)
+
+	if code := httpPost(comp, "application/json", []byte(`{"a": 1}`), nil); code != 401 {
+		t.Error("HTTP: missing token accepted ", code)
+	}
+	if code := httpPost(comp, "application/json", []byte(`{"a": 1}`), map[string]string{"Authorization": "Bearer s3cr3t"}); code != 200 {
+		t.Error("HTTP: valid token rejected ", code)
+	}
+
+	comp = NewHTTPJSONInput(nil, out, GetConfig(`{
+		"port": 0, "auth": {"type": "basic", "username": "u", "password": "p"}
+	}`)).(*HTTPJSONInput)
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"a": 1}`))
+	req.SetBasicAuth("u", "p")
+	w := httptest.NewRecorder()
+	comp.handle(w, req)
+	if w.Code != 200 {
+		t.Error("HTTP: valid basic auth rejected ", w.Code)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.SetBasicAuth("u", "p")
+	w = httptest.NewRecorder()
+	comp.handle(w, req)
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Error("HTTP: GET accepted ", w.Code)
+	}
+}
+
+func TestHTTPSaturated(t *testing.T) {
+	out := make(chan *core.Event, 2)
+	comp := NewHTTPJSONInput(nil, out, GetConfig(`{"port": 0, "queue_timeout_ms": 10}`)).(*HTTPJSONInput)
+
+	out <- GetEvent(`{"a": 0}`)
+
+	// Does not fit in the space left: none of the batch is queued
+	if code := httpPost(comp, "application/json", []byte(`[{"a": 1}, {"a": 2}]`), nil); code != http.StatusTooManyRequests {
+		t.Error("HTTP: expected 429 got ", code)
+	}
+	if len(out) != 1 {
+		t.Error("HTTP: part of a refused batch queued ", len(out))
+	}
+
+	// Fits but nobody reads
+	out <- GetEvent(`{"a": 0}`)
+	if code := httpPost(comp, "application/json", []byte(`{"a": 1}`), nil); code != http.StatusTooManyRequests {
+		t.Error("HTTP: expected 429 got ", code)
+	}
+
+	// Larger than the queue, refused up front
+	<-out
+	<-out
+	if code := httpPost(comp, "application/json", []byte(`[{"a": 1}, {"a": 2}, {"a": 3}]`), nil); code != http.StatusRequestEntityTooLarge {
+		t.Error("HTTP: expected 413 got ", code)
+	}
+	if len(out) != 0 {
+		t.Error("HTTP: part of a refused batch queued ", len(out))
+	}
+}
+
+func TestHTTPStr(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewHTTPStrInput(nil, out, GetConfig(`{"port": 0}`)).(*HTTPStrInput)
+
+	if code := httpPost(comp.HTTPJSONInput, "text/plain", []byte("{not json}\nline2"), nil); code != 200 {
+		t.Error("HTTP: text rejected ", code)
+	}
+	if e := <-out; e.Data["message"] != "{not json}" {
+		t.Error("HTTP: wrong message ", e.Data)
+	}
+	if e := <-out; e.Data["message"] != "line2" {
+		t.Error("HTTP: wrong message ", e.Data)
+	}
+}
+
+func TestHTTPWaitForAck(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewHTTPJSONInput(nil, out, GetConfig(`{"port": 0, "wait_for_ack": true, "ack_timeout_ms": 200}`)).(*HTTPJSONInput)
+
+	// The answer is sent once the pipeline is done with every event
+	codes := make(chan int, 1)
+	post := func(body string) {
+		codes <- httpPost(comp, "application/json", []byte(body), nil)
+	}
+
+	go post(`[{"a": 1}, {"a": 2}]`)
+	(<-out).Ack()
+	(<-out).Ack()
+	if code := <-codes; code != 200 {
+		t.Error("HTTP: expected 200 got ", code)
+	}
+
+	go post(`[{"a": 1}, {"a": 2}]`)
+	(<-out).Ack()
+	(<-out).Nack()
+	if code := <-codes; code != http.StatusInternalServerError {
+		t.Error("HTTP: expected 500 got ", code)
+	}
+
+	go post(`{"a": 1}`)
+	<-out
+	if code := <-codes; code != http.StatusGatewayTimeout {
+		t.Error("HTTP: expected 504 got ", code)
+	}
+}
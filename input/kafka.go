@@ -1,13 +1,19 @@
 /*
-   - UDP: Listens on a UDP port for messages. Each packet is a separate message
-   and thus the message length is limitted by the packet length (and maybe
-   network MTU)
+   - KAFKA: Consume messages from Kafka topics (or topics matching a regex).
+   Events carry the message metadata (topic, partition, offset, key, headers
+   and timestamp). Offsets are stored only once the outputs have acked all the
+   messages up to them (at-least-once delivery) and committed periodically and
+   when partitions are revoked. The consumer lag of every assigned partition is
+   reported in the stats
 */
 package input
 
 import (
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	log "github.com/sirupsen/logrus"
@@ -28,12 +34,38 @@ func init() {
 	core.GetRegistryInstance()["KafkaStrInput"] = NewKafkaStrInput
 }
 
-// The base structure for common UDP Ops
+// An assigned partition
+type kafkaPartition struct {
+	topic     string
+	partition int32
+	acks      *core.AckTracker
+	// Set once revoked, acks arriving later are not stored
+	revoked int32
+}
+
+// The base structure for common Kafka Ops
 type KafkaJSONInput struct {
 	*core.ComponentBase
 	// Keep a referece to the struct responsible for decoding...
 	Decoder core.LineCodec
 	Kafka   *kafka.Consumer
+	// Topics or regular expressions (starting with ^)
+	Topics []string
+	// Where to start from: "earliest"/"latest" when the group has no committed
+	// offset or, if StartTime is set, the first message at or after StartTime
+	StartFrom string
+	StartTime time.Time
+	// How often to commit the stored offsets
+	CommitInterval time.Duration
+	// Messages tracked per partition before pausing and whether to commit
+	// past failed ones (see core.AckTracker)
+	MaxPending int
+	SkipFailed bool
+	// Assigned partitions (key: topic/partition)
+	partitions map[string]*kafkaPartition
+	// Partitions already moved to StartTime
+	started map[string]bool
+	lock    *sync.Mutex
 }
 
 func InterfaceToConfigMap(cfg interface{}) kafka.ConfigMap {
@@ -47,23 +79,77 @@ func InterfaceToConfigMap(cfg interface{}) kafka.ConfigMap {
 func NewKafkaJSONInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
 	log.Info("Creating KafkaJSONInput")
 
-	k, err := kafka.NewConsumer(&kafka.ConfigMap{
-		"bootstrap.servers":    cfg["brokers"].(string),
-		"group.id":             cfg["group"].(string),
-		"session.timeout.ms":   300000, // 5 mins
-		"default.topic.config": InterfaceToConfigMap(cfg["topic_conf"])})
+	brokers, ok := cfg["brokers"].(string)
+	if !ok {
+		panic("KafkaInput: 'brokers' is required")
+	}
+	group, ok := cfg["group"].(string)
+	if !ok {
+		panic("KafkaInput: 'group' is required")
+	}
+	tmp, ok := cfg["topics"].([]interface{})
+	if !ok || len(tmp) == 0 {
+		panic("KafkaInput: 'topics' is required")
+	}
+	topics := core.InterfaceToStringArray(tmp)
+
+	kafkaConfig := kafka.ConfigMap{
+		"bootstrap.servers": brokers,
+		"group.id":          group,
+		// Offsets are stored once acked and committed by us
+		"enable.auto.offset.store": false,
+		"enable.auto.commit":       false}
+
+	if tmp, ok := cfg["topic_conf"].(map[string]interface{}); ok {
+		kafkaConfig["default.topic.config"] = InterfaceToConfigMap(tmp)
+	}
+
+	start_from, _ := cfg["start_from"].(string)
+	var start_time time.Time
+	switch start_from {
+	case "":
+	case "earliest", "latest":
+		kafkaConfig["auto.offset.reset"] = start_from
+	default:
+		var err error
+		if start_time, err = time.Parse(time.RFC3339, start_from); err != nil {
+			panic("KafkaInput: 'start_from' must be earliest, latest or an RFC3339 time")
+		}
+	}
 
+	// Any librdkafka consumer setting can be given in consumer_conf
+	if tmp, ok := cfg["consumer_conf"].(map[string]interface{}); ok {
+		for k, v := range tmp {
+			kafkaConfig.SetKey(k, v)
+		}
+	}
+
+	commit_interval := 5000.0
+	if tmp, ok := cfg["commit_interval_ms"].(float64); ok {
+		commit_interval = tmp
+	}
+
+	max_pending := core.AckMaxPending
+	if tmp, ok := cfg["max_pending"].(float64); ok {
+		max_pending = int(tmp)
+	}
+	skip_failed, _ := cfg["skip_failed"].(bool)
+
+	k, err := kafka.NewConsumer(&kafkaConfig)
 	if err != nil {
 		panic(fmt.Sprintf("Failed to create consumer: %s\n", err))
 	}
 
 	m := KafkaJSONInput{core.NewComponentBase(inQ, outQ, cfg),
-		&core.JSONLineCodec{}, k}
+		&core.JSONLineCodec{}, k, topics, start_from, start_time,
+		time.Duration(commit_interval) * time.Millisecond, max_pending, skip_failed,
+		map[string]*kafkaPartition{}, map[string]bool{}, &sync.Mutex{}}
 
 	log.Infof("Created Consumer %v\n", m.Kafka)
 
-	topics := core.InterfaceToStringArray(cfg["topics"].([]interface{}))
-	err = m.Kafka.SubscribeTopics(topics, nil)
+	if err = m.Kafka.SubscribeTopics(topics, m.rebalance); err != nil {
+		panic(fmt.Sprintf("Failed to subscribe to %v: %s\n", topics, err))
+	}
 
 	m.Tag = "IN-KAFKA-JSON"
 
@@ -72,11 +158,196 @@ func NewKafkaJSONInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Con
 
 func (p *KafkaJSONInput) Signal(string) {}
 
-func (p *KafkaJSONInput) Run() {
+// Stop, releasing the loop if it is paused on a full tracker
+func (p *KafkaJSONInput) Stop() {
+	p.ComponentBase.Stop()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, part := range p.partitions {
+		if part.acks != nil {
+			part.acks.Close()
+		}
+	}
+}
+
+// Add the lag (messages not acked yet) of every assigned partition
+func (p *KafkaJSONInput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	// Do not hold the lock while asking the trackers: they call back into us
+	p.lock.Lock()
+	parts := []*kafkaPartition{}
+	for _, part := range p.partitions {
+		parts = append(parts, part)
+	}
+	p.lock.Unlock()
+
+	lag := map[string]int64{}
+	for _, part := range parts {
+		_, high, err := p.Kafka.GetWatermarkOffsets(part.topic, part.partition)
+		if err != nil || high < 0 || part.acks == nil {
+			continue
+		}
+		l := high - part.acks.Committed()
+		if l < 0 {
+			l = 0
+		}
+		lag[fmt.Sprintf("%s/%d", part.topic, part.partition)] = l
+	}
+	ret["Lag"] = lag
+	return ret
+}
+
+// Handle partition assignments and revocations. Called from Poll()
+func (p *KafkaJSONInput) rebalance(c *kafka.Consumer, ev kafka.Event) error {
+	switch ke := ev.(type) {
+	case kafka.AssignedPartitions:
+		log.Info("KAFKA-IN: Assigned ", ke.Partitions)
+		parts := ke.Partitions
+		if !p.StartTime.IsZero() {
+			parts = p.seekToTime(parts)
+		}
+
+		p.lock.Lock()
+		for _, tp := range parts {
+			key := fmt.Sprintf("%s/%d", *tp.Topic, tp.Partition)
+			p.partitions[key] = &kafkaPartition{*tp.Topic, tp.Partition, nil, 0}
+		}
+		p.lock.Unlock()
+
+		return c.Assign(parts)
+
+	case kafka.RevokedPartitions:
+		log.Info("KAFKA-IN: Revoked ", ke.Partitions)
+		// Last chance to commit what is acked so far
+		p.commit()
+
+		p.lock.Lock()
+		for _, tp := range ke.Partitions {
+			key := fmt.Sprintf("%s/%d", *tp.Topic, tp.Partition)
+			if part, ok := p.partitions[key]; ok {
+				atomic.StoreInt32(&part.revoked, 1)
+				delete(p.partitions, key)
+			}
+		}
+		p.lock.Unlock()
+
+		return c.Unassign()
+	}
+	return nil
+}
+
+// Move newly assigned partitions to the first offset at or after StartTime.
+// This is done once per partition, later assignments use the committed offsets
+func (p *KafkaJSONInput) seekToTime(parts []kafka.TopicPartition) []kafka.TopicPartition {
+	times := []kafka.TopicPartition{}
+	for _, tp := range parts {
+		key := fmt.Sprintf("%s/%d", *tp.Topic, tp.Partition)
+		if !p.started[key] {
+			times = append(times, kafka.TopicPartition{Topic: tp.Topic, Partition: tp.Partition,
+				Offset: kafka.Offset(p.StartTime.UnixNano() / int64(time.Millisecond))})
+		}
+	}
+	if len(times) == 0 {
+		return parts
+	}
+
+	offsets, err := p.Kafka.OffsetsForTimes(times, 10000)
+	if err != nil {
+		log.Error("KAFKA-IN: Failed to get offsets for ", p.StartTime, ": ", err.Error())
+		return parts
+	}
+
+	ret := []kafka.TopicPartition{}
+	for _, tp := range parts {
+		for _, o := range offsets {
+			if *o.Topic == *tp.Topic && o.Partition == tp.Partition && o.Error == nil {
+				tp.Offset = o.Offset
+				p.started[fmt.Sprintf("%s/%d", *tp.Topic, tp.Partition)] = true
+			}
+		}
+		ret = append(ret, tp)
+	}
+	return ret
+}
+
+// Commit the stored (acked) offsets
+func (p *KafkaJSONInput) commit() {
+	if _, err := p.Kafka.Commit(); err != nil {
+		// Nothing stored since the last commit is not an error
+		if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrNoOffset {
+			log.Error("KAFKA-IN: Failed to commit: ", err.Error())
+		}
+	}
+}
+
+// Get the ack tracker of a message's partition. Acked offsets are stored and
+// committed with the next commit
+func (p *KafkaJSONInput) tracker(tp kafka.TopicPartition) *core.AckTracker {
+	key := fmt.Sprintf("%s/%d", *tp.Topic, tp.Partition)
 
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	part, ok := p.partitions[key]
+	if !ok {
+		// Not seen in a rebalance (ex. manually assigned)
+		part = &kafkaPartition{*tp.Topic, tp.Partition, nil, 0}
+		p.partitions[key] = part
+	}
+	if part.acks != nil {
+		return part.acks
+	}
+
+	part.acks = core.NewAckTracker(int64(tp.Offset), func(offset int64) {
+		if atomic.LoadInt32(&part.revoked) != 0 {
+			log.Debug("KAFKA-IN: Not storing offset ", offset, " of revoked ", key)
+			return
+		}
+		_, err := p.Kafka.StoreOffsets([]kafka.TopicPartition{
+			{Topic: &part.topic, Partition: part.partition, Offset: kafka.Offset(offset)}})
+		if err != nil {
+			log.Error("Failed to store offset ", offset, " of ", key, ": ", err.Error())
+		}
+	})
+	part.acks.MaxPending = p.MaxPending
+	part.acks.SkipFailed = p.SkipFailed
+	return part.acks
+}
+
+// Message metadata as event fields
+func kafkaMetadata(msg *kafka.Message, data map[string]interface{}) {
+	data["_kafka_topic"] = *msg.TopicPartition.Topic
+	data["_kafka_partition"] = msg.TopicPartition.Partition
+	data["_kafka_offset"] = int64(msg.TopicPartition.Offset)
+	if msg.Key != nil {
+		data["_kafka_key"] = string(msg.Key)
+	}
+	if len(msg.Headers) > 0 {
+		headers := map[string]interface{}{}
+		for _, h := range msg.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		data["_kafka_headers"] = headers
+	}
+	if msg.TimestampType != kafka.TimestampNotAvailable {
+		data["_kafka_timestamp"] = msg.Timestamp.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+func (p *KafkaJSONInput) Run() {
+	p.MustStop = false
 	log.Info("Starting Kafka loop")
 
+	last_commit := time.Now()
+
 	for !p.MustStop {
+		if time.Since(last_commit) >= p.CommitInterval {
+			p.commit()
+			last_commit = time.Now()
+		}
+
 		ev := p.Kafka.Poll(100)
 		if ev == nil {
 			continue
@@ -84,18 +355,25 @@ func (p *KafkaJSONInput) Run() {
 
 		switch ke := ev.(type) {
 		case *kafka.Message:
-			// fmt.Printf("%% Message on %s:\n%s\n",
-			// 	ke.TopicPartition, string(ke.Value))
+			// The offset to commit is the next one to read
+			acks := p.tracker(ke.TopicPartition)
+			next := int64(ke.TopicPartition.Offset) + 1
 
 			json_data, err := p.Decoder.FromBytes(ke.Value)
 			if err != nil {
 				log.Error("Failed to decode data from kafka")
 				log.Error("   data: " + string(ke.Value))
 				log.Error(err.Error())
+				acks.Skip(next)
 				continue
 			}
+			kafkaMetadata(ke, json_data)
 
 			e := core.NewEvent(json_data)
+			if ke.TimestampType != kafka.TimestampNotAvailable {
+				e.Timestamp = ke.Timestamp
+			}
+			acks.Track(e, next)
 			p.OutQ <- e
 
 			// Stats
@@ -106,11 +384,13 @@ func (p *KafkaJSONInput) Run() {
 			log.Debugf("%% Reached %v\n", ke)
 		case kafka.Error:
 			log.Errorf("%% Error: %v\n", ke)
-			break
 		default:
-			log.Warnf("Ignored %v\n", ke)
+			log.Debugf("Ignored %v\n", ke)
 		}
 	}
+
+	p.commit()
+	log.Info("KAFKA-IN: Stopped")
 }
 
 /*
@@ -0,0 +1,68 @@
+package input
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestKafkaInput(t *testing.T) {
+	mc, err := kafka.NewMockCluster(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	producer, err := kafka.NewProducer(&kafka.ConfigMap{"bootstrap.servers": mc.BootstrapServers()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic := "test-in"
+	for i := 0; i < 2; i++ {
+		producer.Produce(&kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: 0},
+			Key:            []byte("k"),
+			Value:          []byte(fmt.Sprintf(`{"a": %d}`, i)),
+			Headers:        []kafka.Header{{Key: "h", Value: []byte("v")}},
+		}, nil)
+	}
+	producer.Flush(10000)
+	producer.Close()
+
+	out := make(chan *core.Event, 10)
+	comp := NewKafkaJSONInput(nil, out, GetConfig(fmt.Sprintf(`{
+		"brokers": "%s", "group": "gopipe-test", "topics": ["^test-.*"],
+		"start_from": "earliest", "commit_interval_ms": 100
+	}`, mc.BootstrapServers()))).(*KafkaJSONInput)
+	go comp.Run()
+	defer comp.Stop()
+
+	for i := 0; i < 2; i++ {
+		var e *core.Event
+		select {
+		case e = <-out:
+		case <-time.After(30 * time.Second):
+			t.Fatal("Kafka: no message consumed")
+		}
+		d := e.Data
+		if d["_kafka_topic"] != topic || d["_kafka_partition"] != int32(0) || d["_kafka_offset"] != int64(i) {
+			t.Error("Kafka: wrong metadata ", d)
+		}
+		if d["_kafka_key"] != "k" || d["_kafka_headers"].(map[string]interface{})["h"] != "v" {
+			t.Error("Kafka: wrong key/headers ", d)
+		}
+		if i == 0 {
+			e.Ack()
+		}
+	}
+
+	// The second message is not acked: it is still lagging
+	lag := comp.GetStatsJSON()["Lag"].(map[string]int64)
+	if lag["test-in/0"] != 1 {
+		t.Error("Kafka: wrong lag ", lag)
+	}
+}
@@ -0,0 +1,550 @@
+/*
+   - PCAP: Read UDP packets from pcap or pcapng capture files (ex tcpdump -w).
+   Link, IP and UDP headers are stripped and each UDP payload is emitted in
+   `Data["bytes"]` (like UDPRawInput) with the original addresses/ports and the
+   capture time as the event timestamp. Optionally, packets are replayed with
+   their original timing. At the end of the files the end of the stream is
+   signaled.
+
+       {
+           "module": "PcapFileInput",
+           "path": "/tmp/netflow-*.pcap",
+           "port": 2055,
+           "replay": true,
+           "speed": 2.0
+       }
+*/
+package input
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering PcapFileInput")
+	core.GetRegistryInstance()["PcapFileInput"] = NewPcapFileInput
+}
+
+// Link types we can strip
+const (
+	linkNull     = 0
+	linkEthernet = 1
+	linkRaw      = 101
+	linkLoop     = 108
+	linkSLL      = 113
+	linkIPv4     = 228
+	linkIPv6     = 229
+	linkSLL2     = 276
+)
+
+// Largest packet we accept from a file, anything bigger means corruption
+const pcapMaxPacket = 262144
+
+var errPcapSkip = errors.New("not an UDP packet")
+var errPcapFragment = errors.New("fragmented packet")
+var errPcapTruncated = errors.New("truncated packet")
+
+type PcapFileInput struct {
+	*core.ComponentBase
+	// File path, can be a glob. Matching files are read in order
+	Path string
+	// Only emit packets sent to this port (0 for all)
+	Port uint16
+	// Replay with the original timing, Speed times faster
+	Replay bool
+	Speed  float64
+	// Packets per outcome
+	Packets   uint64
+	NotUDP    uint64
+	Fragments uint64
+	Truncated uint64
+	lock      *sync.Mutex
+}
+
+func NewPcapFileInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating PcapFileInput")
+
+	path, ok := cfg["path"].(string)
+	if !ok || path == "" {
+		panic("PcapFileInput: 'path' is required")
+	}
+
+	port := uint16(0)
+	if tmp, ok := cfg["port"].(float64); ok {
+		port = uint16(tmp)
+	}
+
+	replay, _ := cfg["replay"].(bool)
+
+	speed := 1.0
+	if tmp, ok := cfg["speed"].(float64); ok {
+		speed = tmp
+	}
+	if speed <= 0 {
+		panic("PcapFileInput: 'speed' must be positive")
+	}
+
+	m := &PcapFileInput{core.NewComponentBase(inQ, outQ, cfg), path, port,
+		replay, speed, 0, 0, 0, 0, &sync.Mutex{}}
+
+	m.Tag = "IN-PCAP"
+
+	return m
+}
+
+func (p *PcapFileInput) Signal(string) {}
+
+// Add the packet counters to the component stats
+func (p *PcapFileInput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Packets"] = p.Packets
+	ret["NotUDP"] = p.NotUDP
+	ret["Fragments"] = p.Fragments
+	ret["Truncated"] = p.Truncated
+	return ret
+}
+
+func (p *PcapFileInput) Run() {
+	p.MustStop = false
+
+	files, err := filepath.Glob(p.Path)
+	if err != nil {
+		log.Error("PCAP: Invalid path ", p.Path, ": ", err.Error())
+	}
+	if len(files) == 0 {
+		log.Error("PCAP: No files matching ", p.Path)
+	}
+	sort.Strings(files)
+
+	// Replay clock: first capture time and when we sent it
+	var first, start time.Time
+
+	for _, file := range files {
+		if p.MustStop {
+			break
+		}
+
+		log.Info("PCAP: Reading ", file)
+		f, err := os.Open(file)
+		if err != nil {
+			log.Error("PCAP: Failed to open ", file, ": ", err.Error())
+			continue
+		}
+
+		reader, err := newPcapReader(bufio.NewReader(f))
+		if err != nil {
+			log.Error("PCAP: ", file, ": ", err.Error())
+			f.Close()
+			continue
+		}
+
+		for !p.MustStop {
+			pkt, err := reader.Next()
+			if err != nil {
+				if err != io.EOF {
+					log.Error("PCAP: ", file, ": ", err.Error())
+				}
+				break
+			}
+
+			data, err := pcapUDPPayload(pkt)
+			p.lock.Lock()
+			p.Packets++
+			switch err {
+			case errPcapSkip:
+				p.NotUDP++
+			case errPcapFragment:
+				p.Fragments++
+			case errPcapTruncated:
+				p.Truncated++
+			}
+			p.lock.Unlock()
+
+			if err != nil {
+				continue
+			}
+			if p.Port != 0 && data["_to_port"] != strconv.Itoa(int(p.Port)) {
+				continue
+			}
+
+			if p.Replay {
+				if first.IsZero() {
+					first = pkt.ts
+					start = time.Now()
+				}
+				p.wait(start.Add(time.Duration(float64(pkt.ts.Sub(first)) / p.Speed)))
+			}
+
+			e := core.NewEvent(data)
+			e.Timestamp = pkt.ts
+			p.OutQ <- e
+
+			// Stats
+			p.StatsAddMesg()
+			p.PrintStats()
+		}
+		f.Close()
+	}
+
+	log.Info("PCAP: End of input")
+	p.MustPrintStats()
+	p.EndOfStream()
+}
+
+// Sleep until the given time, in small steps so we can be stopped
+func (p *PcapFileInput) wait(until time.Time) {
+	for !p.MustStop {
+		left := time.Until(until)
+		if left <= 0 {
+			return
+		}
+		if left > 100*time.Millisecond {
+			left = 100 * time.Millisecond
+		}
+		time.Sleep(left)
+	}
+}
+
+// A captured frame
+type pcapPacket struct {
+	ts   time.Time
+	link uint32
+	data []byte
+}
+
+type pcapReader interface {
+	Next() (*pcapPacket, error)
+}
+
+// Detect the file format from its magic number
+func newPcapReader(r *bufio.Reader) (pcapReader, error) {
+	magic, err := r.Peek(4)
+	if err != nil {
+		return nil, errors.New("file too short")
+	}
+
+	switch binary.BigEndian.Uint32(magic) {
+	case 0x0a0d0d0a:
+		return &pcapNGReader{r: r, order: binary.LittleEndian}, nil
+	case 0xa1b2c3d4, 0xd4c3b2a1, 0xa1b23c4d, 0x4d3cb2a1:
+		return newPcapClassicReader(r)
+	}
+	return nil, fmt.Errorf("unknown file format (magic %x)", magic)
+}
+
+// Classic libpcap format
+type pcapClassicReader struct {
+	r     io.Reader
+	order binary.ByteOrder
+	nano  bool
+	link  uint32
+}
+
+func newPcapClassicReader(r io.Reader) (*pcapClassicReader, error) {
+	hdr := make([]byte, 24)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, errors.New("short file header")
+	}
+
+	p := &pcapClassicReader{r: r, order: binary.LittleEndian}
+	magic := p.order.Uint32(hdr)
+	if magic != 0xa1b2c3d4 && magic != 0xa1b23c4d {
+		p.order = binary.BigEndian
+		magic = p.order.Uint32(hdr)
+	}
+	p.nano = magic == 0xa1b23c4d
+	// Upper bits may carry FCS information
+	p.link = p.order.Uint32(hdr[20:]) & 0x0fffffff
+	return p, nil
+}
+
+func (p *pcapClassicReader) Next() (*pcapPacket, error) {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("short packet header")
+		}
+		return nil, err
+	}
+
+	sec := int64(p.order.Uint32(hdr))
+	frac := int64(p.order.Uint32(hdr[4:]))
+	length := p.order.Uint32(hdr[8:])
+	if length > pcapMaxPacket {
+		return nil, fmt.Errorf("invalid packet length %d", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, errors.New("short packet")
+	}
+
+	if !p.nano {
+		frac *= 1000
+	}
+	return &pcapPacket{time.Unix(sec, frac), p.link, data}, nil
+}
+
+// pcapng format
+type pcapNGInterface struct {
+	link uint32
+	// Timestamp units per second
+	res uint64
+}
+
+type pcapNGReader struct {
+	r      io.Reader
+	order  binary.ByteOrder
+	ifaces []pcapNGInterface
+	// Simple packet blocks have no timestamp, we use the last one seen
+	last time.Time
+}
+
+// Read a block and return its type and body (without the trailing length)
+func (p *pcapNGReader) block() (uint32, []byte, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(p.r, hdr); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, errors.New("short block header")
+		}
+		return 0, nil, err
+	}
+
+	btype := p.order.Uint32(hdr)
+	if btype == 0x0a0d0d0a {
+		// Section header: the byte order magic tells us how to read the rest
+		magic := make([]byte, 4)
+		if _, err := io.ReadFull(p.r, magic); err != nil {
+			return 0, nil, errors.New("short section header")
+		}
+		p.order = binary.LittleEndian
+		if p.order.Uint32(magic) != 0x1a2b3c4d {
+			p.order = binary.BigEndian
+		}
+		p.ifaces = nil
+		hdr = append(hdr, magic...)
+	}
+
+	length := p.order.Uint32(hdr[4:])
+	if length < uint32(len(hdr))+4 || length%4 != 0 || length > pcapMaxPacket+1024 {
+		return 0, nil, fmt.Errorf("invalid block length %d", length)
+	}
+
+	body := make([]byte, length-uint32(len(hdr)))
+	if _, err := io.ReadFull(p.r, body); err != nil {
+		return 0, nil, errors.New("short block")
+	}
+	return btype, body[:len(body)-4], nil
+}
+
+func (p *pcapNGReader) Next() (*pcapPacket, error) {
+	for {
+		btype, body, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+
+		switch btype {
+		case 1:
+			// Interface description
+			if len(body) < 8 {
+				return nil, errors.New("short interface block")
+			}
+			p.ifaces = append(p.ifaces, pcapNGInterface{
+				uint32(p.order.Uint16(body)), pcapNGResolution(p.order, body[8:])})
+		case 6:
+			// Enhanced packet
+			if len(body) < 20 {
+				return nil, errors.New("short packet block")
+			}
+			iface := p.order.Uint32(body)
+			if int(iface) >= len(p.ifaces) {
+				return nil, fmt.Errorf("packet for unknown interface %d", iface)
+			}
+			length := p.order.Uint32(body[12:])
+			if int(length) > len(body)-20 {
+				return nil, errors.New("invalid packet length")
+			}
+
+			units := uint64(p.order.Uint32(body[4:]))<<32 | uint64(p.order.Uint32(body[8:]))
+			p.last = pcapNGTime(units, p.ifaces[iface].res)
+			return &pcapPacket{p.last, p.ifaces[iface].link, body[20 : 20+length]}, nil
+		case 3:
+			// Simple packet (always on the first interface)
+			if len(body) < 4 || len(p.ifaces) == 0 {
+				return nil, errors.New("invalid simple packet block")
+			}
+			data := body[4:]
+			if length := p.order.Uint32(body); int(length) < len(data) {
+				data = data[:length]
+			}
+			return &pcapPacket{p.last, p.ifaces[0].link, data}, nil
+		}
+	}
+}
+
+// Get the timestamp resolution from the interface options (if_tsresol)
+func pcapNGResolution(order binary.ByteOrder, opts []byte) uint64 {
+	for len(opts) >= 4 {
+		code := order.Uint16(opts)
+		length := int(order.Uint16(opts[2:]))
+		if code == 0 || len(opts) < 4+length {
+			break
+		}
+		if code == 9 && length >= 1 {
+			exp := opts[4]
+			if exp&0x80 != 0 && exp&0x7f < 64 {
+				return 1 << (exp & 0x7f)
+			}
+			if exp&0x80 == 0 && exp <= 19 {
+				res := uint64(1)
+				for i := byte(0); i < exp; i++ {
+					res *= 10
+				}
+				return res
+			}
+		}
+		opts = opts[4+(length+3)&^3:]
+	}
+	// Microseconds
+	return 1000000
+}
+
+func pcapNGTime(units uint64, res uint64) time.Time {
+	sec := units / res
+	frac := units % res
+	if res <= 1000000000 {
+		frac = frac * 1000000000 / res
+	} else {
+		frac = frac / (res / 1000000000)
+	}
+	return time.Unix(int64(sec), int64(frac))
+}
+
+// Strip the link, IP and UDP headers and return the event data
+func pcapUDPPayload(pkt *pcapPacket) (map[string]interface{}, error) {
+	b := pkt.data
+	var etype uint16
+
+	switch pkt.link {
+	case linkEthernet:
+		if len(b) < 14 {
+			return nil, errPcapTruncated
+		}
+		etype = binary.BigEndian.Uint16(b[12:])
+		b = b[14:]
+		for (etype == 0x8100 || etype == 0x88a8) && len(b) >= 4 {
+			etype = binary.BigEndian.Uint16(b[2:])
+			b = b[4:]
+		}
+	case linkSLL:
+		if len(b) < 16 {
+			return nil, errPcapTruncated
+		}
+		etype = binary.BigEndian.Uint16(b[14:])
+		b = b[16:]
+	case linkSLL2:
+		if len(b) < 20 {
+			return nil, errPcapTruncated
+		}
+		etype = binary.BigEndian.Uint16(b)
+		b = b[20:]
+	case linkNull, linkLoop:
+		// The address family is in host order, look at the IP version instead
+		if len(b) < 4 {
+			return nil, errPcapTruncated
+		}
+		b = b[4:]
+	case linkRaw, linkIPv4, linkIPv6:
+	default:
+		return nil, errPcapSkip
+	}
+
+	if etype != 0 && etype != 0x0800 && etype != 0x86dd {
+		return nil, errPcapSkip
+	}
+	if len(b) == 0 {
+		return nil, errPcapTruncated
+	}
+
+	var src, dst net.IP
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return nil, errPcapTruncated
+		}
+		ihl := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:]))
+		if ihl < 20 || total < ihl || len(b) < total {
+			return nil, errPcapTruncated
+		}
+		if b[9] != 17 {
+			return nil, errPcapSkip
+		}
+		// More fragments or non-zero offset
+		if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+			return nil, errPcapFragment
+		}
+		src = net.IP(b[12:16])
+		dst = net.IP(b[16:20])
+		// Ignore the link layer padding
+		b = b[ihl:total]
+	case 6:
+		if len(b) < 40 {
+			return nil, errPcapTruncated
+		}
+		src = net.IP(b[8:24])
+		dst = net.IP(b[24:40])
+		next := b[6]
+		b = b[40:]
+		for next == 0 || next == 43 || next == 60 {
+			if len(b) < 8 || len(b) < (int(b[1])+1)*8 {
+				return nil, errPcapTruncated
+			}
+			next = b[0]
+			b = b[(int(b[1])+1)*8:]
+		}
+		if next == 44 {
+			return nil, errPcapFragment
+		}
+		if next != 17 {
+			return nil, errPcapSkip
+		}
+	default:
+		return nil, errPcapSkip
+	}
+
+	if len(b) < 8 {
+		return nil, errPcapTruncated
+	}
+	length := int(binary.BigEndian.Uint16(b[4:]))
+	if length < 8 || length > len(b) {
+		return nil, errPcapTruncated
+	}
+
+	return map[string]interface{}{
+		"bytes":      b[8:length],
+		"_from_addr": src.String(),
+		"_from_port": strconv.Itoa(int(binary.BigEndian.Uint16(b))),
+		"_to_addr":   dst.String(),
+		"_to_port":   strconv.Itoa(int(binary.BigEndian.Uint16(b[2:]))),
+	}, nil
+}
@@ -0,0 +1,178 @@
+package input
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// Helper to write values in the given byte order
+func pcapBytes(order binary.ByteOrder, vals ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range vals {
+		binary.Write(&buf, order, v)
+	}
+	return buf.Bytes()
+}
+
+// Ethernet + IPv4 + UDP/TCP frame
+func pcapFrame(proto uint8, dport uint16, payload string) []byte {
+	l4 := pcapBytes(binary.BigEndian, uint16(5000), dport, uint16(8+len(payload)), uint16(0))
+	if proto == 6 {
+		l4 = append(l4, make([]byte, 12)...)
+	}
+	l4 = append(l4, payload...)
+	ip := pcapBytes(binary.BigEndian, uint8(0x45), uint8(0), uint16(20+len(l4)), uint16(1),
+		uint16(0x4000), uint8(64), proto, uint16(0), [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2})
+	eth := pcapBytes(binary.BigEndian, [6]byte{}, [6]byte{}, uint16(0x0800))
+	frame := append(append(eth, ip...), l4...)
+	// Ethernet padding must be ignored
+	return append(frame, 0, 0, 0, 0)
+}
+
+// Classic pcap, little endian, microseconds
+func pcapFile(t *testing.T, dir string, ts []time.Time, frames ...[]byte) string {
+	buf := pcapBytes(binary.LittleEndian, uint32(0xa1b2c3d4), uint16(2), uint16(4),
+		int32(0), uint32(0), uint32(65535), uint32(1))
+	for i, f := range frames {
+		buf = append(buf, pcapBytes(binary.LittleEndian, uint32(ts[i].Unix()),
+			uint32(ts[i].Nanosecond()/1000), uint32(len(f)), uint32(len(f)))...)
+		buf = append(buf, f...)
+	}
+
+	path := filepath.Join(dir, "test.pcap")
+	if err := ioutil.WriteFile(path, buf, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func readAll(ch chan *core.Event) []*core.Event {
+	var ret []*core.Event
+	for e := range ch {
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func TestPcapFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := time.Unix(1500000000, 250000000)
+	pcapFile(t, dir, []time.Time{ts, ts, ts},
+		pcapFrame(17, 2055, "hello"), pcapFrame(6, 2055, "tcp"), pcapFrame(17, 9999, "other"))
+
+	out := make(chan *core.Event, 10)
+	comp := NewPcapFileInput(nil, out, GetConfig(`{"path": "`+dir+`/*.pcap", "port": 2055}`))
+	comp.Run()
+
+	events := readAll(out)
+	if len(events) != 1 {
+		t.Fatal("PCAP: expected 1 event, got ", len(events))
+	}
+	e := events[0]
+	if string(e.Data["bytes"].([]byte)) != "hello" {
+		t.Error("PCAP: wrong payload ", e.Data)
+	}
+	if e.Data["_from_addr"] != "10.0.0.1" || e.Data["_from_port"] != "5000" || e.Data["_to_port"] != "2055" {
+		t.Error("PCAP: wrong addresses ", e.Data)
+	}
+	if !e.Timestamp.Equal(ts) {
+		t.Error("PCAP: wrong timestamp ", e.Timestamp)
+	}
+
+	stats := comp.(*PcapFileInput).GetStatsJSON()
+	if stats["Packets"] != uint64(3) || stats["NotUDP"] != uint64(1) {
+		t.Error("PCAP: wrong stats ", stats)
+	}
+}
+
+func TestPcapReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ts := time.Unix(1500000000, 0)
+	path := pcapFile(t, dir, []time.Time{ts, ts.Add(time.Second)},
+		pcapFrame(17, 2055, "a"), pcapFrame(17, 2055, "b"))
+
+	out := make(chan *core.Event, 10)
+	comp := NewPcapFileInput(nil, out, GetConfig(`{"path": "`+path+`", "replay": true, "speed": 5}`))
+
+	start := time.Now()
+	comp.Run()
+	elapsed := time.Since(start)
+
+	if len(readAll(out)) != 2 {
+		t.Error("PCAP: expected 2 events")
+	}
+	if elapsed < 180*time.Millisecond || elapsed > time.Second {
+		t.Error("PCAP: replay took ", elapsed)
+	}
+}
+
+func TestPcapNG(t *testing.T) {
+	order := binary.LittleEndian
+	block := func(btype uint32, body []byte) []byte {
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+		l := uint32(12 + len(body))
+		return append(append(pcapBytes(order, btype, l), body...), pcapBytes(order, l)...)
+	}
+
+	// Raw IPv6 + UDP, nanosecond resolution
+	payload := "over v6"
+	udp := append(pcapBytes(binary.BigEndian, uint16(1234), uint16(4739), uint16(8+len(payload)), uint16(0)), payload...)
+	src := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+	ip := append(pcapBytes(binary.BigEndian, uint32(0x60000000), uint16(len(udp)), uint8(17), uint8(64),
+		src, [16]byte{15: 2}), udp...)
+
+	units := uint64(1500000000123456789)
+	var buf []byte
+	buf = append(buf, block(0x0a0d0d0a, pcapBytes(order, uint32(0x1a2b3c4d), uint16(1), uint16(0), int64(-1)))...)
+	buf = append(buf, block(1, pcapBytes(order, uint16(linkRaw), uint16(0), uint32(65535),
+		uint16(9), uint16(1), uint8(9), [3]byte{}, uint16(0), uint16(0)))...)
+	// Unknown blocks are skipped
+	buf = append(buf, block(5, []byte{1, 2, 3, 4})...)
+	buf = append(buf, block(6, append(pcapBytes(order, uint32(0), uint32(units>>32), uint32(units),
+		uint32(len(ip)), uint32(len(ip))), ip...))...)
+
+	reader, err := newPcapReader(bufio.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := reader.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pkt.ts.UnixNano() != int64(units) {
+		t.Error("PCAPNG: wrong timestamp ", pkt.ts.UnixNano())
+	}
+
+	data, err := pcapUDPPayload(pkt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data["bytes"].([]byte)) != payload || data["_from_addr"] != "2001:db8::1" || data["_to_port"] != "4739" {
+		t.Error("PCAPNG: wrong packet ", data)
+	}
+
+	if _, err = reader.Next(); err == nil {
+		t.Error("PCAPNG: expected end of file")
+	}
+}
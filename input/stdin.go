@@ -0,0 +1,173 @@
+/*
+   - STDIN: Read messages from the standard input. Each line is processed as a
+   separate message (same framing as TCP). When stdin is closed the end of the
+   stream is signaled, the pipeline drains and gopipe exits. Useful in shell
+   pipelines:
+
+       zcat dump.gz | gopipe -c enrich.json > out.jsonl
+*/
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering StdinJSONInput")
+	core.GetRegistryInstance()["StdinJSONInput"] = NewStdinJSONInput
+
+	log.Info("Registering StdinCSVInput")
+	core.GetRegistryInstance()["StdinCSVInput"] = NewStdinCSVInput
+
+	log.Info("Registering StdinStrInput")
+	core.GetRegistryInstance()["StdinStrInput"] = NewStdinStrInput
+
+	log.Info("Registering StdinRawInput")
+	core.GetRegistryInstance()["StdinRawInput"] = NewStdinRawInput
+}
+
+// The base structure for reading stdin. The default implementation is using
+// JSON message format
+type StdinJSONInput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for decoding...
+	Decoder core.LineCodec
+	// Where we read from (os.Stdin unless testing)
+	Reader io.Reader
+	// Maximum line length
+	MaxLine int
+}
+
+func NewStdinJSONInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdinJSONInput")
+
+	max_line := 65000
+	if tmp, ok := cfg["max_line"].(float64); ok {
+		max_line = int(tmp)
+	}
+
+	m := StdinJSONInput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, os.Stdin, max_line}
+
+	m.Tag = "IN-STDIN-JSON"
+
+	return &m
+}
+
+func (p *StdinJSONInput) Signal(string) {}
+
+func (p *StdinJSONInput) Run() {
+	p.MustStop = false
+	reader := bufio.NewReader(p.Reader)
+	var tmpdata []byte
+
+	for !p.MustStop {
+		linedata, is_prefix, err := reader.ReadLine()
+
+		if err != nil {
+			if err != io.EOF {
+				log.Error("STDIN: Read error: ", err.Error())
+			}
+			break
+		}
+
+		if is_prefix {
+			tmpdata = append(tmpdata, linedata...)
+			continue
+		}
+
+		tmpdata = append(tmpdata, linedata...)
+
+		if len(tmpdata) > p.MaxLine {
+			log.Warn("STDIN: Skipping line longer than ", p.MaxLine, " bytes")
+			tmpdata = []byte{}
+			continue
+		}
+
+		json_data, err := p.Decoder.FromBytes(tmpdata)
+		if err != nil {
+			log.Error("Failed to decode data from stdin")
+			log.Error("   data: " + string(tmpdata))
+			log.Error(err.Error())
+			tmpdata = []byte{}
+			continue
+		}
+
+		e := core.NewEvent(json_data)
+		p.OutQ <- e
+
+		tmpdata = []byte{}
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	log.Info("STDIN: End of input")
+	p.MustPrintStats()
+	p.EndOfStream()
+}
+
+// Stdin CSV implementation
+type StdinCSVInput struct {
+	*StdinJSONInput
+}
+
+func NewStdinCSVInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdinCSVInput")
+
+	// Defaults...
+	m := StdinCSVInput{NewStdinJSONInput(inQ, outQ, cfg).(*StdinJSONInput)}
+
+	m.Tag = "IN-STDIN-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Decoder = c
+
+	return &m
+}
+
+// Stdin Raw implementation
+type StdinRawInput struct {
+	*StdinJSONInput
+}
+
+func NewStdinRawInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdinRawInput")
+
+	// Defaults...
+	m := StdinRawInput{NewStdinJSONInput(inQ, outQ, cfg).(*StdinJSONInput)}
+
+	m.Tag = "IN-STDIN-RAW"
+
+	m.Decoder = &core.RawLineCodec{}
+
+	return &m
+}
+
+// Stdin String implementation
+type StdinStrInput struct {
+	*StdinJSONInput
+}
+
+func NewStdinStrInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdinStrInput")
+
+	// Defaults...
+	m := StdinStrInput{NewStdinJSONInput(inQ, outQ, cfg).(*StdinJSONInput)}
+
+	m.Tag = "IN-STDIN-STR"
+
+	m.Decoder = &core.StringLineCodec{}
+
+	return &m
+}
@@ -0,0 +1,67 @@
+package input
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	"github.com/urban-1/gopipe/output"
+	"github.com/urban-1/gopipe/proc"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// stdin -> if -> endif -> stdout: the end of stdin must stop every stage
+func TestStdinEndOfStream(t *testing.T) {
+	ch1 := make(chan *core.Event, 10)
+	ch2 := make(chan *core.Event, 10)
+	ch3 := make(chan *core.Event, 10)
+
+	cin := NewStdinJSONInput(nil, ch1, GetConfig(`{}`))
+	cin.(*StdinJSONInput).Reader = strings.NewReader("{\"a\": 1}\nnot json\n{\"a\": 2}")
+
+	cif := proc.NewIfProc(ch1, ch2, GetConfig(`{"condition": "true"}`))
+	cendif := proc.NewEndIfProc(ch2, ch3, GetConfig(`{}`))
+
+	var buf bytes.Buffer
+	cout := output.NewStdoutJSONOutput(ch3, nil, GetConfig(`{}`))
+	cout.(*output.StdoutJSONOutput).Writer = &buf
+
+	finished := make(chan bool)
+	go cin.Run()
+	go cif.Run()
+	go cendif.Run()
+	go func() {
+		cout.Run()
+		finished <- true
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Duration(3) * time.Second):
+		t.Fatal("Stdin: end of stream did not reach the output")
+	}
+
+	if buf.String() != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Error("Stdin: unexpected output: ", buf.String())
+	}
+}
+
+func TestStdinStr(t *testing.T) {
+	in := make(chan *core.Event, 10)
+
+	cin := NewStdinStrInput(nil, in, GetConfig(`{}`))
+	cin.(*StdinStrInput).Reader = strings.NewReader("hello\nworld\n")
+	cin.Run()
+
+	if e := <-in; e.Data["message"] != "hello" {
+		t.Error("Stdin: expected hello", e.Data)
+	}
+	if e := <-in; e.Data["message"] != "world" {
+		t.Error("Stdin: expected world", e.Data)
+	}
+	if _, ok := <-in; ok {
+		t.Error("Stdin: channel was not closed at the end of the input")
+	}
+}
@@ -0,0 +1,476 @@
+/*
+   - SYSLOG: Receive syslog messages over UDP, TCP or TLS and parse them
+   (RFC 3164 and RFC 5424) into data fields. Messages that cannot be parsed are
+   not dropped, they are stored in the `message` field as they are
+*/
+package input
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering SyslogInput")
+	core.GetRegistryInstance()["SyslogInput"] = NewSyslogInput
+}
+
+type SyslogInput struct {
+	*core.ComponentBase
+	Protocol string
+	Addr     string
+	TLS      *tls.Config
+	// Replace Event.Timestamp with the time found in the message
+	UseTimestamp bool
+	// Timezone of RFC 3164 timestamps (these carry no zone)
+	Location *time.Location
+	Sock     io.Closer
+	lock     *sync.Mutex
+}
+
+func NewSyslogInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating SyslogInput")
+
+	protocol := "udp"
+	if tmp, ok := cfg["protocol"].(string); ok {
+		protocol = tmp
+	}
+
+	host := "0.0.0.0"
+	if tmp, ok := cfg["listen"].(string); ok {
+		host = tmp
+	}
+
+	port := 514
+	if tmp, ok := cfg["port"].(float64); ok {
+		port = int(tmp)
+	}
+
+	var tlsConfig *tls.Config
+	switch protocol {
+	case "udp", "tcp":
+	case "tls":
+		var err error
+		tlsConfig, err = syslogTLSConfig(cfg)
+		if err != nil {
+			panic("SyslogInput: Invalid TLS configuration: " + err.Error())
+		}
+	default:
+		panic("SyslogInput: 'protocol' must be one of udp, tcp or tls")
+	}
+
+	use_timestamp, _ := cfg["use_timestamp"].(bool)
+
+	loc := time.Local
+	if tmp, ok := cfg["timezone"].(string); ok {
+		var err error
+		if loc, err = time.LoadLocation(tmp); err != nil {
+			panic("SyslogInput: Invalid timezone: " + err.Error())
+		}
+	}
+
+	m := &SyslogInput{core.NewComponentBase(inQ, outQ, cfg),
+		protocol, net.JoinHostPort(host, strconv.Itoa(port)), tlsConfig,
+		use_timestamp, loc, nil, &sync.Mutex{}}
+
+	m.Tag = "IN-SYSLOG-" + strings.ToUpper(protocol)
+
+	return m
+}
+
+// Build the server TLS config. If a CA is given clients must present a
+// certificate signed by it
+func syslogTLSConfig(cfg core.Config) (*tls.Config, error) {
+	certFile, _ := cfg["cert_file"].(string)
+	keyFile, _ := cfg["key_file"].(string)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if caFile, ok := cfg["ca_file"].(string); ok {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + caFile)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
+
+func (p *SyslogInput) Signal(string) {}
+
+// Stop closes the socket so any blocking Accept/Read returns
+func (p *SyslogInput) Stop() {
+	p.ComponentBase.Stop()
+	if p.Sock != nil {
+		p.Sock.Close()
+	}
+}
+
+func (p *SyslogInput) Run() {
+	if p.Protocol == "udp" {
+		p.runUDP()
+	} else {
+		p.runStream()
+	}
+	log.Infof("%s: Stopping...", p.Tag)
+}
+
+func (p *SyslogInput) runUDP() {
+	l, err := net.ListenPacket("udp", p.Addr)
+	if err != nil {
+		log.Error("Error listening:", err.Error())
+		os.Exit(1)
+	}
+	p.Sock = l
+	defer l.Close()
+
+	log.Info("Listening on udp:" + p.Addr)
+	var buffer []byte = make([]byte, 65000)
+	for !p.MustStop {
+		n, addr, err := l.ReadFrom(buffer)
+		if err != nil {
+			if p.MustStop {
+				break
+			}
+			log.Error("Syslog receive error: ", err.Error())
+			continue
+		}
+		p.emit(buffer[:n], addr)
+	}
+}
+
+func (p *SyslogInput) runStream() {
+	var l net.Listener
+	var err error
+	if p.TLS != nil {
+		l, err = tls.Listen("tcp", p.Addr, p.TLS)
+	} else {
+		l, err = net.Listen("tcp", p.Addr)
+	}
+	if err != nil {
+		log.Error("Error listening:", err.Error())
+		os.Exit(1)
+	}
+	p.Sock = l
+	defer l.Close()
+
+	log.Info("Listening on " + p.Protocol + ":" + p.Addr)
+	for !p.MustStop {
+		conn, err := l.Accept()
+		if err != nil {
+			if p.MustStop {
+				break
+			}
+			log.Error("Error accepting: ", err.Error())
+			continue
+		}
+		log.Info("Accepted " + conn.RemoteAddr().String())
+		go p.handleRequest(conn)
+	}
+}
+
+// Read frames from a stream connection. Both octet counting ("<len> <msg>")
+// and new line framing (RFC 6587) are supported, detected per message
+func (p *SyslogInput) handleRequest(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReaderSize(conn, 65536)
+
+	for !p.MustStop {
+		frame, err := readSyslogFrame(reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Error("Syslog read error from ", conn.RemoteAddr().String(), ": ", err.Error())
+			}
+			log.Info("Client disconnected: " + conn.RemoteAddr().String())
+			return
+		}
+		if len(frame) == 0 {
+			continue
+		}
+		p.emit(frame, conn.RemoteAddr())
+	}
+}
+
+// Read a single message from a stream
+func readSyslogFrame(reader *bufio.Reader) ([]byte, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+
+	if first[0] >= '0' && first[0] <= '9' {
+		lenstr, err := reader.ReadString(' ')
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(lenstr))
+		if err != nil || n > 65000 {
+			return nil, errors.New("invalid octet count '" + lenstr + "'")
+		}
+		frame := make([]byte, n)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return nil, err
+		}
+		return frame, nil
+	}
+
+	line, err := reader.ReadBytes('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return nil, err
+	}
+	if len(line) > 65000 {
+		return nil, errors.New("message too long")
+	}
+	return []byte(strings.TrimRight(string(line), "\r\n\x00")), nil
+}
+
+// Parse a message and push it downstream
+func (p *SyslogInput) emit(raw []byte, addr net.Addr) {
+	json_data, ts, err := ParseSyslog(raw, p.Location)
+	if err != nil {
+		log.Debug("Unable to parse syslog message from ", addr.String(), ": ", err.Error())
+		json_data = map[string]interface{}{"message": string(raw)}
+	}
+
+	json_data["_from_addr"], json_data["_from_port"], _ = net.SplitHostPort(addr.String())
+
+	e := core.NewEvent(json_data)
+	if p.UseTimestamp && !ts.IsZero() {
+		e.Timestamp = ts
+	}
+	p.OutQ <- e
+
+	// Stats (stream connections run concurrently)
+	p.lock.Lock()
+	p.StatsAddMesg()
+	p.PrintStats()
+	p.lock.Unlock()
+}
+
+// RFC 3164 tag: app-name[procid]: message
+var syslogTagRegex = regexp.MustCompile(`^([^\s\[\]:]+)(?:\[([^\]]*)\])?:\s?`)
+
+// Parse an RFC 3164 or RFC 5424 message. The location is used for RFC 3164
+// timestamps since they do not carry a timezone. A zero time is returned if
+// the message has no (valid) timestamp
+func ParseSyslog(raw []byte, loc *time.Location) (map[string]interface{}, time.Time, error) {
+	msg := string(raw)
+
+	if len(msg) < 3 || msg[0] != '<' {
+		return nil, time.Time{}, errors.New("missing priority")
+	}
+	end := strings.IndexByte(msg, '>')
+	if end < 2 || end > 4 {
+		return nil, time.Time{}, errors.New("invalid priority")
+	}
+	pri, err := strconv.Atoi(msg[1:end])
+	if err != nil || pri > 191 {
+		return nil, time.Time{}, errors.New("invalid priority")
+	}
+
+	json_data := map[string]interface{}{
+		"priority": pri,
+		"facility": pri / 8,
+		"severity": pri % 8,
+	}
+
+	rest := msg[end+1:]
+	if strings.HasPrefix(rest, "1 ") {
+		ts, err := parseRFC5424(rest[2:], json_data)
+		return json_data, ts, err
+	}
+
+	return json_data, parseRFC3164(rest, json_data, loc), nil
+}
+
+// Split the next space delimited token
+func nextSyslogToken(s string) (string, string, error) {
+	if s == "" {
+		return "", "", errors.New("unexpected end of message")
+	}
+	idx := strings.IndexByte(s, ' ')
+	if idx < 0 {
+		return s, "", nil
+	}
+	return s[:idx], s[idx+1:], nil
+}
+
+// TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA [MSG]
+func parseRFC5424(s string, json_data map[string]interface{}) (time.Time, error) {
+	var ts time.Time
+	keys := []string{"timestamp", "hostname", "app_name", "procid", "msgid"}
+	for _, key := range keys {
+		tok, rest, err := nextSyslogToken(s)
+		if err != nil {
+			return ts, err
+		}
+		s = rest
+
+		if tok == "-" {
+			continue
+		}
+
+		if key == "timestamp" {
+			ts, err = time.Parse(time.RFC3339Nano, tok)
+			if err != nil {
+				return ts, errors.New("invalid timestamp '" + tok + "'")
+			}
+		}
+		json_data[key] = tok
+	}
+
+	if s == "" {
+		return ts, errors.New("missing structured data")
+	}
+
+	if s[0] == '-' {
+		s = s[1:]
+	} else {
+		sd, rest, err := parseStructuredData(s)
+		if err != nil {
+			return ts, err
+		}
+		json_data["structured_data"] = sd
+		s = rest
+	}
+
+	if len(s) > 0 {
+		if s[0] != ' ' {
+			return ts, errors.New("invalid structured data")
+		}
+		// Drop the UTF-8 BOM if present
+		json_data["message"] = strings.TrimPrefix(s[1:], "\xef\xbb\xbf")
+	}
+
+	return ts, nil
+}
+
+// Parse [id name="value" ...][id2 ...] into a map of maps
+func parseStructuredData(s string) (map[string]interface{}, string, error) {
+	sd := map[string]interface{}{}
+
+	for len(s) > 0 && s[0] == '[' {
+		s = s[1:]
+		idEnd := strings.IndexAny(s, " ]")
+		if idEnd <= 0 {
+			return nil, s, errors.New("invalid structured data id")
+		}
+		params := map[string]interface{}{}
+		sd[s[:idEnd]] = params
+		s = s[idEnd:]
+
+		for len(s) > 0 && s[0] == ' ' {
+			s = s[1:]
+			eq := strings.Index(s, `="`)
+			if eq <= 0 {
+				return nil, s, errors.New("invalid structured data parameter")
+			}
+			name := s[:eq]
+			s = s[eq+2:]
+
+			// Value with \" \\ and \] escapes
+			var value []byte
+			closed := false
+			for i := 0; i < len(s); i++ {
+				if s[i] == '\\' && i+1 < len(s) && (s[i+1] == '"' || s[i+1] == '\\' || s[i+1] == ']') {
+					value = append(value, s[i+1])
+					i++
+					continue
+				}
+				if s[i] == '"' {
+					s = s[i+1:]
+					closed = true
+					break
+				}
+				value = append(value, s[i])
+			}
+			if !closed {
+				return nil, s, errors.New("unterminated structured data value")
+			}
+			params[name] = string(value)
+		}
+
+		if len(s) == 0 || s[0] != ']' {
+			return nil, s, errors.New("unterminated structured data element")
+		}
+		s = s[1:]
+	}
+
+	return sd, s, nil
+}
+
+// Mmm dd hh:mm:ss HOSTNAME TAG: MSG
+//
+// RFC 3164 is more of a description of what is out there than a standard, so
+// this is best effort: whatever cannot be parsed stays in the message
+func parseRFC3164(s string, json_data map[string]interface{}, loc *time.Location) time.Time {
+	var ts time.Time
+
+	if len(s) >= 16 && s[15] == ' ' {
+		if t, err := time.ParseInLocation(time.Stamp, s[:15], loc); err == nil {
+			// No year in the timestamp. Assume the current one unless that
+			// puts the message in the future (ex Dec 31 received on Jan 1)
+			now := time.Now().In(loc)
+			ts = t.AddDate(now.Year(), 0, 0)
+			if ts.After(now.AddDate(0, 0, 1)) {
+				ts = ts.AddDate(-1, 0, 0)
+			}
+			s = s[16:]
+		}
+	}
+
+	// Some senders (ex rsyslog) use RFC 3339 timestamps
+	if ts.IsZero() {
+		if tok, rest, err := nextSyslogToken(s); err == nil {
+			if t, err := time.Parse(time.RFC3339Nano, tok); err == nil {
+				ts = t
+				s = rest
+			}
+		}
+	}
+
+	if !ts.IsZero() {
+		json_data["timestamp"] = ts.Format(time.RFC3339Nano)
+
+		// Hostname follows the timestamp
+		if tok, rest, err := nextSyslogToken(s); err == nil && rest != "" && !strings.HasSuffix(tok, ":") {
+			json_data["hostname"] = tok
+			s = rest
+		}
+	}
+
+	if m := syslogTagRegex.FindStringSubmatch(s); m != nil {
+		json_data["app_name"] = m[1]
+		if m[2] != "" {
+			json_data["procid"] = m[2]
+		}
+		s = s[len(m[0]):]
+	}
+
+	json_data["message"] = s
+	return ts
+}
@@ -0,0 +1,136 @@
+package input
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestSyslogRFC5424(t *testing.T) {
+	raw := `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appl\"ication" eventID="1011"][examplePriority@32473 class="high"] An application event`
+
+	data, ts, err := ParseSyslog([]byte(raw), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data["facility"] != 20 || data["severity"] != 5 || data["priority"] != 165 {
+		t.Error("Syslog: wrong priority ", data)
+	}
+	if data["hostname"] != "mymachine.example.com" || data["app_name"] != "evntslog" || data["msgid"] != "ID47" {
+		t.Error("Syslog: wrong header ", data)
+	}
+	if _, ok := data["procid"]; ok {
+		t.Error("Syslog: nil procid should be skipped ", data)
+	}
+	if ts.UnixNano() != time.Date(2003, 10, 11, 22, 14, 15, 3000000, time.UTC).UnixNano() {
+		t.Error("Syslog: wrong timestamp ", ts)
+	}
+
+	sd := data["structured_data"].(map[string]interface{})
+	if sd["exampleSDID@32473"].(map[string]interface{})["eventSource"] != `Appl"ication` {
+		t.Error("Syslog: wrong structured data ", sd)
+	}
+	if sd["examplePriority@32473"].(map[string]interface{})["class"] != "high" {
+		t.Error("Syslog: wrong structured data ", sd)
+	}
+	if data["message"] != "An application event" {
+		t.Error("Syslog: wrong message ", data)
+	}
+
+	// No SD, no message
+	data, _, err = ParseSyslog([]byte(`<34>1 - - su 12 - -`), time.UTC)
+	if err != nil || data["procid"] != "12" || data["message"] != nil {
+		t.Error("Syslog: wrong nil handling ", data, err)
+	}
+
+	// Broken SD
+	if _, _, err = ParseSyslog([]byte(`<34>1 - - su - - [x a="b] msg`), time.UTC); err == nil {
+		t.Error("Syslog: accepted broken structured data")
+	}
+}
+
+func TestSyslogRFC3164(t *testing.T) {
+	raw := `<34>Oct 11 22:14:15 mymachine su[123]: 'su root' failed for lonvick on /dev/pts/8`
+
+	data, ts, err := ParseSyslog([]byte(raw), time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data["hostname"] != "mymachine" || data["app_name"] != "su" || data["procid"] != "123" {
+		t.Error("Syslog: wrong header ", data)
+	}
+	if data["message"] != "'su root' failed for lonvick on /dev/pts/8" {
+		t.Error("Syslog: wrong message ", data)
+	}
+	if ts.Month() != time.October || ts.Day() != 11 || ts.Hour() != 22 {
+		t.Error("Syslog: wrong timestamp ", ts)
+	}
+
+	// No header at all
+	data, ts, err = ParseSyslog([]byte(`<13>just some text`), time.UTC)
+	if err != nil || !ts.IsZero() || data["message"] != "just some text" {
+		t.Error("Syslog: wrong parsing of header-less message ", data, err)
+	}
+
+	if _, _, err = ParseSyslog([]byte(`no priority`), time.UTC); err == nil {
+		t.Error("Syslog: accepted message without priority")
+	}
+}
+
+func TestSyslogTCP(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewSyslogInput(nil, out, GetConfig(`{
+		"protocol": "tcp", "listen": "127.0.0.1", "port": 10514, "use_timestamp": true
+	}`))
+	go comp.Run()
+	defer comp.Stop()
+	time.Sleep(time.Duration(500) * time.Millisecond)
+
+	conn, err := net.Dial("tcp", "127.0.0.1:10514")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := `<165>1 2003-10-11T22:14:15.003Z host app - - - hello`
+	fmt.Fprintf(conn, "%d %s", len(msg), msg)
+	fmt.Fprintf(conn, "<13>Oct 11 22:14:15 host app: world\n")
+	fmt.Fprintf(conn, "garbage\n")
+	conn.Close()
+
+	e := <-out
+	if e.Data["message"] != "hello" || e.Timestamp.Year() != 2003 {
+		t.Error("Syslog: octet counted frame ", e.Data, e.Timestamp)
+	}
+	e = <-out
+	if e.Data["message"] != "world" {
+		t.Error("Syslog: new line frame ", e.Data)
+	}
+	e = <-out
+	if e.Data["message"] != "garbage" || e.Data["priority"] != nil {
+		t.Error("Syslog: malformed message ", e.Data)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	out := make(chan *core.Event, 10)
+	comp := NewSyslogInput(nil, out, GetConfig(`{"listen": "127.0.0.1", "port": 10515}`))
+	go comp.Run()
+	defer comp.Stop()
+	time.Sleep(time.Duration(500) * time.Millisecond)
+
+	conn, err := net.Dial("udp", "127.0.0.1:10515")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte(`<34>1 - host app - - - over udp`))
+	conn.Close()
+
+	e := <-out
+	if e.Data["message"] != "over udp" || e.Data["_from_addr"] != "127.0.0.1" {
+		t.Error("Syslog: UDP message ", e.Data)
+	}
+}
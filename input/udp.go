@@ -79,10 +79,15 @@ func (p *UDPJSONInput) Run() {
 		// , ": ", buffer[:n]
 		log.Debug("Received ", n, " bytes from ", addr.String())
 
-		json_data, err := p.Decoder.FromBytes(buffer[:n])
+		// Codecs may keep a reference to the data (Raw) so do not hand them
+		// the read buffer
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+
+		json_data, err := p.Decoder.FromBytes(data)
 		if err != nil {
 			log.Error("Failed to decode data from " + addr.String())
-			log.Error("   data: " + string(buffer[:n]))
+			log.Error("   data: " + string(data))
 			log.Error(err.Error())
 			continue
 		}
@@ -97,7 +102,7 @@ func (p *UDPJSONInput) Run() {
 		p.PrintStats()
 
 	}
-	log.Info("%s: Stopping...", p.Tag)
+	log.Infof("%s: Stopping...", p.Tag)
 }
 
 /*
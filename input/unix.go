@@ -0,0 +1,410 @@
+/*
+   - UNIX: Listens on a Unix domain socket for messages. In "stream" mode each
+   line is a separate message (same framing as TCP). In "datagram" mode each
+   datagram is a separate message (same framing as UDP). The peer credentials
+   (pid/uid/gid) are attached to the event data when the OS provides them
+*/
+package input
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering UnixJSONInput")
+	core.GetRegistryInstance()["UnixJSONInput"] = NewUnixJSONInput
+
+	log.Info("Registering UnixCSVInput")
+	core.GetRegistryInstance()["UnixCSVInput"] = NewUnixCSVInput
+
+	log.Info("Registering UnixStrInput")
+	core.GetRegistryInstance()["UnixStrInput"] = NewUnixStrInput
+
+	log.Info("Registering UnixRawInput")
+	core.GetRegistryInstance()["UnixRawInput"] = NewUnixRawInput
+}
+
+// The base structure for common Unix socket Ops. The default implementation is
+// using JSON message format
+type UnixJSONInput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for decoding...
+	Decoder  core.LineCodec
+	Path     string
+	Datagram bool
+	Mode     os.FileMode
+	Owner    string
+	Group    string
+	Sock     io.Closer
+}
+
+func NewUnixJSONInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixJSONInput")
+
+	path, ok := cfg["path"].(string)
+	if !ok {
+		panic("UnixJSONInput: 'path' is required")
+	}
+
+	datagram := false
+	if tmp, ok := cfg["socket_type"].(string); ok {
+		switch tmp {
+		case "stream":
+		case "datagram":
+			datagram = true
+		default:
+			panic("UnixJSONInput: 'socket_type' must be either 'stream' or 'datagram'")
+		}
+	}
+
+	var mode os.FileMode
+	if tmp, ok := cfg["mode"].(string); ok {
+		m, err := strconv.ParseUint(tmp, 8, 32)
+		if err != nil {
+			panic("UnixJSONInput: 'mode' must be an octal string (ex \"0660\")")
+		}
+		mode = os.FileMode(m)
+	}
+
+	owner, _ := cfg["owner"].(string)
+	group, _ := cfg["group"].(string)
+
+	m := UnixJSONInput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{},
+		path, datagram, mode, owner, group, nil}
+
+	m.Tag = "IN-UNIX-JSON"
+
+	return &m
+}
+
+func (p *UnixJSONInput) Signal(string) {}
+
+// Stop closes the socket so any blocking Accept/Read returns
+func (p *UnixJSONInput) Stop() {
+	p.ComponentBase.Stop()
+	if p.Sock != nil {
+		p.Sock.Close()
+	}
+}
+
+func (p *UnixJSONInput) Run() {
+	if err := removeStaleSocket(p.Path); err != nil {
+		log.Error("Error listening: ", err.Error())
+		os.Exit(1)
+	}
+
+	if p.Datagram {
+		p.runDatagram()
+	} else {
+		p.runStream()
+	}
+
+	// Do not leave the socket behind
+	os.Remove(p.Path)
+	log.Infof("%s: Stopping...", p.Tag)
+}
+
+// Create the stream listener and accept connections
+func (p *UnixJSONInput) runStream() {
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: p.Path, Net: "unix"})
+	if err != nil {
+		log.Error("Error listening: ", err.Error())
+		os.Exit(1)
+	}
+	// We remove the file ourselves on exit
+	l.SetUnlinkOnClose(false)
+
+	p.Sock = l
+	defer l.Close()
+
+	if err := p.setPermissions(); err != nil {
+		log.Error("Error setting socket permissions: ", err.Error())
+		os.Exit(1)
+	}
+
+	log.Info("Listening on unix:" + p.Path)
+	for !p.MustStop {
+		conn, err := l.AcceptUnix()
+		if err != nil {
+			if p.MustStop {
+				break
+			}
+			log.Error("Error accepting: ", err.Error())
+			os.Exit(1)
+		}
+		log.Info("Accepted unix connection on " + p.Path)
+		go p.handleRequest(conn)
+	}
+}
+
+// This is a goroutine that will be spawned for each client connected to the
+// socket. Framing is identical to the TCP input.
+func (p *UnixJSONInput) handleRequest(conn *net.UnixConn) {
+	defer conn.Close()
+
+	pid, uid, gid, hasCreds := peerCredentials(conn)
+
+	reader := bufio.NewReader(conn)
+	var tmpdata []byte
+
+	for !p.MustStop {
+		linedata, is_prefix, err := reader.ReadLine()
+
+		if err != nil {
+			if err != io.EOF && !p.MustStop {
+				log.Error("Unix read error: ", err.Error())
+			}
+			log.Info("Client disconnected from unix:" + p.Path)
+			break
+		}
+
+		if is_prefix {
+			tmpdata = append(tmpdata, linedata...)
+
+			// Max line protection...
+			if len(tmpdata) > 65000 {
+				log.Warn("Connection flood detected. Closing connection on unix:" + p.Path)
+				break
+			}
+			continue
+		}
+
+		tmpdata = append(tmpdata, linedata...)
+
+		json_data, err := p.Decoder.FromBytes(tmpdata)
+		if err != nil {
+			log.Error("Failed to decode data from unix:" + p.Path)
+			log.Error("   data: " + string(tmpdata))
+			log.Error(err.Error())
+			tmpdata = []byte{}
+			continue
+		}
+
+		if hasCreds {
+			json_data["_peer_pid"], json_data["_peer_uid"], json_data["_peer_gid"] = pid, uid, gid
+		}
+
+		e := core.NewEvent(json_data)
+		p.OutQ <- e
+
+		tmpdata = []byte{}
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+}
+
+// Bind a datagram socket and read messages from it
+func (p *UnixJSONInput) runDatagram() {
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: p.Path, Net: "unixgram"})
+	if err != nil {
+		log.Error("Error listening: ", err.Error())
+		os.Exit(1)
+	}
+
+	p.Sock = conn
+	defer conn.Close()
+
+	if err := p.setPermissions(); err != nil {
+		log.Error("Error setting socket permissions: ", err.Error())
+		os.Exit(1)
+	}
+
+	if err := enablePassCred(conn); err != nil {
+		log.Warn("Unable to receive peer credentials: ", err.Error())
+	}
+
+	log.Info("Listening on unixgram:" + p.Path)
+	var buffer []byte = make([]byte, 65000)
+	var oob []byte = make([]byte, credOOBSize)
+	for !p.MustStop {
+		n, oobn, _, _, err := conn.ReadMsgUnix(buffer, oob)
+		if err != nil {
+			if p.MustStop {
+				break
+			}
+			log.Error("Unix receive error: ", err.Error())
+			continue
+		}
+
+		log.Debug("Received ", n, " bytes on ", p.Path)
+
+		// Codecs may keep a reference to the data (Raw) so do not hand them
+		// the read buffer
+		data := make([]byte, n)
+		copy(data, buffer[:n])
+
+		json_data, err := p.Decoder.FromBytes(data)
+		if err != nil {
+			log.Error("Failed to decode data from unixgram:" + p.Path)
+			log.Error("   data: " + string(data))
+			log.Error(err.Error())
+			continue
+		}
+
+		if pid, uid, gid, ok := credentialsFromOOB(oob[:oobn]); ok {
+			json_data["_peer_pid"], json_data["_peer_uid"], json_data["_peer_gid"] = pid, uid, gid
+		}
+
+		e := core.NewEvent(json_data)
+		p.OutQ <- e
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+}
+
+// Apply the configured file mode and ownership to the socket file
+func (p *UnixJSONInput) setPermissions() error {
+	if p.Mode != 0 {
+		if err := os.Chmod(p.Path, p.Mode); err != nil {
+			return err
+		}
+	}
+
+	if p.Owner == "" && p.Group == "" {
+		return nil
+	}
+
+	uid, gid := -1, -1
+	if p.Owner != "" {
+		u, err := lookupID(p.Owner, func(s string) (string, error) {
+			u, err := user.Lookup(s)
+			if err != nil {
+				return "", err
+			}
+			return u.Uid, nil
+		})
+		if err != nil {
+			return err
+		}
+		uid = u
+	}
+
+	if p.Group != "" {
+		g, err := lookupID(p.Group, func(s string) (string, error) {
+			g, err := user.LookupGroup(s)
+			if err != nil {
+				return "", err
+			}
+			return g.Gid, nil
+		})
+		if err != nil {
+			return err
+		}
+		gid = g
+	}
+
+	return os.Chown(p.Path, uid, gid)
+}
+
+// Accept either numeric ids or names
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+// A socket file left behind by a crashed process prevents us from binding.
+// Remove it, but only if it is a socket and nobody is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New(path + " exists and is not a socket")
+	}
+
+	// Stream listeners answer, datagram sockets accept a dial
+	for _, network := range []string{"unix", "unixgram"} {
+		if conn, err := net.Dial(network, path); err == nil {
+			conn.Close()
+			return errors.New(path + " is in use by another process")
+		}
+	}
+
+	log.Warn("Removing stale socket ", path)
+	return os.Remove(path)
+}
+
+// Unix CSV implementation
+type UnixCSVInput struct {
+	*UnixJSONInput
+}
+
+func NewUnixCSVInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixCSVInput")
+
+	// Defaults...
+	m := UnixCSVInput{NewUnixJSONInput(inQ, outQ, cfg).(*UnixJSONInput)}
+
+	m.Tag = "IN-UNIX-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Decoder = c
+
+	return &m
+}
+
+// Unix Raw implementation
+type UnixRawInput struct {
+	*UnixJSONInput
+}
+
+func NewUnixRawInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixRawInput")
+
+	// Defaults...
+	m := UnixRawInput{NewUnixJSONInput(inQ, outQ, cfg).(*UnixJSONInput)}
+
+	m.Tag = "IN-UNIX-RAW"
+
+	m.Decoder = &core.RawLineCodec{}
+
+	return &m
+}
+
+// Unix String implementation
+type UnixStrInput struct {
+	*UnixJSONInput
+}
+
+func NewUnixStrInput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixStrInput")
+
+	// Defaults...
+	m := UnixStrInput{NewUnixJSONInput(inQ, outQ, cfg).(*UnixJSONInput)}
+
+	m.Tag = "IN-UNIX-STR"
+
+	m.Decoder = &core.StringLineCodec{}
+
+	return &m
+}
@@ -0,0 +1,65 @@
+//go:build linux
+// +build linux
+
+package input
+
+import (
+	"net"
+	"syscall"
+)
+
+// Space needed for a single SCM_CREDENTIALS control message
+var credOOBSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// Get the credentials of the process connected on the other side of a stream
+// socket (SO_PEERCRED)
+func peerCredentials(conn *net.UnixConn) (pid int, uid int, gid int, ok bool) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	var cred *syscall.Ucred
+	var cerr error
+	err = raw.Control(func(fd uintptr) {
+		cred, cerr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || cerr != nil {
+		return 0, 0, 0, false
+	}
+
+	return int(cred.Pid), int(cred.Uid), int(cred.Gid), true
+}
+
+// Ask the kernel to attach SCM_CREDENTIALS to every received datagram
+func enablePassCred(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// Extract the sender's credentials from a datagram's control messages
+func credentialsFromOOB(oob []byte) (pid int, uid int, gid int, ok bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+
+	for i := range msgs {
+		cred, err := syscall.ParseUnixCredentials(&msgs[i])
+		if err == nil {
+			return int(cred.Pid), int(cred.Uid), int(cred.Gid), true
+		}
+	}
+	return 0, 0, 0, false
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package input
+
+import (
+	"errors"
+	"net"
+)
+
+// Peer credentials are only implemented for Linux at the moment
+var credOOBSize = 0
+
+func peerCredentials(conn *net.UnixConn) (pid int, uid int, gid int, ok bool) {
+	return 0, 0, 0, false
+}
+
+func enablePassCred(conn *net.UnixConn) error {
+	return errors.New("peer credentials are not supported on this platform")
+}
+
+func credentialsFromOOB(oob []byte) (pid int, uid int, gid int, ok bool) {
+	return 0, 0, 0, false
+}
@@ -0,0 +1,157 @@
+package input
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	"github.com/urban-1/gopipe/output"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func testUnixJSON(t *testing.T, socketType string) {
+	dir, err := ioutil.TempDir("", "gopipe-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gopipe.sock")
+
+	in, out := GetChannels()
+	mid := make(chan *core.Event, 1)
+
+	out <- GetEvent(`{"a": 1}`)
+
+	cin := NewUnixJSONInput(nil, in, GetConfig(`
+		{"path": "`+path+`", "socket_type": "`+socketType+`", "mode": "0600"}
+	`))
+
+	cout := output.NewUnixJSONOutput(out, mid, GetConfig(`
+		{"path": "`+path+`", "socket_type": "`+socketType+`"}
+	`))
+
+	go cin.Run()
+	time.Sleep(time.Duration(1) * time.Second)
+	go cout.Run()
+
+	// Test Unix as middle stage
+	e := <-mid
+	tmp, _ := e.Data["a"].(json.Number).Int64()
+	if tmp != 1 {
+		t.Error("Unix MID error: I was expecting a: 1")
+		t.Error(e.Data)
+	}
+
+	// Test socket
+	e = <-in
+	tmp, _ = e.Data["a"].(json.Number).Int64()
+	if tmp != 1 {
+		t.Error("Unix IO error: I was expecting a: 1")
+		t.Error(e.Data)
+	}
+
+	if runtime.GOOS == "linux" && e.Data["_peer_pid"] != os.Getpid() {
+		t.Error("Unix IO error: I was expecting the peer pid to be ours")
+		t.Error(e.Data)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Error("Unix socket mode was not applied")
+	}
+
+	cin.Stop()
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Unix socket was not removed on stop")
+	}
+}
+
+func TestUnixStreamJSON(t *testing.T) {
+	testUnixJSON(t, "stream")
+}
+
+func TestUnixDatagramJSON(t *testing.T) {
+	testUnixJSON(t, "datagram")
+}
+
+func TestUnixStr(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "gopipe.sock")
+
+	in, out := GetChannels()
+	mid := make(chan *core.Event, 1)
+
+	msg := "[32241.135047] cfg80211:  DFS Master region: unset"
+	out <- GetEvent(`{"message": "` + msg + `"}`)
+
+	cin := NewUnixStrInput(nil, in, GetConfig(`{"path": "`+path+`"}`))
+	cout := output.NewUnixStrOutput(out, mid, GetConfig(`{"path": "`+path+`"}`))
+
+	go cin.Run()
+	time.Sleep(time.Duration(1) * time.Second)
+	go cout.Run()
+
+	<-mid
+	e := <-in
+	if e.Data["message"].(string) != msg {
+		t.Error("Unix IO error: message mismatch")
+		t.Error(e.Data)
+	}
+	cin.Stop()
+}
+
+func TestUnixStaleSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A regular file must never be removed
+	path := filepath.Join(dir, "not-a-socket")
+	ioutil.WriteFile(path, []byte("data"), 0644)
+	if removeStaleSocket(path) == nil {
+		t.Error("removeStaleSocket accepted a regular file")
+	}
+
+	// Nothing there is fine
+	if err := removeStaleSocket(filepath.Join(dir, "missing.sock")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUnixOutputNoListener(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gopipe-unix")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	out := make(chan *core.Event, 1)
+	mid := make(chan *core.Event, 1)
+	e, ack := GetAckedEvent(`{"message": "lost"}`)
+	out <- e
+	close(out)
+
+	cout := output.NewUnixStrOutput(out, mid, GetConfig(`{"path": "`+filepath.Join(dir, "missing.sock")+`"}`))
+	cout.Run()
+
+	// Still passed down in proc, with the error
+	if e := <-mid; e.Data["_unix_error"] == nil {
+		t.Error("Unix: failed event without _unix_error ", e.Data)
+	}
+	e.Ack()
+	if ok := <-ack; ok {
+		t.Error("Unix: failed event acked")
+	}
+}
@@ -0,0 +1,103 @@
+package output
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+// The batching of an output: events are queued until the batch is full or
+// FlushInterval has passed since the last flush, then sent together
+type batcher struct {
+	// Queue an event. Returns false if it was not queued (ex it could not be
+	// encoded and has been nacked)
+	Queue func(e *core.Event) bool
+	// Whether the batch should be sent without waiting (ex batch_size)
+	Full func() bool
+	// Send the queued events and start a new batch. Every event is done once
+	// this (or Close) returns
+	Flush func()
+	// Called after the last flush, before the end of the stream is passed
+	// on (optional, ex to wait for requests in flight)
+	Close         func()
+	FlushInterval time.Duration
+}
+
+// Read the inQ of the component until it is stopped or the stream ends, then
+// flush what is left. We flush on time as well, so we cannot use ShouldRun()
+func (b *batcher) run(p *core.ComponentBase) {
+	ticker := time.NewTicker(b.FlushInterval / 2)
+	defer ticker.Stop()
+
+	eos := false
+	queued := 0
+	last_flush := time.Now()
+
+	for !p.MustStop {
+		select {
+		case e, ok := <-p.InQ:
+			if !ok {
+				eos = true
+				p.MustStop = true
+				break
+			}
+			if p.Skip(e) {
+				continue
+			}
+			if !b.Queue(e) {
+				continue
+			}
+			queued++
+
+			// Stats
+			p.StatsAddMesg()
+			p.PrintStats()
+
+		case <-p.Stopping():
+		case <-ticker.C:
+		}
+
+		// Nothing to send: the next batch waits a full interval
+		if queued == 0 {
+			if time.Since(last_flush) >= b.FlushInterval {
+				last_flush = time.Now()
+			}
+			continue
+		}
+		if b.Full() || time.Since(last_flush) >= b.FlushInterval {
+			b.Flush()
+			queued = 0
+			last_flush = time.Now()
+		}
+	}
+
+	if queued > 0 {
+		b.Flush()
+	}
+	if b.Close != nil {
+		b.Close()
+	}
+	if eos {
+		p.EndOfStream()
+	}
+}
+
+// Call try until it succeeds, fails for good (retry is false) or retries have
+// been made, doubling the wait from backoff (up to max_backoff) every time.
+// try is given the number of the attempt (0 for the first). Returns the last
+// error
+func withRetries(tag string, retries int, backoff time.Duration, max_backoff time.Duration, try func(attempt int) (bool, error)) error {
+	for attempt := 0; ; attempt++ {
+		retry, err := try(attempt)
+		if err == nil || !retry || attempt >= retries {
+			return err
+		}
+
+		log.Warnf("%s: Retrying in %v: %s", tag, backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > max_backoff {
+			backoff = max_backoff
+		}
+	}
+}
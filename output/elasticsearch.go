@@ -0,0 +1,388 @@
+/*
+   - ELASTICSEARCH: Index events into Elasticsearch/OpenSearch with `_bulk`
+   requests. Events are batched until `batch_size` events or `batch_bytes` are
+   queued or `flush_interval_ms` has passed. The index name is a template of
+   event fields and time, ex. `flows-{type}-{+2006.01.02}`. Requests failing
+   with 429/5xx (and documents rejected with these codes) are retried with
+   exponential backoff. Documents rejected permanently are written to the
+   `dead_letter` file (if set) together with the error.
+*/
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering ElasticsearchOutput")
+	core.GetRegistryInstance()["ElasticsearchOutput"] = NewElasticsearchOutput
+}
+
+// A queued document
+type esItem struct {
+	e      *core.Event
+	index  string
+	action []byte
+	doc    []byte
+}
+
+// The per-item result of a bulk request
+type esBulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]esBulkItemResult `json:"items"`
+}
+
+type esBulkItemResult struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type ElasticsearchOutput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for encoding...
+	Encoder core.LineCodec
+	// Base URL, ex. http://localhost:9200
+	URL    string
+	Client *http.Client
+	// Index template, bulk action (index or create) and document id field
+	Index   string
+	Action  string
+	IdField string
+	// Flush thresholds
+	BatchSize     int
+	BatchBytes    int
+	FlushInterval time.Duration
+	// Retries of 429/5xx with exponential backoff
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Where permanently rejected documents are written (optional)
+	DeadLetter string
+	// Authentication: basic or bearer
+	AuthType string
+	Username string
+	Password string
+	Token    string
+	// Stats
+	Indexed  uint64
+	Retried  uint64
+	Rejected uint64
+	Failed   uint64
+	lock     *sync.Mutex
+}
+
+func NewElasticsearchOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating ElasticsearchOutput")
+
+	url, ok := cfg["url"].(string)
+	if !ok || url == "" {
+		panic("ElasticsearchOutput: 'url' is required")
+	}
+	index, ok := cfg["index"].(string)
+	if !ok || index == "" {
+		panic("ElasticsearchOutput: 'index' is required")
+	}
+
+	action := "index"
+	if tmp, ok := cfg["action"].(string); ok {
+		action = tmp
+	}
+	if action != "index" && action != "create" {
+		panic("ElasticsearchOutput: 'action' must be 'index' or 'create'")
+	}
+	id_field, _ := cfg["id_field"].(string)
+	dead_letter, _ := cfg["dead_letter"].(string)
+
+	batch_size := 500
+	if tmp, ok := cfg["batch_size"].(float64); ok {
+		batch_size = int(tmp)
+	}
+	batch_bytes := 5 * 1024 * 1024
+	if tmp, ok := cfg["batch_bytes"].(float64); ok {
+		batch_bytes = int(tmp)
+	}
+	flush_interval := 1000.0
+	if tmp, ok := cfg["flush_interval_ms"].(float64); ok {
+		flush_interval = tmp
+	}
+	if flush_interval <= 0 {
+		panic("ElasticsearchOutput: 'flush_interval_ms' must be positive")
+	}
+	max_retries := 5
+	if tmp, ok := cfg["max_retries"].(float64); ok {
+		max_retries = int(tmp)
+	}
+	retry_backoff := 500.0
+	if tmp, ok := cfg["retry_backoff_ms"].(float64); ok {
+		retry_backoff = tmp
+	}
+	timeout := 30000.0
+	if tmp, ok := cfg["timeout_ms"].(float64); ok {
+		timeout = tmp
+	}
+
+	auth_type, username, password, token := "", "", "", ""
+	if auth, ok := cfg["auth"].(map[string]interface{}); ok {
+		auth_type, _ = auth["type"].(string)
+		username, _ = auth["username"].(string)
+		password, _ = auth["password"].(string)
+		token, _ = auth["token"].(string)
+		if auth_type != "basic" && auth_type != "bearer" {
+			panic("ElasticsearchOutput: auth 'type' must be 'basic' or 'bearer'")
+		}
+	}
+
+	m := &ElasticsearchOutput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, strings.TrimRight(url, "/"),
+		&http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		index, action, id_field,
+		batch_size, batch_bytes, time.Duration(flush_interval) * time.Millisecond,
+		max_retries, time.Duration(retry_backoff) * time.Millisecond, dead_letter,
+		auth_type, username, password, token,
+		0, 0, 0, 0, &sync.Mutex{}}
+
+	m.Tag = "OUT-ELASTICSEARCH"
+
+	return m
+}
+
+func (p *ElasticsearchOutput) Signal(string) {}
+
+// Add the bulk results to the component stats
+func (p *ElasticsearchOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Indexed"] = p.Indexed
+	ret["Retried"] = p.Retried
+	ret["Rejected"] = p.Rejected
+	ret["Failed"] = p.Failed
+	return ret
+}
+
+func (p *ElasticsearchOutput) Run() {
+	p.MustStop = false
+
+	batch := []*esItem{}
+	size := 0
+	b := &batcher{
+		Queue: func(e *core.Event) bool {
+			item, err := p.item(e)
+			if err != nil {
+				log.Error("ES-OUT: Failed to encode data: ", err.Error())
+				e.Nack()
+				return false
+			}
+			batch = append(batch, item)
+			size += len(item.action) + len(item.doc)
+			return true
+		},
+		Full: func() bool {
+			return len(batch) >= p.BatchSize || size >= p.BatchBytes
+		},
+		Flush: func() {
+			p.Flush(batch)
+			batch = batch[:0]
+			size = 0
+		},
+		FlushInterval: p.FlushInterval,
+	}
+	b.run(p.ComponentBase)
+
+	log.Info("ES-OUT: Stopped")
+}
+
+// Encode an event into its bulk action and document lines
+func (p *ElasticsearchOutput) item(e *core.Event) (*esItem, error) {
+	doc, err := p.Encoder.ToBytes(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	if len(doc) == 0 || doc[len(doc)-1] != '\n' {
+		doc = append(doc, '\n')
+	}
+
+	index := expandTemplate(p.Index, e.Data, e.Timestamp)
+	meta := map[string]interface{}{"_index": index}
+	if p.IdField != "" {
+		if id, ok := e.Data[p.IdField]; ok && id != nil {
+			meta["_id"] = fmt.Sprint(id)
+		}
+	}
+	action, err := json.Marshal(map[string]interface{}{p.Action: meta})
+	if err != nil {
+		return nil, err
+	}
+
+	return &esItem{e, index, append(action, '\n'), doc}, nil
+}
+
+// Send a batch, retrying what failed temporarily. Every event is done once
+// this returns
+func (p *ElasticsearchOutput) Flush(batch []*esItem) {
+	err := withRetries("ES-OUT", p.MaxRetries, p.RetryBackoff, 30*time.Second, func(attempt int) (bool, error) {
+		if attempt > 0 {
+			p.statsAdd(&p.Retried, len(batch))
+		}
+		retry, err := p.bulk(batch)
+		if err == nil && len(retry) > 0 {
+			batch = retry
+			err = fmt.Errorf("%d documents rejected temporarily", len(retry))
+		}
+		return true, err
+	})
+	if err == nil {
+		return
+	}
+
+	log.Errorf("ES-OUT: Giving up on %d documents: %s", len(batch), err.Error())
+	p.statsAdd(&p.Failed, len(batch))
+	for _, item := range batch {
+		p.done(item.e, err.Error())
+	}
+}
+
+// Send one bulk request. Returns the items to retry, or an error if the whole
+// request should be retried
+func (p *ElasticsearchOutput) bulk(batch []*esItem) ([]*esItem, error) {
+	var body bytes.Buffer
+	for _, item := range batch {
+		body.Write(item.action)
+		body.Write(item.doc)
+	}
+
+	req, err := http.NewRequest("POST", p.URL+"/_bulk", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	switch p.AuthType {
+	case "basic":
+		req.SetBasicAuth(p.Username, p.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	if resp.StatusCode >= 300 {
+		// Not going to get better by retrying (ex. authentication)
+		msg := fmt.Sprintf("status %d: %s", resp.StatusCode, string(data))
+		log.Error("ES-OUT: Bulk request rejected: ", msg)
+		p.statsAdd(&p.Failed, len(batch))
+		for _, item := range batch {
+			p.done(item.e, msg)
+		}
+		return nil, nil
+	}
+
+	result := esBulkResponse{}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("invalid response: %s", err.Error())
+	}
+	if len(result.Items) != len(batch) {
+		return nil, fmt.Errorf("expected %d items in the response, got %d",
+			len(batch), len(result.Items))
+	}
+
+	retry := []*esItem{}
+	for i, item := range batch {
+		res := esBulkItemResult{}
+		for _, r := range result.Items[i] {
+			res = r
+		}
+
+		switch {
+		case res.Status < 300:
+			p.statsAdd(&p.Indexed, 1)
+			p.done(item.e, "")
+		case res.Status == http.StatusTooManyRequests || res.Status >= 500:
+			retry = append(retry, item)
+		default:
+			p.statsAdd(&p.Rejected, 1)
+			p.reject(item, res)
+		}
+	}
+	return retry, nil
+}
+
+// A document has been rejected permanently: write it to the dead letter file
+func (p *ElasticsearchOutput) reject(item *esItem, res esBulkItemResult) {
+	log.Warnf("ES-OUT: Document rejected with %d: %s", res.Status, string(res.Error))
+
+	if p.DeadLetter == "" {
+		p.done(item.e, string(res.Error))
+		return
+	}
+
+	line, err := json.Marshal(map[string]interface{}{
+		"index":    item.index,
+		"status":   res.Status,
+		"error":    res.Error,
+		"document": json.RawMessage(bytes.TrimSpace(item.doc))})
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(p.DeadLetter, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		log.Error("ES-OUT: Failed to write to the dead letter file: ", err.Error())
+		p.done(item.e, string(res.Error))
+		return
+	}
+
+	// Stored where someone can deal with it
+	item.e.Data["_es_error"] = string(res.Error)
+	p.done(item.e, "")
+}
+
+// An event has been indexed (error is empty) or failed
+func (p *ElasticsearchOutput) done(e *core.Event, reason string) {
+	if reason != "" {
+		e.Data["_es_error"] = reason
+	}
+
+	// Check if we are being used in proc! The next components hold their
+	// own reference
+	if p.OutQ != nil {
+		e.Retain()
+		p.OutQ <- e
+	}
+	if reason != "" {
+		e.Nack()
+	} else {
+		e.Ack()
+	}
+}
+
+func (p *ElasticsearchOutput) statsAdd(counter *uint64, n int) {
+	p.lock.Lock()
+	*counter += uint64(n)
+	p.lock.Unlock()
+}
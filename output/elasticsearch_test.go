@@ -0,0 +1,145 @@
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestExpandTemplate(t *testing.T) {
+	ts := time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC)
+	data := map[string]interface{}{"type": "v5"}
+	if r := expandTemplate("flows-{type}-{+2006.01.02}", data, ts); r != "flows-v5-2017.07.14" {
+		t.Error("Wrong template expansion ", r)
+	}
+}
+
+// A stand-in for the _bulk API. status returns the status of the n-th document
+// (ex. "a") on the given attempt
+type esStandIn struct {
+	lock     sync.Mutex
+	attempts map[string]int
+	indexed  []string
+	status   func(doc string, attempt int) int
+}
+
+func (s *esStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	items := []map[string]interface{}{}
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		action := map[string]map[string]interface{}{}
+		json.Unmarshal(scanner.Bytes(), &action)
+		scanner.Scan()
+		doc := map[string]interface{}{}
+		json.Unmarshal(scanner.Bytes(), &doc)
+
+		name := doc["name"].(string)
+		status := s.status(name, s.attempts[name])
+		s.attempts[name]++
+
+		result := map[string]interface{}{"status": status}
+		if status < 300 {
+			s.indexed = append(s.indexed, action["index"]["_index"].(string)+"/"+action["index"]["_id"].(string))
+		} else {
+			result["error"] = map[string]interface{}{"type": "some_exception"}
+		}
+		items = append(items, map[string]interface{}{"index": result})
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": true, "items": items})
+}
+
+func TestElasticsearchOutput(t *testing.T) {
+	es := &esStandIn{attempts: map[string]int{}, status: func(doc string, attempt int) int {
+		switch {
+		case doc == "busy" && attempt == 0:
+			return 429
+		case doc == "bad":
+			return 400
+		}
+		return 201
+	}}
+	srv := httptest.NewServer(es)
+	defer srv.Close()
+
+	tmpdir, _ := ioutil.TempDir("", "gopipe-es")
+	defer os.RemoveAll(tmpdir)
+	dead := filepath.Join(tmpdir, "dead.json")
+
+	in := make(chan *core.Event, 10)
+	comp := NewElasticsearchOutput(in, nil, GetConfig(`{
+		"url": "`+srv.URL+`", "index": "test-{+2006}", "id_field": "name",
+		"retry_backoff_ms": 10, "dead_letter": "`+dead+`"
+	}`))
+
+	acks := []chan bool{}
+	for _, name := range []string{"ok", "busy", "bad"} {
+		e, ack := GetAckedEvent(`{"name": "` + name + `"}`)
+		e.Timestamp = time.Date(2017, 7, 14, 0, 0, 0, 0, time.UTC)
+		in <- e
+		acks = append(acks, ack)
+	}
+	close(in)
+	comp.Run()
+
+	// The rejected one is in the dead letter file
+	for _, ack := range acks {
+		if ok := <-ack; !ok {
+			t.Error("Elasticsearch: event nacked")
+		}
+	}
+	if strings.Join(es.indexed, ",") != "test-2017/ok,test-2017/busy" {
+		t.Error("Elasticsearch: wrong documents indexed ", es.indexed)
+	}
+	data, _ := ioutil.ReadFile(dead)
+	letter := map[string]interface{}{}
+	json.Unmarshal(data, &letter)
+	if letter["status"] != float64(400) || letter["document"].(map[string]interface{})["name"] != "bad" {
+		t.Error("Elasticsearch: wrong dead letter ", string(data))
+	}
+
+	stats := comp.GetStatsJSON()
+	if stats["Indexed"] != uint64(2) || stats["Retried"] != uint64(1) || stats["Rejected"] != uint64(1) {
+		t.Error("Elasticsearch: wrong stats ", stats)
+	}
+}
+
+func TestElasticsearchOutputDown(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	in := make(chan *core.Event, 1)
+	out := make(chan *core.Event, 1)
+	comp := NewElasticsearchOutput(in, out, GetConfig(`{
+		"url": "`+srv.URL+`", "index": "test", "max_retries": 1, "retry_backoff_ms": 10
+	}`))
+
+	in <- GetEvent(`{"name": "lost"}`)
+	close(in)
+	go comp.Run()
+
+	// Given up after one retry, passed down with the error
+	e := <-out
+	if e.Data["_es_error"] == nil {
+		t.Error("Elasticsearch: failure not reported ", e.Data)
+	}
+	if stats := comp.GetStatsJSON(); stats["Failed"] != uint64(1) || stats["Retried"] != uint64(1) {
+		t.Error("Elasticsearch: wrong stats ", stats)
+	}
+}
@@ -5,22 +5,43 @@
    they can also be used in any processing step to split the flow output of
    the framework. The output compoment should support that which means that it
    should be aware of the `outQ` and check if is nil ("out" section) or not
-   (processing section):
+   (processing section). The output acks the event once written (nacks it
+   on failure); when it passes the event on, it first takes an extra
+   reference for the next components:
 
        // Check if we are being used in proc!
        if p.OutQ != nil {
+           e.Retain()
            p.OutQ<-e
        }
-
-   - File: Output to timestamped files with regular (time-based) rotation.
+       e.Ack()
+
+   - File: Output to timestamped files rotated on time, size or number of
+   events. Files can be partitioned in sub-folders by event fields and time
+   (ex `exporter={_from_addr}/{+2006/01/02}`), keeping a bounded number of
+   them open. Writes are buffered and flushed periodically, files can be
+   compressed (gzip, zstd) and are written as `.tmp` and renamed once closed,
+   so readers never pick up half-written files. Old files can be pruned and a
+   hook can run a command or signal another component on every rotation
 */
 package output
 
 import (
+	"bufio"
+	"compress/gzip"
+	"container/list"
 	"encoding/json"
+	"fmt"
+	"io"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
 	log "github.com/sirupsen/logrus"
 	"github.com/urban-1/gopipe/core"
 )
@@ -31,16 +52,154 @@ func init() {
 
 	log.Info("Registering FileCSVOutput")
 	core.GetRegistryInstance()["FileCSVOutput"] = NewFileCSVOutput
+
+	log.Info("Registering FileInfluxOutput")
+	core.GetRegistryInstance()["FileInfluxOutput"] = NewFileInfluxOutput
+}
+
+// Compressors need to be flushed as well as closed
+type fileCompressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// The extension added to the file names for each compression
+var fileCompressions = map[string]string{"": "", "gzip": ".gz", "zstd": ".zst"}
+
+// Writes events to an open file in some format. The default writes lines with
+// a LineCodec, other formats (ex parquet) bring their own
+type fileWriter interface {
+	// Write an event, returning how many bytes it added. Returns a
+	// *fileRowError if the event could not be encoded (the file is still fine)
+	Write(e *core.Event) (int, error)
+	Flush() error
+	Close() error
+}
+
+// An event that cannot be written in the format of the file
+type fileRowError struct {
+	err error
+}
+
+func (e *fileRowError) Error() string {
+	return e.err.Error()
+}
+
+// Encode an event with a line codec. The point time of the Influx line
+// protocol is the event's timestamp (unless taken from a field)
+func encodeLine(codec core.LineCodec, e *core.Event) ([]byte, error) {
+	c, ok := codec.(*core.InfluxLineCodec)
+	if !ok {
+		return codec.ToBytes(e.Data)
+	}
+	line, err := c.Encode(e.Data, e.Timestamp)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// Writes encoded lines through a buffer and an optional compressor
+type lineWriter struct {
+	codec      core.LineCodec
+	compressor fileCompressor
+	buf        *bufio.Writer
+}
+
+func newLineWriter(w io.Writer, codec core.LineCodec, compression string, size int) (*lineWriter, error) {
+	ret := &lineWriter{codec: codec}
+
+	var err error
+	switch compression {
+	case "gzip":
+		ret.compressor = gzip.NewWriter(w)
+	case "zstd":
+		if ret.compressor, err = zstd.NewWriter(w); err != nil {
+			return nil, err
+		}
+	}
+	if ret.compressor != nil {
+		w = ret.compressor
+	}
+	ret.buf = bufio.NewWriterSize(w, size)
+	return ret, nil
+}
+
+func (w *lineWriter) Write(e *core.Event) (int, error) {
+	line, err := encodeLine(w.codec, e)
+	if err != nil {
+		return 0, &fileRowError{err}
+	}
+	return w.buf.Write(line)
+}
+
+func (w *lineWriter) Flush() error {
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.compressor != nil {
+		return w.compressor.Flush()
+	}
+	return nil
+}
+
+func (w *lineWriter) Close() error {
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if w.compressor != nil {
+		return w.compressor.Close()
+	}
+	return nil
+}
+
+// The open file of a folder (partition)
+type fileHandle struct {
+	dir     string
+	fname   string
+	fd      *os.File
+	writer  fileWriter
+	created int64
+	written int
+	events  int
+	// Events written but not flushed yet (acked on flush)
+	pending []*core.Event
+	// Position in the LRU
+	elem *list.Element
 }
 
 type FileJSONOutput struct {
 	*core.ComponentBase
-	LastRotate    int64
-	Folder        string
-	Pattern       string
+	Folder  string
+	Pattern string
+	// The sub-folder template of the partitions (optional)
+	Partition     string
+	MaxOpenFiles  int
 	RotateSeconds int
-	Fd            *os.File
+	RotateBytes   int
+	RotateEvents  int
 	Encoder       core.LineCodec
+	BufferSize    int
+	FlushInterval time.Duration
+	Compression   string
+	// Added to the file names (ex compression)
+	Extension string
+	// Creates the writer of each file (lines with the Encoder by default)
+	NewWriter func(io.Writer) (fileWriter, error)
+	// Ack events once their file is closed rather than on every flush, for
+	// formats that cannot be read before they are closed
+	AckOnClose bool
+	// Pruning, 0 keeps everything
+	KeepFiles   int
+	KeepSeconds int
+	// The rotated hook
+	OnRotateCommand []string
+	OnRotateSignals []interface{}
+	// Called with the name of every file once closed and renamed (optional)
+	Closed func(fname string)
+	// Open files by folder, most recently used first
+	files map[string]*fileHandle
+	lru   *list.List
 }
 
 func NewFileJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
@@ -56,90 +215,498 @@ func NewFileJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Con
 		pattern = tmp
 	}
 
+	partition, _ := cfg["partition"].(string)
+
+	max_open_files := 64
+	if tmp, ok := cfg["max_open_files"].(float64); ok && tmp >= 1 {
+		max_open_files = int(tmp)
+	}
+
 	rotate_seconds := 60
 	if tmp, ok := cfg["rotate_seconds"].(float64); ok {
 		rotate_seconds = int(tmp)
 	}
 
+	rotate_bytes := 0
+	if tmp, ok := cfg["rotate_bytes"].(float64); ok {
+		rotate_bytes = int(tmp)
+	}
+
+	rotate_events := 0
+	if tmp, ok := cfg["rotate_events"].(float64); ok {
+		rotate_events = int(tmp)
+	}
+
+	buffer_size := 65536
+	if tmp, ok := cfg["buffer_size"].(float64); ok && tmp > 0 {
+		buffer_size = int(tmp)
+	}
+
+	flush_interval := 1000 * time.Millisecond
+	if tmp, ok := cfg["flush_interval_ms"].(float64); ok && tmp > 0 {
+		flush_interval = time.Duration(tmp) * time.Millisecond
+	}
+
+	compression, _ := cfg["compression"].(string)
+	if _, ok := fileCompressions[compression]; !ok {
+		panic("FileJSONOutput: 'compression' must be 'gzip' or 'zstd'")
+	}
+
+	keep_files := 0
+	if tmp, ok := cfg["keep_files"].(float64); ok {
+		keep_files = int(tmp)
+	}
+
+	keep_seconds := 0
+	if tmp, ok := cfg["keep_seconds"].(float64); ok {
+		keep_seconds = int(tmp)
+	}
+
+	command := []string{}
+	signals := []interface{}{}
+	if on_rotate, ok := cfg["on_rotate"].(map[string]interface{}); ok {
+		if tmp, ok := on_rotate["command"].([]interface{}); ok {
+			command = core.InterfaceToStringArray(tmp)
+		}
+		if tmp, ok := on_rotate["signals"].([]interface{}); ok {
+			signals = tmp
+		}
+	}
+
 	m := &FileJSONOutput{core.NewComponentBase(inQ, outQ, cfg),
-		0, folder, pattern, rotate_seconds, nil,
-		&core.JSONLineCodec{}}
+		folder, pattern, partition, max_open_files,
+		rotate_seconds, rotate_bytes, rotate_events,
+		&core.JSONLineCodec{}, buffer_size, flush_interval, compression,
+		fileCompressions[compression], nil, false,
+		keep_files, keep_seconds, command, signals, nil,
+		map[string]*fileHandle{}, list.New()}
 
 	m.Tag = "OUT-FILE-JSON"
+	m.NewWriter = func(w io.Writer) (fileWriter, error) {
+		return newLineWriter(w, m.Encoder, m.Compression, m.BufferSize)
+	}
 
 	return m
 }
 
 func (p *FileJSONOutput) Signal(string) {}
 
-// Check and rotate the output file if needed
-func (p *FileJSONOutput) checkRotate() {
+// Check and rotate (close) a file if needed. The next event of its folder
+// opens a new one
+func (p *FileJSONOutput) checkRotate(f *fileHandle) {
 	now := time.Now().Unix()
-	if int(now-p.LastRotate) >= p.RotateSeconds {
-		p.getNewFile()
+	if (p.RotateSeconds > 0 && int(now-f.created) >= p.RotateSeconds) ||
+		(p.RotateBytes > 0 && f.written >= p.RotateBytes) ||
+		(p.RotateEvents > 0 && f.events >= p.RotateEvents) {
+		p.closeFile(f)
+	}
+}
+
+// The folder of an event: the partition template is expanded with the event
+// fields (sanitised) and time under the output folder
+func (p *FileJSONOutput) partitionDir(e *core.Event) (string, error) {
+	if p.Partition == "" {
+		return p.Folder, nil
+	}
+
+	ts := e.Timestamp
+	if ts.IsZero() {
+		ts = time.Now()
 	}
+	dir := filepath.Join(p.Folder, expandPath(p.Partition, e.Data, ts))
+
+	rel, err := filepath.Rel(p.Folder, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("partition %s is outside %s", dir, p.Folder)
+	}
+	return dir, nil
+}
+
+// The name of the n-th file created in the same second: the sequence goes
+// before the extension of the pattern
+func fileSequence(name string, n int) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + strconv.Itoa(n) + ext
+}
+
+func fileExists(name string) bool {
+	_, err := os.Stat(name)
+	return err == nil
 }
 
-// Create a new file, close the old file if required
-func (p *FileJSONOutput) getNewFile() {
+// The open file of a folder. If there is none, a new file is created, closing
+// the least recently used one if there are too many open
+func (p *FileJSONOutput) getFile(dir string) (*fileHandle, error) {
+	if f, ok := p.files[dir]; ok {
+		p.lru.MoveToFront(f.elem)
+		return f, nil
+	}
+
+	for p.lru.Len() >= p.MaxOpenFiles {
+		p.closeFile(p.lru.Back().Value.(*fileHandle))
+	}
+
+	f, err := p.newFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	f.elem = p.lru.PushFront(f)
+	p.files[dir] = f
+	return f, nil
+}
 
-	if p.Fd != nil {
-		log.Debug("Closing old file")
-		p.Fd.Sync()
-		p.Fd.Close()
+// Create a new file in a folder
+func (p *FileJSONOutput) newFile(dir string) (*fileHandle, error) {
+	if dir != p.Folder {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			log.Error("Failed to create ", dir, ": ", err.Error())
+			return nil, err
+		}
 	}
 
 	now := time.Now()
-	fname := now.Format(p.Pattern)
-	fname = p.Folder + "/" + fname
+	ext := p.Extension
+	base := now.Format(p.Pattern)
+	fname := filepath.Join(dir, base+ext)
+	for i := 1; fileExists(fname) || fileExists(fname+".tmp"); i++ {
+		fname = filepath.Join(dir, fileSequence(base, i)+ext)
+	}
 
 	log.Info("Creating ", fname)
 
-	tmp, err := os.Create(fname)
+	fd, err := os.Create(fname + ".tmp")
 	if err != nil {
-		panic("Failed to open output file - Check permissions of " + p.Folder)
+		log.Error("Failed to open output file - Check permissions of ", dir, ": ", err.Error())
+		return nil, err
 	}
-	p.Fd = tmp
-	p.LastRotate = now.Unix()
 
+	writer, err := p.NewWriter(fd)
+	if err != nil {
+		log.Error("Failed to create writer for ", fname, ": ", err.Error())
+		fd.Close()
+		os.Remove(fname + ".tmp")
+		return nil, err
+	}
+
+	return &fileHandle{dir: dir, fname: fname, fd: fd, writer: writer, created: now.Unix()}, nil
 }
 
-func (p *FileJSONOutput) Run() {
-	p.MustStop = false
-	log.Debug("FileJSONOutput Starting ... ")
-	p.getNewFile()
+// Flush the buffered data of a file and ack the events written so far
+func (p *FileJSONOutput) flush(f *fileHandle) error {
+	if err := f.writer.Flush(); err != nil {
+		log.Error("Failed to flush ", f.fname, ": ", err.Error())
+		p.abandonFile(f)
+		return err
+	}
 
-	var data []byte
+	if !p.AckOnClose {
+		f.ack()
+	}
+	return nil
+}
 
-	for !p.MustStop {
-		p.checkRotate()
+// Ack the pending events of a file
+func (f *fileHandle) ack() {
+	for _, e := range f.pending {
+		e.Ack()
+	}
+	f.pending = f.pending[:0]
+}
 
-		log.Debug("FileJSONOutput Reading")
-		e, err := p.ShouldRun()
-		if err != nil {
-			continue
+// Forget an open file
+func (p *FileJSONOutput) detach(f *fileHandle) {
+	delete(p.files, f.dir)
+	p.lru.Remove(f.elem)
+}
+
+// Give up on a file after a failure: its pending events are nacked and the
+// partial file is left as .tmp
+func (p *FileJSONOutput) abandonFile(f *fileHandle) {
+	p.detach(f)
+	for _, e := range f.pending {
+		e.Nack()
+	}
+	f.pending = nil
+
+	log.Error("Leaving partial file ", f.fname, ".tmp")
+	f.fd.Close()
+}
+
+// Flush, close and rename a file, then prune old files and run the rotated
+// hook
+func (p *FileJSONOutput) closeFile(f *fileHandle) {
+	log.Debug("Closing ", f.fname)
+
+	if p.flush(f) != nil {
+		return
+	}
+	if err := f.writer.Close(); err != nil {
+		log.Error("Failed to close ", f.fname, ": ", err.Error())
+		p.abandonFile(f)
+		return
+	}
+	p.detach(f)
+	f.fd.Sync()
+	f.fd.Close()
+
+	if err := os.Rename(f.fname+".tmp", f.fname); err != nil {
+		log.Error("Failed to rename ", f.fname, ".tmp: ", err.Error())
+		for _, e := range f.pending {
+			e.Nack()
 		}
+		return
+	}
+	f.ack()
+	p.finished(f.dir, f.fname)
+}
 
-		data, err = p.Encoder.ToBytes(e.Data)
+// A file has been closed and renamed: prune old files and run the hooks
+func (p *FileJSONOutput) finished(dir string, fname string) {
+	p.prune(dir)
+	p.rotated(fname)
+	if p.Closed != nil {
+		p.Closed(fname)
+	}
+}
+
+// Rename the .tmp files left behind by a previous run that did not close them
+// (ex crashed), so they are not left out. Their data was acked once flushed,
+// so it is not written again. Files acked on close (ex parquet) cannot be read
+// without being closed and their events were not acked: these are left as
+// they are
+func (p *FileJSONOutput) recoverFiles() {
+	root := p.Folder
+	walk := func(path string, entry os.DirEntry, err error) error {
 		if err != nil {
-			log.Error("Failed to encode data: ", err.Error())
+			log.Error("Failed to list ", path, ": ", err.Error())
+			return nil
+		}
+		if entry.IsDir() {
+			// Partitions are only under the folder
+			if path != root && p.Partition == "" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		name := strings.TrimSuffix(entry.Name(), ".tmp")
+		if name == entry.Name() || !p.isOurs(name) {
+			return nil
+		}
+		if p.AckOnClose {
+			log.Warn("Cannot recover ", path, ", leaving it as it is")
+			return nil
+		}
+
+		dir := filepath.Dir(path)
+		fname := filepath.Join(dir, name)
+		base := strings.TrimSuffix(name, p.Extension)
+		for i := 1; fileExists(fname); i++ {
+			fname = filepath.Join(dir, fileSequence(base, i)+p.Extension)
+		}
+
+		log.Info("Recovering ", path, " as ", fname)
+		if err := os.Rename(path, fname); err != nil {
+			log.Error("Failed to rename ", path, ": ", err.Error())
+			return nil
+		}
+		p.finished(dir, fname)
+		return nil
+	}
+
+	if !fileExists(root) {
+		return
+	}
+	if err := filepath.WalkDir(root, walk); err != nil {
+		log.Error("Failed to recover files in ", root, ": ", err.Error())
+	}
+}
+
+// All open files (to close them while iterating)
+func (p *FileJSONOutput) openFiles() []*fileHandle {
+	ret := make([]*fileHandle, 0, p.lru.Len())
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		ret = append(ret, elem.Value.(*fileHandle))
+	}
+	return ret
+}
+
+// Check if a file name was created by us (ignoring the sequence)
+func (p *FileJSONOutput) isOurs(name string) bool {
+	ext := p.Extension
+	if !strings.HasSuffix(name, ext) {
+		return false
+	}
+	name = strings.TrimSuffix(name, ext)
+	if _, err := time.Parse(p.Pattern, name); err == nil {
+		return true
+	}
+
+	ext = filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	idx := strings.LastIndex(stem, ".")
+	if idx < 0 {
+		return false
+	}
+	if _, err := strconv.Atoi(stem[idx+1:]); err != nil {
+		return false
+	}
+	_, err := time.Parse(p.Pattern, stem[:idx]+ext)
+	return err == nil
+}
+
+// Delete the oldest files of a folder above keep_files and files older than
+// keep_seconds
+func (p *FileJSONOutput) prune(dir string) {
+	if p.KeepFiles <= 0 && p.KeepSeconds <= 0 {
+		return
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Error("Failed to list ", dir, ": ", err.Error())
+		return
+	}
+
+	files := []os.FileInfo{}
+	for _, entry := range entries {
+		if entry.IsDir() || !p.isOurs(entry.Name()) {
 			continue
 		}
+		if info, err := entry.Info(); err == nil {
+			files = append(files, info)
+		}
+	}
 
-		_, err = p.Fd.Write(data)
+	// Newest first
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].ModTime().After(files[j].ModTime())
+	})
+
+	oldest := time.Now().Add(-time.Duration(p.KeepSeconds) * time.Second)
+	for i, info := range files {
+		if (p.KeepFiles > 0 && i >= p.KeepFiles) ||
+			(p.KeepSeconds > 0 && info.ModTime().Before(oldest)) {
+			log.Info("Pruning ", filepath.Join(dir, info.Name()))
+			if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+				log.Error("Failed to prune ", info.Name(), ": ", err.Error())
+			}
+		}
+	}
+}
 
-		if err != nil {
-			log.Error("Failed to write data: ", err.Error())
+// Run the rotated hook in the background: the command ({file} is replaced
+// with the path of the closed file) and, if it succeeds, the signals
+func (p *FileJSONOutput) rotated(fname string) {
+	if len(p.OnRotateCommand) == 0 && len(p.OnRotateSignals) == 0 {
+		return
+	}
+
+	go func() {
+		if len(p.OnRotateCommand) > 0 {
+			args := make([]string, len(p.OnRotateCommand))
+			for i, arg := range p.OnRotateCommand {
+				args[i] = strings.Replace(arg, "{file}", fname, -1)
+			}
+			if err := exec.Command(args[0], args[1:]...).Run(); err != nil {
+				log.Error("Rotated command failed for ", fname, ": ", err.Error())
+				return
+			}
 		}
 
-		// Check if we are being used in proc!
-		if p.OutQ != nil {
-			p.OutQ <- e
+		for _, signal := range p.OnRotateSignals {
+			mod := int(signal.(core.Config)["mod"].(float64))
+			sig := signal.(core.Config)["signal"].(string)
+			log.Infof("Invoking signal '%s' on component %d", sig, mod)
+			core.SignalComponent(mod, sig)
 		}
+	}()
+}
+
+// Write (buffered) an event to the file of its partition
+func (p *FileJSONOutput) write(e *core.Event) {
+	dir, err := p.partitionDir(e)
+	if err != nil {
+		log.Error("Failed to write data: ", err.Error())
+		e.Nack()
+		return
+	}
 
-		// Stats
-		p.StatsAddMesg()
-		p.PrintStats()
+	f, err := p.getFile(dir)
+	if err != nil {
+		e.Nack()
+		return
+	}
+
+	n, err := f.writer.Write(e)
+	if _, ok := err.(*fileRowError); ok {
+		log.Error("Failed to encode data: ", err.Error())
+		e.Nack()
+		return
+	}
+	if err != nil {
+		log.Error("Failed to write data: ", err.Error())
+		e.Nack()
+		p.abandonFile(f)
+		return
+	}
+	f.written += n
+	f.events++
+
+	// Check if we are being used in proc! The next components hold their own
+	// reference, ours is released once the data is flushed
+	if p.OutQ != nil {
+		e.Retain()
+		p.OutQ <- e
+	}
+	f.pending = append(f.pending, e)
+
+	p.checkRotate(f)
+}
+
+func (p *FileJSONOutput) Run() {
+	p.MustStop = false
+	log.Debug("FileJSONOutput Starting ... ")
+
+	p.recoverFiles()
+
+	// We flush on time as well, so read the inQ ourselves
+	ticker := time.NewTicker(p.FlushInterval)
+	defer ticker.Stop()
+
+	eos := false
+	for !p.MustStop {
+		select {
+		case e, ok := <-p.InQ:
+			if !ok {
+				eos = true
+				p.MustStop = true
+				break
+			}
+			if p.Skip(e) {
+				continue
+			}
+			p.write(e)
+
+			// Stats
+			p.StatsAddMesg()
+			p.PrintStats()
+
+		case <-p.Stopping():
+		case <-ticker.C:
+			for _, f := range p.openFiles() {
+				if p.flush(f) == nil {
+					p.checkRotate(f)
+				}
+			}
+		}
+	}
+
+	for _, f := range p.openFiles() {
+		p.closeFile(f)
+	}
+	if eos {
+		p.EndOfStream()
 	}
 	log.Debug("FileJSONOutput Stopping")
 }
@@ -164,3 +731,24 @@ func NewFileCSVOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Conf
 
 	return &m
 }
+
+// File Influx line protocol implementation
+type FileInfluxOutput struct {
+	*FileJSONOutput
+}
+
+func NewFileInfluxOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating FileInfluxOutput")
+
+	m := FileInfluxOutput{NewFileJSONOutput(inQ, outQ, cfg).(*FileJSONOutput)}
+
+	m.Tag = "OUT-FILE-INFLUX"
+
+	c, err := core.NewInfluxLineCodec(cfg)
+	if err != nil {
+		panic(err.Error())
+	}
+	m.Encoder = c
+
+	return &m
+}
@@ -0,0 +1,405 @@
+package output
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func listFiles(t *testing.T, dir string) []string {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("FILE: cannot list ", err)
+	}
+	ret := []string{}
+	for _, entry := range entries {
+		ret = append(ret, entry.Name())
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func TestFileOutputRotateEvents(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test-20060102.json",
+		"rotate_events": 2
+	}`))
+
+	acks := []chan bool{}
+	for _, data := range []string{`{"a": 1}`, `{"a": 2}`, `{"a": 3}`} {
+		e, ack := GetAckedEvent(data)
+		in <- e
+		acks = append(acks, ack)
+	}
+	close(in)
+	comp.Run()
+
+	for _, ack := range acks {
+		if ok := <-ack; !ok {
+			t.Error("FILE: event nacked")
+		}
+	}
+
+	// Two files in the same second, none left as .tmp
+	files := listFiles(t, dir)
+	day := time.Now().Format("20060102")
+	if len(files) != 2 || files[0] != "test-"+day+".1.json" || files[1] != "test-"+day+".json" {
+		t.Fatal("FILE: wrong files ", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, files[1]))
+	if string(data) != "{\"a\":1}\n{\"a\":2}\n" {
+		t.Error("FILE: wrong content ", string(data))
+	}
+	data, _ = ioutil.ReadFile(filepath.Join(dir, files[0]))
+	if string(data) != "{\"a\":3}\n" {
+		t.Error("FILE: wrong content ", string(data))
+	}
+}
+
+func TestFileOutputTmpAndFlush(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test.json",
+		"flush_interval_ms": 50
+	}`))
+	go comp.Run()
+
+	e, ack := GetAckedEvent(`{"a": 1}`)
+	in <- e
+
+	// Acked once flushed, still written as .tmp
+	select {
+	case ok := <-ack:
+		if !ok {
+			t.Error("FILE: event nacked")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FILE: event not flushed")
+	}
+	if files := listFiles(t, dir); len(files) != 1 || files[0] != "test.json.tmp" {
+		t.Error("FILE: wrong files ", files)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "test.json.tmp"))
+	if string(data) != "{\"a\":1}\n" {
+		t.Error("FILE: not flushed ", string(data))
+	}
+
+	close(in)
+	for i := 0; i < 100 && !fileExists(filepath.Join(dir, "test.json")); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if files := listFiles(t, dir); len(files) != 1 || files[0] != "test.json" {
+		t.Error("FILE: not renamed ", files)
+	}
+}
+
+func TestFileOutputInProc(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 10)
+	out := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, out, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test.json",
+		"flush_interval_ms": 500
+	}`))
+	null := NewNullOutput(out, nil, GetConfig(`{}`))
+	go comp.Run()
+	go null.Run()
+
+	e, ack := GetAckedEvent(`{"a": 1}`)
+	in <- e
+
+	// Passed on and acked by the null output, but not flushed yet
+	for i := 0; i < 100 && (len(in) > 0 || len(out) > 0); i++ {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-ack:
+		t.Fatal("FILE: event acked before the flush")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	select {
+	case ok := <-ack:
+		if !ok {
+			t.Error("FILE: event nacked")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FILE: event not acked")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "test.json.tmp"))
+	if string(data) != "{\"a\":1}\n" {
+		t.Error("FILE: not flushed ", string(data))
+	}
+	close(in)
+	null.Stop()
+}
+
+func TestFileOutputCompression(t *testing.T) {
+	for _, compression := range []string{"gzip", "zstd"} {
+		dir := t.TempDir()
+
+		in := make(chan *core.Event, 10)
+		comp := NewFileJSONOutput(in, nil, GetConfig(`{
+			"folder": "`+dir+`", "file_name_format": "test.json",
+			"compression": "`+compression+`"
+		}`))
+		in <- GetEvent(`{"a": 1}`)
+		close(in)
+		comp.Run()
+
+		fname := filepath.Join(dir, "test.json"+fileCompressions[compression])
+		fd, err := os.Open(fname)
+		if err != nil {
+			t.Fatal("FILE: missing ", fname)
+		}
+		var data []byte
+		if compression == "gzip" {
+			r, _ := gzip.NewReader(fd)
+			data, err = ioutil.ReadAll(r)
+		} else {
+			r, _ := zstd.NewReader(fd)
+			data, err = ioutil.ReadAll(r)
+			r.Close()
+		}
+		fd.Close()
+		if err != nil || string(data) != "{\"a\":1}\n" {
+			t.Error("FILE: wrong ", compression, " content ", string(data), err)
+		}
+	}
+}
+
+func TestFileOutputPrune(t *testing.T) {
+	dir := t.TempDir()
+
+	// Older files of ours and a file that is not ours
+	for i, name := range []string{"test-20200101.json", "test-20200102.1.json", "other.json"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("x"), 0644)
+		old := time.Now().Add(-time.Duration(10-i) * time.Hour)
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test-20060102.json",
+		"keep_files": 2
+	}`))
+	in <- GetEvent(`{"a": 1}`)
+	close(in)
+	comp.Run()
+
+	day := time.Now().Format("20060102")
+	if files := listFiles(t, dir); len(files) != 3 || files[0] != "other.json" ||
+		files[1] != "test-20200102.1.json" || files[2] != "test-"+day+".json" {
+		t.Error("FILE: wrong files after pruning ", files)
+	}
+}
+
+func TestFileOutputRotatedHook(t *testing.T) {
+	dir := t.TempDir()
+
+	signaled := make(chan string, 1)
+	defer func(f func(int, string)) { core.SignalComponent = f }(core.SignalComponent)
+	core.SignalComponent = func(mod int, signal string) {
+		signaled <- signal
+	}
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test.json",
+		"on_rotate": {
+			"command": ["cp", "{file}", "`+dir+`/copy"],
+			"signals": [{"mod": 1, "signal": "reload"}]
+		}
+	}`))
+	in <- GetEvent(`{"a": 1}`)
+	close(in)
+	comp.Run()
+
+	select {
+	case signal := <-signaled:
+		if signal != "reload" {
+			t.Error("FILE: wrong signal ", signal)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("FILE: component not signaled")
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "copy")); string(data) != "{\"a\":1}\n" {
+		t.Error("FILE: command not run ", string(data))
+	}
+}
+
+func TestFileOutputCreateFailure(t *testing.T) {
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "/nonexistent/gopipe", "file_name_format": "test.json"
+	}`))
+
+	e, ack := GetAckedEvent(`{"a": 1}`)
+	in <- e
+	close(in)
+	comp.Run()
+
+	if ok := <-ack; ok {
+		t.Error("FILE: event acked without a file")
+	}
+}
+
+func TestFileOutputPartitions(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "flows.json",
+		"partition": "exporter={exporter}/{+2006/01/02}", "max_open_files": 1
+	}`))
+
+	ts := time.Date(2018, 3, 16, 10, 0, 0, 0, time.UTC)
+	for _, exporter := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "../../etc", ".."} {
+		e := GetEvent(`{"exporter": "` + exporter + `"}`)
+		e.Timestamp = ts
+		in <- e
+	}
+	close(in)
+	comp.Run()
+
+	// One file open at a time: switching partitions closes the other file
+	for name, expected := range map[string]string{
+		"exporter=10.0.0.1/2018/03/16/flows.json":   "{\"exporter\":\"10.0.0.1\"}\n",
+		"exporter=10.0.0.1/2018/03/16/flows.1.json": "{\"exporter\":\"10.0.0.1\"}\n",
+		"exporter=10.0.0.2/2018/03/16/flows.json":   "{\"exporter\":\"10.0.0.2\"}\n",
+		"exporter=.._.._etc/2018/03/16/flows.json":  "{\"exporter\":\"../../etc\"}\n",
+		"exporter=_/2018/03/16/flows.json":          "{\"exporter\":\"..\"}\n",
+	} {
+		if data, _ := ioutil.ReadFile(filepath.Join(dir, name)); string(data) != expected {
+			t.Error("FILE: wrong content of ", name, ": ", string(data))
+		}
+	}
+}
+
+func TestFileOutputPartitionEscape(t *testing.T) {
+	dir := t.TempDir()
+
+	// Values are sanitised one by one
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "flows.json",
+		"partition": "{a}{b}"
+	}`))
+	in <- GetEvent(`{"a": ".", "b": "."}`)
+	close(in)
+	comp.Run()
+
+	if !fileExists(filepath.Join(dir, "__", "flows.json")) {
+		t.Error("FILE: wrong partition ", listFiles(t, dir))
+	}
+
+	// The template cannot escape either
+	in = make(chan *core.Event, 10)
+	comp = NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`/sub", "file_name_format": "flows.json",
+		"partition": "../{a}"
+	}`))
+	e, ack := GetAckedEvent(`{"a": "x"}`)
+	in <- e
+	close(in)
+	comp.Run()
+
+	if ok := <-ack; ok || fileExists(filepath.Join(dir, "x")) {
+		t.Error("FILE: wrote outside the folder")
+	}
+}
+
+func TestFileOutputStop(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test.json",
+		"flush_interval_ms": 60000
+	}`))
+	done := make(chan bool)
+	go func() {
+		comp.Run()
+		close(done)
+	}()
+
+	e, ack := GetAckedEvent(`{"a": 1}`)
+	in <- e
+	for i := 0; i < 100 && len(in) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Returns without waiting for the next flush, the file is closed
+	comp.Stop()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("FILE: not stopped")
+	}
+	if ok := <-ack; !ok {
+		t.Error("FILE: event nacked")
+	}
+	if files := listFiles(t, dir); len(files) != 1 || files[0] != "test.json" {
+		t.Error("FILE: not closed ", files)
+	}
+}
+
+func TestFileOutputRecover(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "a"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a", "test-20240102.json.tmp"), []byte("{\"a\":1}\n"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "a", "other.tmp"), []byte("x"), 0644)
+
+	closed := []string{}
+	in := make(chan *core.Event)
+	comp := NewFileJSONOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test-20060102.json",
+		"partition": "{p}"
+	}`)).(*FileJSONOutput)
+	comp.Closed = func(fname string) { closed = append(closed, fname) }
+	close(in)
+	comp.Run()
+
+	// Ours renamed and handled as closed, others left alone
+	if files := listFiles(t, filepath.Join(dir, "a")); len(files) != 2 || files[0] != "other.tmp" || files[1] != "test-20240102.json" {
+		t.Error("FILE: not recovered ", files)
+	}
+	if len(closed) != 1 || closed[0] != filepath.Join(dir, "a", "test-20240102.json") {
+		t.Error("FILE: closed hook not called ", closed)
+	}
+}
+
+func TestFileOutputInflux(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 1)
+	comp := NewFileInfluxOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "test.lp",
+		"measurement": "flows", "precision": "s"
+	}`))
+	e := GetEvent(`{"bytes": 10}`)
+	e.Timestamp = time.Unix(1500000000, 0)
+	in <- e
+	close(in)
+	comp.Run()
+
+	// The event's timestamp is the point time
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "test.lp"))
+	if string(data) != "flows bytes=10i 1500000000\n" {
+		t.Error("FILE: wrong line ", string(data))
+	}
+}
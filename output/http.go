@@ -0,0 +1,400 @@
+/*
+   - HTTP: Send events to HTTP endpoints (webhooks, REST services). The URL and
+   headers are templates of event fields. Events are sent one per request or
+   batched as a JSON array or NDJSON body. Requests failing with a retryable
+   status (or a network error) are retried with exponential backoff. When the
+   endpoint keeps failing the circuit opens: no events are read for a while so
+   the backpressure reaches the input.
+*/
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering HttpOutput")
+	core.GetRegistryInstance()["HttpOutput"] = NewHttpOutput
+}
+
+// Events going to the same URL with the same headers
+type httpBatch struct {
+	url     string
+	headers map[string]string
+	events  []*core.Event
+}
+
+type HttpOutput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for encoding...
+	Encoder core.LineCodec
+	Client  *http.Client
+	// URL and header templates
+	URL     string
+	Method  string
+	Headers map[string]string
+	// single, json_array or ndjson
+	Mode string
+	Gzip bool
+	// Authentication: basic or bearer
+	AuthType string
+	Username string
+	Password string
+	Token    string
+	// Flush thresholds (batch modes)
+	BatchSize     int
+	FlushInterval time.Duration
+	// Retries with exponential backoff
+	RetryOn      map[int]bool
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// Open the circuit after this many failed requests in a row
+	CircuitFailures int
+	CircuitOpen     time.Duration
+	// Stats
+	Sent       uint64
+	Failed     uint64
+	failures   int
+	open_until time.Time
+	lock       *sync.Mutex
+	// Limits the requests in flight
+	inflight chan bool
+	wg       *sync.WaitGroup
+}
+
+func NewHttpOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating HttpOutput")
+
+	url, ok := cfg["url"].(string)
+	if !ok || url == "" {
+		panic("HttpOutput: 'url' is required")
+	}
+	method := "POST"
+	if tmp, ok := cfg["method"].(string); ok {
+		method = strings.ToUpper(tmp)
+	}
+	headers := map[string]string{}
+	if tmp, ok := cfg["headers"].(map[string]interface{}); ok {
+		for k, v := range tmp {
+			headers[k] = fmt.Sprint(v)
+		}
+	}
+
+	mode := "single"
+	if tmp, ok := cfg["mode"].(string); ok {
+		mode = tmp
+	}
+	if mode != "single" && mode != "json_array" && mode != "ndjson" {
+		panic("HttpOutput: 'mode' must be 'single', 'json_array' or 'ndjson'")
+	}
+	gz, _ := cfg["gzip"].(bool)
+
+	auth_type, username, password, token := "", "", "", ""
+	if auth, ok := cfg["auth"].(map[string]interface{}); ok {
+		auth_type, _ = auth["type"].(string)
+		username, _ = auth["username"].(string)
+		password, _ = auth["password"].(string)
+		token, _ = auth["token"].(string)
+		if auth_type != "basic" && auth_type != "bearer" {
+			panic("HttpOutput: auth 'type' must be 'basic' or 'bearer'")
+		}
+	}
+
+	batch_size := 100
+	if tmp, ok := cfg["batch_size"].(float64); ok {
+		batch_size = int(tmp)
+	}
+	if mode == "single" {
+		batch_size = 1
+	}
+	flush_interval := 1000.0
+	if tmp, ok := cfg["flush_interval_ms"].(float64); ok {
+		flush_interval = tmp
+	}
+	if flush_interval <= 0 {
+		panic("HttpOutput: 'flush_interval_ms' must be positive")
+	}
+
+	retry_on := map[int]bool{429: true, 502: true, 503: true, 504: true}
+	if tmp, ok := cfg["retry_on"].([]interface{}); ok {
+		retry_on = map[int]bool{}
+		for _, code := range tmp {
+			if c, ok := code.(float64); ok {
+				retry_on[int(c)] = true
+			}
+		}
+	}
+	max_retries := 3
+	if tmp, ok := cfg["max_retries"].(float64); ok {
+		max_retries = int(tmp)
+	}
+	retry_backoff := 500.0
+	if tmp, ok := cfg["retry_backoff_ms"].(float64); ok {
+		retry_backoff = tmp
+	}
+	max_backoff := 30000.0
+	if tmp, ok := cfg["max_backoff_ms"].(float64); ok {
+		max_backoff = tmp
+	}
+	timeout := 10000.0
+	if tmp, ok := cfg["timeout_ms"].(float64); ok {
+		timeout = tmp
+	}
+	max_in_flight := 4
+	if tmp, ok := cfg["max_in_flight"].(float64); ok && tmp >= 1 {
+		max_in_flight = int(tmp)
+	}
+	circuit_failures := 5
+	if tmp, ok := cfg["circuit_failures"].(float64); ok {
+		circuit_failures = int(tmp)
+	}
+	circuit_open := 30000.0
+	if tmp, ok := cfg["circuit_open_ms"].(float64); ok {
+		circuit_open = tmp
+	}
+
+	m := &HttpOutput{core.NewComponentBase(inQ, outQ, cfg), &core.JSONLineCodec{},
+		&http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		url, method, headers, mode, gz,
+		auth_type, username, password, token,
+		batch_size, time.Duration(flush_interval) * time.Millisecond,
+		retry_on, max_retries, time.Duration(retry_backoff) * time.Millisecond,
+		time.Duration(max_backoff) * time.Millisecond,
+		circuit_failures, time.Duration(circuit_open) * time.Millisecond,
+		0, 0, 0, time.Time{}, &sync.Mutex{},
+		make(chan bool, max_in_flight), &sync.WaitGroup{}}
+
+	m.Tag = "OUT-HTTP"
+
+	return m
+}
+
+func (p *HttpOutput) Signal(string) {}
+
+// Add the sent/failed events and the circuit state to the component stats
+func (p *HttpOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Sent"] = p.Sent
+	ret["Failed"] = p.Failed
+	ret["CircuitOpen"] = time.Now().Before(p.open_until)
+	return ret
+}
+
+func (p *HttpOutput) Run() {
+	p.MustStop = false
+
+	// Batches by URL and headers, in the order they were started
+	batches := map[string]*httpBatch{}
+	keys := []string{}
+	queued := 0
+	b := &batcher{
+		Queue: func(e *core.Event) bool {
+			batch := &httpBatch{expandURL(p.URL, e.Data), map[string]string{}, nil}
+			for k, v := range p.Headers {
+				batch.headers[k] = expandFields(v, e.Data)
+			}
+			key := batch.key()
+			if _, ok := batches[key]; !ok {
+				batches[key] = batch
+				keys = append(keys, key)
+			}
+			batches[key].events = append(batches[key].events, e)
+			queued++
+			return true
+		},
+		Full: func() bool {
+			return queued >= p.BatchSize
+		},
+		Flush: func() {
+			for _, key := range keys {
+				p.dispatch(batches[key])
+			}
+			batches = map[string]*httpBatch{}
+			keys = keys[:0]
+			queued = 0
+		},
+		// Events are passed on by the requests
+		Close:         p.wg.Wait,
+		FlushInterval: p.FlushInterval,
+	}
+	b.run(p.ComponentBase)
+
+	log.Info("HTTP-OUT: Stopped")
+}
+
+func (b *httpBatch) key() string {
+	names := []string{}
+	for k := range b.headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	key := b.url
+	for _, k := range names {
+		key += "\n" + k + ": " + b.headers[k]
+	}
+	return key
+}
+
+// Send a batch in the background, blocking while the circuit is open or too
+// many requests are in flight
+func (p *HttpOutput) dispatch(b *httpBatch) {
+	for {
+		p.lock.Lock()
+		wait := time.Until(p.open_until)
+		p.lock.Unlock()
+		if wait <= 0 {
+			break
+		}
+		time.Sleep(wait)
+	}
+
+	p.inflight <- true
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		err := p.send(b)
+		<-p.inflight
+		p.done(b, err)
+	}()
+}
+
+// The circuit opens after CircuitFailures failed batches in a row and is
+// closed again by the first successful one
+func (p *HttpOutput) done(b *httpBatch, err error) {
+	p.lock.Lock()
+	if err != nil {
+		log.Errorf("HTTP-OUT: Failed to send %d events to %s: %s", len(b.events), b.url, err.Error())
+		p.Failed += uint64(len(b.events))
+		p.failures++
+		if p.CircuitFailures > 0 && p.failures >= p.CircuitFailures {
+			log.Warnf("HTTP-OUT: %d failures in a row, pausing for %v", p.failures, p.CircuitOpen)
+			p.open_until = time.Now().Add(p.CircuitOpen)
+		}
+	} else {
+		p.Sent += uint64(len(b.events))
+		p.failures = 0
+	}
+	p.lock.Unlock()
+
+	for _, e := range b.events {
+		if err != nil {
+			e.Data["_http_error"] = err.Error()
+		}
+
+		// Check if we are being used in proc! The next components hold their
+		// own reference
+		if p.OutQ != nil {
+			e.Retain()
+			p.OutQ <- e
+		}
+		if err != nil {
+			e.Nack()
+		} else {
+			e.Ack()
+		}
+	}
+}
+
+// Encode the body of a batch
+func (p *HttpOutput) body(b *httpBatch) ([]byte, error) {
+	var buf bytes.Buffer
+	if p.Mode == "json_array" {
+		buf.WriteByte('[')
+	}
+	for i, e := range b.events {
+		data, err := p.Encoder.ToBytes(e.Data)
+		if err != nil {
+			return nil, err
+		}
+		data = bytes.TrimRight(data, "\n")
+		if p.Mode == "json_array" && i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.Write(data)
+		if p.Mode == "ndjson" {
+			buf.WriteByte('\n')
+		}
+	}
+	if p.Mode == "json_array" {
+		buf.WriteByte(']')
+	}
+
+	if !p.Gzip {
+		return buf.Bytes(), nil
+	}
+	var gzbuf bytes.Buffer
+	w := gzip.NewWriter(&gzbuf)
+	w.Write(buf.Bytes())
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return gzbuf.Bytes(), nil
+}
+
+// Send a batch, retrying on network errors and retryable statuses
+func (p *HttpOutput) send(b *httpBatch) error {
+	body, err := p.body(b)
+	if err != nil {
+		return err
+	}
+
+	return withRetries("HTTP-OUT", p.MaxRetries, p.RetryBackoff, p.MaxBackoff, func(int) (bool, error) {
+		return p.request(b, body)
+	})
+}
+
+// Send one request. Returns whether a failure is worth retrying
+func (p *HttpOutput) request(b *httpBatch, body []byte) (bool, error) {
+	req, err := http.NewRequest(p.Method, b.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+
+	if p.Mode == "ndjson" {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if p.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	switch p.AuthType {
+	case "basic":
+		req.SetBasicAuth(p.Username, p.Password)
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+p.Token)
+	}
+	for k, v := range b.headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	return p.RetryOn[resp.StatusCode], err
+}
@@ -0,0 +1,150 @@
+package output
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// Records the requests it gets and answers with the given statuses in turn
+// (the last one is repeated)
+type httpStandIn struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []string
+}
+
+func (s *httpStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		body, _ = gzip.NewReader(r.Body)
+	}
+	data, _ := ioutil.ReadAll(body)
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("X-Src")+" "+string(data))
+
+	status := s.statuses[0]
+	if len(s.statuses) > 1 {
+		s.statuses = s.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestHttpOutputBatches(t *testing.T) {
+	standin := &httpStandIn{statuses: []int{200}}
+	srv := httptest.NewServer(standin)
+	defer srv.Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewHttpOutput(in, nil, GetConfig(`{
+		"url": "`+srv.URL+`/{type}", "method": "put", "headers": {"X-Src": "{src}"},
+		"mode": "ndjson", "gzip": true, "batch_size": 10
+	}`))
+
+	acks := []chan bool{}
+	for _, data := range []string{
+		`{"type": "a", "src": "1", "n": 1}`,
+		`{"type": "b", "src": "1", "n": 2}`,
+		`{"type": "a", "src": "1", "n": 3}`,
+	} {
+		e, ack := GetAckedEvent(data)
+		in <- e
+		acks = append(acks, ack)
+	}
+	close(in)
+	comp.Run()
+
+	for _, ack := range acks {
+		if ok := <-ack; !ok {
+			t.Error("HTTP: event nacked")
+		}
+	}
+
+	// One request per URL
+	sort.Strings(standin.requests)
+	if len(standin.requests) != 2 ||
+		standin.requests[0] != "PUT /a 1 {\"n\":1,\"src\":\"1\",\"type\":\"a\"}\n{\"n\":3,\"src\":\"1\",\"type\":\"a\"}\n" ||
+		standin.requests[1] != "PUT /b 1 {\"n\":2,\"src\":\"1\",\"type\":\"b\"}\n" {
+		t.Error("HTTP: wrong requests ", standin.requests)
+	}
+}
+
+func TestHttpOutputRetry(t *testing.T) {
+	standin := &httpStandIn{statuses: []int{503, 429, 201}}
+	srv := httptest.NewServer(standin)
+	defer srv.Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewHttpOutput(in, nil, GetConfig(`{
+		"url": "`+srv.URL+`/", "mode": "json_array", "retry_backoff_ms": 10
+	}`))
+
+	e, ack := GetAckedEvent(`{"n": 1}`)
+	in <- e
+	close(in)
+	comp.Run()
+
+	if ok := <-ack; !ok {
+		t.Error("HTTP: event nacked")
+	}
+	if len(standin.requests) != 3 || standin.requests[2] != `POST /  [{"n":1}]` {
+		t.Error("HTTP: wrong requests ", standin.requests)
+	}
+}
+
+func TestHttpOutputCircuit(t *testing.T) {
+	standin := &httpStandIn{statuses: []int{500}}
+	srv := httptest.NewServer(standin)
+	defer srv.Close()
+
+	in := make(chan *core.Event, 10)
+	out := make(chan *core.Event, 10)
+	comp := NewHttpOutput(in, out, GetConfig(`{
+		"url": "`+srv.URL+`/", "circuit_failures": 2, "circuit_open_ms": 300,
+		"max_in_flight": 1
+	}`))
+	go comp.Run()
+
+	// 500 is not retried, two failures open the circuit
+	for i := 0; i < 2; i++ {
+		in <- GetEvent(`{"n": 1}`)
+		if e := <-out; e.Data["_http_error"] == nil {
+			t.Error("HTTP: failure not reported ", e.Data)
+		}
+	}
+	if stats := comp.GetStatsJSON(); stats["CircuitOpen"] != true || stats["Failed"] != uint64(2) {
+		t.Error("HTTP: circuit not open ", stats)
+	}
+
+	// Nothing is sent while open
+	start := time.Now()
+	standin.lock.Lock()
+	standin.statuses = []int{200}
+	standin.lock.Unlock()
+	in <- GetEvent(`{"n": 2}`)
+	e := <-out
+	if e.Data["_http_error"] != nil || time.Since(start) < 200*time.Millisecond {
+		t.Error("HTTP: sent while the circuit was open ", time.Since(start), e.Data)
+	}
+	if stats := comp.GetStatsJSON(); stats["CircuitOpen"] != false {
+		t.Error("HTTP: circuit not closed ", stats)
+	}
+	close(in)
+}
+
+func TestHttpOutputURLEscape(t *testing.T) {
+	data := map[string]interface{}{"team": "a/../b?x=1", "q": "c&d=e f"}
+	if u := expandURL("http://h/{team}/events?q={q}&t={team}", data); u != "http://h/a%2F..%2Fb%3Fx=1/events?q=c%26d%3De+f&t=a%2F..%2Fb%3Fx%3D1" {
+		t.Error("HTTP: wrong URL ", u)
+	}
+}
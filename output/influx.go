@@ -0,0 +1,277 @@
+/*
+   - INFLUX: Write events to InfluxDB as line protocol points, in batches over
+   HTTP or over UDP. Fields are mapped to the measurement, tags and fields with
+   the `InfluxLineCodec`, which can also be used with the file and stdout
+   outputs. The point time is the event's timestamp or the value of a field.
+*/
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering InfluxOutput")
+	core.GetRegistryInstance()["InfluxOutput"] = NewInfluxOutput
+}
+
+// A queued point
+type influxPoint struct {
+	e    *core.Event
+	line []byte
+}
+
+type InfluxOutput struct {
+	*core.ComponentBase
+	Encoder *core.InfluxLineCodec
+	// Write endpoint (HTTP) or host:port (UDP)
+	URL    string
+	UDP    string
+	Client *http.Client
+	// Authentication: token or username/password
+	Token    string
+	Username string
+	Password string
+	// Flush thresholds
+	BatchSize     int
+	FlushInterval time.Duration
+	// Retries of 429/5xx with exponential backoff
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// Maximum datagram size over UDP
+	UDPPayload int
+	// Stats
+	Written uint64
+	Failed  uint64
+	lock    *sync.Mutex
+}
+
+func NewInfluxOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating InfluxOutput")
+
+	codec, err := core.NewInfluxLineCodec(cfg)
+	if err != nil {
+		panic(err.Error())
+	}
+
+	write_url, _ := cfg["url"].(string)
+	udp, _ := cfg["udp"].(string)
+	if (write_url == "") == (udp == "") {
+		panic("InfluxOutput: one of 'url' or 'udp' is required")
+	}
+
+	// Let the server know the precision of the timestamps
+	if write_url != "" {
+		u, err := url.Parse(write_url)
+		if err != nil {
+			panic("InfluxOutput: Invalid 'url': " + err.Error())
+		}
+		q := u.Query()
+		if q.Get("precision") == "" {
+			q.Set("precision", codec.Precision)
+			u.RawQuery = q.Encode()
+		}
+		write_url = u.String()
+	}
+
+	token, _ := cfg["token"].(string)
+	username, _ := cfg["username"].(string)
+	password, _ := cfg["password"].(string)
+
+	batch_size := 5000
+	if tmp, ok := cfg["batch_size"].(float64); ok {
+		batch_size = int(tmp)
+	}
+	flush_interval := 1000.0
+	if tmp, ok := cfg["flush_interval_ms"].(float64); ok {
+		flush_interval = tmp
+	}
+	if flush_interval <= 0 {
+		panic("InfluxOutput: 'flush_interval_ms' must be positive")
+	}
+	max_retries := 3
+	if tmp, ok := cfg["max_retries"].(float64); ok {
+		max_retries = int(tmp)
+	}
+	retry_backoff := 500.0
+	if tmp, ok := cfg["retry_backoff_ms"].(float64); ok {
+		retry_backoff = tmp
+	}
+	timeout := 10000.0
+	if tmp, ok := cfg["timeout_ms"].(float64); ok {
+		timeout = tmp
+	}
+	udp_payload := 1400
+	if tmp, ok := cfg["udp_payload"].(float64); ok {
+		udp_payload = int(tmp)
+	}
+
+	m := &InfluxOutput{core.NewComponentBase(inQ, outQ, cfg), codec,
+		write_url, udp, &http.Client{Timeout: time.Duration(timeout) * time.Millisecond},
+		token, username, password,
+		batch_size, time.Duration(flush_interval) * time.Millisecond,
+		max_retries, time.Duration(retry_backoff) * time.Millisecond, udp_payload,
+		0, 0, &sync.Mutex{}}
+
+	m.Tag = "OUT-INFLUX"
+
+	return m
+}
+
+func (p *InfluxOutput) Signal(string) {}
+
+// Add the written/failed points to the component stats
+func (p *InfluxOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Written"] = p.Written
+	ret["Failed"] = p.Failed
+	return ret
+}
+
+func (p *InfluxOutput) Run() {
+	p.MustStop = false
+
+	var conn net.Conn
+	if p.UDP != "" {
+		var err error
+		if conn, err = net.Dial("udp", p.UDP); err != nil {
+			// Giving up: not the end of the stream
+			log.Error("INFLUX-OUT: Failed to connect, stopping: ", err.Error())
+			return
+		}
+		defer conn.Close()
+	}
+
+	batch := []*influxPoint{}
+	b := &batcher{
+		Queue: func(e *core.Event) bool {
+			line, err := p.Encoder.Encode(e.Data, e.Timestamp)
+			if err != nil {
+				log.Error("INFLUX-OUT: Failed to encode data: ", err.Error())
+				e.Nack()
+				return false
+			}
+			batch = append(batch, &influxPoint{e, line})
+			return true
+		},
+		Full: func() bool {
+			return len(batch) >= p.BatchSize
+		},
+		Flush: func() {
+			p.Flush(conn, batch)
+			batch = batch[:0]
+		},
+		FlushInterval: p.FlushInterval,
+	}
+	b.run(p.ComponentBase)
+
+	log.Info("INFLUX-OUT: Stopped")
+}
+
+// Write a batch over UDP (conn) or HTTP. Every event is done once this returns
+func (p *InfluxOutput) Flush(conn net.Conn, batch []*influxPoint) {
+	var err error
+	if conn != nil {
+		err = p.sendUDP(conn, batch)
+	} else {
+		err = p.sendHTTP(batch)
+	}
+
+	p.lock.Lock()
+	if err != nil {
+		log.Errorf("INFLUX-OUT: Failed to write %d points: %s", len(batch), err.Error())
+		p.Failed += uint64(len(batch))
+	} else {
+		p.Written += uint64(len(batch))
+	}
+	p.lock.Unlock()
+
+	for _, pt := range batch {
+		if err != nil {
+			pt.e.Data["_influx_error"] = err.Error()
+		}
+
+		// Check if we are being used in proc! The next components hold their
+		// own reference
+		if p.OutQ != nil {
+			pt.e.Retain()
+			p.OutQ <- pt.e
+		}
+		if err != nil {
+			pt.e.Nack()
+		} else {
+			pt.e.Ack()
+		}
+	}
+}
+
+// Pack as many lines as fit in a datagram
+func (p *InfluxOutput) sendUDP(conn net.Conn, batch []*influxPoint) error {
+	var buf bytes.Buffer
+	for _, pt := range batch {
+		if buf.Len() > 0 && buf.Len()+len(pt.line)+1 > p.UDPPayload {
+			if _, err := conn.Write(buf.Bytes()); err != nil {
+				return err
+			}
+			buf.Reset()
+		}
+		buf.Write(pt.line)
+		buf.WriteByte('\n')
+	}
+	_, err := conn.Write(buf.Bytes())
+	return err
+}
+
+// POST the batch, retrying on 429/5xx and network errors
+func (p *InfluxOutput) sendHTTP(batch []*influxPoint) error {
+	var body bytes.Buffer
+	for _, pt := range batch {
+		body.Write(pt.line)
+		body.WriteByte('\n')
+	}
+
+	return withRetries("INFLUX-OUT", p.MaxRetries, p.RetryBackoff, 30*time.Second, func(int) (bool, error) {
+		return p.post(body.Bytes())
+	})
+}
+
+// Send one request. Returns whether a failure is worth retrying
+func (p *InfluxOutput) post(body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", p.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if p.Token != "" {
+		req.Header.Set("Authorization", "Token "+p.Token)
+	} else if p.Username != "" {
+		req.SetBasicAuth(p.Username, p.Password)
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	msg, _ := ioutil.ReadAll(resp.Body)
+
+	if resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
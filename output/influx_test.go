@@ -0,0 +1,136 @@
+package output
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestInfluxLineCodec(t *testing.T) {
+	c, err := core.NewInfluxLineCodec(GetConfig(`{
+		"measurement": "flows", "tags": ["src", "dst"], "precision": "s"
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := map[string]interface{}{
+		"src": "10.0.0.1", "dst": "a b,c=d", "bytes": int64(1500), "rate": 0.5,
+		"up": true, "name": `say "hi"`, "_from_addr": "1.1.1.1", "empty": nil,
+		"pkts": json.Number("10")}
+	ts := time.Unix(1500000000, 0)
+	line, err := c.Encode(data, ts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `flows,dst=a\ b\,c\=d,src=10.0.0.1 bytes=1500i,name="say \"hi\"",pkts=10i,rate=0.5,up=true 1500000000`
+	if string(line) != expected {
+		t.Error("Influx: wrong line\n", string(line), "\n", expected)
+	}
+
+	// As a codec the time comes from the time field
+	c, _ = core.NewInfluxLineCodec(GetConfig(`{
+		"measurement_field": "type", "fields": ["v"], "time_field": "ts", "precision": "ms"
+	}`))
+	b, err := c.ToBytes(map[string]interface{}{"type": "cpu load", "v": 1.0, "ts": float64(1500000000123), "x": 1.0})
+	if err != nil || string(b) != "cpu\\ load v=1 1500000000123\n" {
+		t.Error("Influx: wrong codec line ", string(b), err)
+	}
+
+	if _, err := c.ToBytes(map[string]interface{}{"type": "cpu", "x": 1.0}); err == nil {
+		t.Error("Influx: encoded a point without fields")
+	}
+	if _, err := core.NewInfluxLineCodec(GetConfig(`{"tags": ["a"]}`)); err == nil {
+		t.Error("Influx: accepted a config without measurement")
+	}
+}
+
+func TestInfluxOutputHTTP(t *testing.T) {
+	var lock sync.Mutex
+	requests := []string{}
+	bodies := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ := ioutil.ReadAll(r.Body)
+		requests = append(requests, r.URL.RawQuery)
+		bodies = append(bodies, string(body))
+		// Fail the first one
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewInfluxOutput(in, nil, GetConfig(`{
+		"url": "`+srv.URL+`/write?db=test", "measurement": "m", "tags": ["host"],
+		"precision": "s", "retry_backoff_ms": 10
+	}`))
+
+	acks := []chan bool{}
+	for i := 0; i < 2; i++ {
+		e, ack := GetAckedEvent(`{"host": "h", "v": 1}`)
+		e.Timestamp = time.Unix(1500000000+int64(i), 0)
+		in <- e
+		acks = append(acks, ack)
+	}
+	close(in)
+	comp.Run()
+
+	for _, ack := range acks {
+		if ok := <-ack; !ok {
+			t.Error("Influx: point nacked")
+		}
+	}
+	if len(requests) != 2 || requests[1] != "db=test&precision=s" {
+		t.Error("Influx: wrong requests ", requests)
+	}
+	if bodies[1] != "m,host=h v=1i 1500000000\nm,host=h v=1i 1500000001\n" {
+		t.Error("Influx: wrong body ", bodies[1])
+	}
+	if stats := comp.GetStatsJSON(); stats["Written"] != uint64(2) {
+		t.Error("Influx: wrong stats ", stats)
+	}
+}
+
+func TestInfluxOutputUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewInfluxOutput(in, nil, GetConfig(`{
+		"udp": "`+conn.LocalAddr().String()+`", "measurement": "m", "udp_payload": 30
+	}`))
+
+	// Each line is 13 bytes with the new line: two fit in a datagram
+	for i := 0; i < 3; i++ {
+		e := GetEvent(`{"v": 1}`)
+		e.Timestamp = time.Unix(0, 12345)
+		in <- e
+	}
+	close(in)
+	comp.Run()
+
+	buf := make([]byte, 100)
+	for _, expected := range []string{"m v=1i 12345\nm v=1i 12345\n", "m v=1i 12345\n"} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, _ := conn.ReadFrom(buf)
+		if string(buf[:n]) != expected {
+			t.Error("Influx: wrong datagram ", string(buf[:n]))
+		}
+	}
+}
@@ -0,0 +1,323 @@
+/*
+   - KAFKA: Produce events to a Kafka topic. The topic and the message key can be
+   templates with `{field}` placeholders replaced by the values of the event's
+   fields. Delivery reports are counted in the stats and, when used in the proc
+   section, events are passed down once delivered (or failed, with the error in
+   `_kafka_error`). Pending messages are flushed on Stop.
+*/
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering KafkaJSONOutput")
+	core.GetRegistryInstance()["KafkaJSONOutput"] = NewKafkaJSONOutput
+
+	log.Info("Registering KafkaCSVOutput")
+	core.GetRegistryInstance()["KafkaCSVOutput"] = NewKafkaCSVOutput
+
+	log.Info("Registering KafkaRawOutput")
+	core.GetRegistryInstance()["KafkaRawOutput"] = NewKafkaRawOutput
+
+	log.Info("Registering KafkaStrOutput")
+	core.GetRegistryInstance()["KafkaStrOutput"] = NewKafkaStrOutput
+}
+
+// The base structure for common Kafka Ops
+type KafkaJSONOutput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for encoding...
+	Encoder core.LineCodec
+	// Drop the new line the JSON/CSV encoders add
+	TrimNewLine bool
+	Kafka       *kafka.Producer
+	// Topic and key templates
+	Topic string
+	Key   string
+	// How long to wait for pending messages on Stop
+	FlushTimeoutMs int
+	// Delivery reports
+	Delivered uint64
+	Failed    uint64
+	lock      *sync.Mutex
+	// Guards flushing against closing the producer
+	closeLock *sync.Mutex
+	closed    bool
+	// Closed when all delivery reports have been processed
+	reportsDone chan bool
+}
+
+func NewKafkaJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating KafkaJSONOutput")
+
+	brokers, ok := cfg["brokers"].(string)
+	if !ok {
+		panic("KafkaOutput: 'brokers' is required")
+	}
+
+	topic, ok := cfg["topic"].(string)
+	if !ok || topic == "" {
+		panic("KafkaOutput: 'topic' is required")
+	}
+
+	key, _ := cfg["key"].(string)
+
+	flush_timeout := 10000
+	if tmp, ok := cfg["flush_timeout_ms"].(float64); ok {
+		flush_timeout = int(tmp)
+	}
+
+	// Any librdkafka producer setting can be given in producer_conf
+	kafkaConfig := kafka.ConfigMap{"bootstrap.servers": brokers}
+	if tmp, ok := cfg["producer_conf"].(map[string]interface{}); ok {
+		for k, v := range tmp {
+			kafkaConfig.SetKey(k, v)
+		}
+	}
+
+	k, err := kafka.NewProducer(&kafkaConfig)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create producer: %s\n", err))
+	}
+
+	m := &KafkaJSONOutput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, true, k, topic, key, flush_timeout,
+		0, 0, &sync.Mutex{}, &sync.Mutex{}, false, make(chan bool)}
+
+	log.Infof("Created Producer %v\n", m.Kafka)
+
+	m.Tag = "OUT-KAFKA-JSON"
+
+	return m
+}
+
+func (p *KafkaJSONOutput) Signal(string) {}
+
+// Add the delivery reports to the component stats
+func (p *KafkaJSONOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Delivered"] = p.Delivered
+	ret["Failed"] = p.Failed
+	return ret
+}
+
+// Flush pending messages before stopping
+func (p *KafkaJSONOutput) Stop() {
+	p.ComponentBase.Stop()
+
+	// Flush needs the delivery reports to be consumed, so do not hold p.lock
+	p.closeLock.Lock()
+	defer p.closeLock.Unlock()
+	if p.closed {
+		return
+	}
+
+	log.Info("KAFKA-OUT: Flushing...")
+	if left := p.Kafka.Flush(p.FlushTimeoutMs); left > 0 {
+		log.Warnf("KAFKA-OUT: %d messages were not delivered", left)
+	}
+}
+
+// An event has been delivered (err is nil) or failed
+func (p *KafkaJSONOutput) delivered(e *core.Event, err error) {
+	p.lock.Lock()
+	if err != nil {
+		p.Failed++
+	} else {
+		p.Delivered++
+	}
+	p.lock.Unlock()
+
+	if e == nil {
+		return
+	}
+	if err != nil {
+		e.Data["_kafka_error"] = err.Error()
+	}
+
+	// Check if we are being used in proc! The next components hold their
+	// own reference
+	if p.OutQ != nil {
+		e.Retain()
+		p.OutQ <- e
+	}
+	if err != nil {
+		e.Nack()
+	} else {
+		e.Ack()
+	}
+}
+
+// Handle the delivery reports
+func (p *KafkaJSONOutput) reports() {
+	for ev := range p.Kafka.Events() {
+		switch ke := ev.(type) {
+		case *kafka.Message:
+			e, _ := ke.Opaque.(*core.Event)
+			if ke.TopicPartition.Error != nil {
+				log.Error("KAFKA-OUT: Failed to deliver to ", *ke.TopicPartition.Topic, ": ",
+					ke.TopicPartition.Error.Error())
+			}
+			p.delivered(e, ke.TopicPartition.Error)
+		case kafka.Error:
+			log.Errorf("KAFKA-OUT: Error: %v\n", ke)
+		default:
+			log.Debugf("KAFKA-OUT: Ignored %v\n", ke)
+		}
+	}
+	close(p.reportsDone)
+}
+
+func (p *KafkaJSONOutput) Run() {
+	p.MustStop = false
+	go p.reports()
+
+	// Delivery reports are passed down from another go routine, so we cannot
+	// let Receive() close the outQ: read the inQ ourselves
+	eos := false
+	var data []byte
+
+	for !p.MustStop {
+		var e *core.Event
+		var ok bool
+		select {
+		case e, ok = <-p.InQ:
+		case <-p.Stopping():
+			continue
+		}
+		if !ok {
+			eos = true
+			break
+		}
+		if p.Skip(e) {
+			continue
+		}
+
+		var err error
+		data, err = p.Encoder.ToBytes(e.Data)
+		if err != nil {
+			log.Error("KAFKA-OUT: Failed to encode data: ", err.Error())
+			e.Nack()
+			continue
+		}
+		if p.TrimNewLine && len(data) > 0 && data[len(data)-1] == '\n' {
+			data = data[:len(data)-1]
+		}
+
+		topic := expandFields(p.Topic, e.Data)
+		msg := &kafka.Message{
+			TopicPartition: kafka.TopicPartition{Topic: &topic, Partition: kafka.PartitionAny},
+			Value:          data,
+			Timestamp:      e.Timestamp,
+			Opaque:         e,
+		}
+		if p.Key != "" {
+			if key := expandFields(p.Key, e.Data); key != "" {
+				msg.Key = []byte(key)
+			}
+		}
+
+		// The local queue is full, wait for the delivery reports to catch up
+		for {
+			err = p.Kafka.Produce(msg, nil)
+			if kerr, ok := err.(kafka.Error); !ok || kerr.Code() != kafka.ErrQueueFull {
+				break
+			}
+			time.Sleep(time.Duration(10) * time.Millisecond)
+		}
+		if err != nil {
+			log.Error("KAFKA-OUT: Failed to produce: ", err.Error())
+			p.delivered(e, err)
+		}
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	p.Stop()
+	p.closeLock.Lock()
+	p.closed = true
+	// Closes the events channel, so reports() returns once done
+	p.Kafka.Close()
+	p.closeLock.Unlock()
+	<-p.reportsDone
+
+	if eos {
+		p.EndOfStream()
+	}
+	log.Info("KAFKA-OUT: Stopped")
+}
+
+// Kafka CSV implementation
+type KafkaCSVOutput struct {
+	*KafkaJSONOutput
+}
+
+func NewKafkaCSVOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating KafkaCSVOutput")
+
+	// Defaults...
+	m := KafkaCSVOutput{NewKafkaJSONOutput(inQ, outQ, cfg).(*KafkaJSONOutput)}
+
+	m.Tag = "OUT-KAFKA-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Encoder = c
+
+	return &m
+}
+
+// Kafka Raw implementation
+type KafkaRawOutput struct {
+	*KafkaJSONOutput
+}
+
+func NewKafkaRawOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating KafkaRawOutput")
+
+	// Defaults...
+	m := KafkaRawOutput{NewKafkaJSONOutput(inQ, outQ, cfg).(*KafkaJSONOutput)}
+
+	m.Tag = "OUT-KAFKA-RAW"
+
+	m.Encoder = &core.RawLineCodec{}
+	m.TrimNewLine = false
+
+	return &m
+}
+
+// Kafka String implementation
+type KafkaStrOutput struct {
+	*KafkaJSONOutput
+}
+
+func NewKafkaStrOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating KafkaStrOutput")
+
+	// Defaults...
+	m := KafkaStrOutput{NewKafkaJSONOutput(inQ, outQ, cfg).(*KafkaJSONOutput)}
+
+	m.Tag = "OUT-KAFKA-STR"
+
+	m.Encoder = &core.StringLineCodec{}
+	m.TrimNewLine = false
+
+	return &m
+}
@@ -0,0 +1,90 @@
+package output
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestExpandFields(t *testing.T) {
+	data := map[string]interface{}{"a": "x", "b": float64(2)}
+	if r := expandFields("t-{a}-{b}-{c}", data); r != "t-x-2-" {
+		t.Error("Kafka: wrong template expansion ", r)
+	}
+	if r := expandFields("static", data); r != "static" {
+		t.Error("Kafka: wrong static topic ", r)
+	}
+}
+
+func TestKafkaOutput(t *testing.T) {
+	mc, err := kafka.NewMockCluster(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mc.Close()
+
+	in := make(chan *core.Event, 10)
+	out := make(chan *core.Event, 10)
+	comp := NewKafkaJSONOutput(in, out, GetConfig(fmt.Sprintf(`{
+		"brokers": "%s", "topic": "test-{type}", "key": "{src}"
+	}`, mc.BootstrapServers())))
+
+	in <- GetEvent(`{"type": "a", "src": "1.1.1.1"}`)
+	in <- GetEvent(`{"type": "a", "src": "2.2.2.2"}`)
+	close(in)
+	comp.Run()
+
+	// Passed down once delivered, then the end of the stream
+	for i := 0; i < 2; i++ {
+		e := <-out
+		if e.Data["_kafka_error"] != nil {
+			t.Error("Kafka: delivery failed ", e.Data)
+		}
+	}
+	if _, ok := <-out; ok {
+		t.Error("Kafka: outQ not closed at the end of the stream")
+	}
+	if stats := comp.GetStatsJSON(); stats["Delivered"] != uint64(2) {
+		t.Error("Kafka: wrong stats ", stats)
+	}
+
+	consumer, err := kafka.NewConsumer(&kafka.ConfigMap{
+		"bootstrap.servers": mc.BootstrapServers(),
+		"group.id":          "gopipe-test",
+		"auto.offset.reset": "earliest"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer consumer.Close()
+	consumer.SubscribeTopics([]string{"test-a"}, nil)
+
+	msg, err := consumer.ReadMessage(10 * time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg.Key) != "1.1.1.1" || string(msg.Value) != `{"src":"1.1.1.1","type":"a"}` {
+		t.Error("Kafka: wrong message ", string(msg.Key), string(msg.Value))
+	}
+}
+
+func TestKafkaOutputFailure(t *testing.T) {
+	in := make(chan *core.Event, 1)
+	out := make(chan *core.Event, 1)
+	comp := NewKafkaStrOutput(in, out, GetConfig(`{
+		"brokers": "127.0.0.1:1", "topic": "test",
+		"producer_conf": {"message.timeout.ms": 500}
+	}`))
+
+	in <- GetEvent(`{"message": "lost"}`)
+	close(in)
+	go comp.Run()
+
+	e := <-out
+	if e.Data["_kafka_error"] == nil {
+		t.Error("Kafka: failed delivery not reported ", e.Data)
+	}
+}
@@ -34,10 +34,11 @@ func (p *NullOutput) Run() {
 	log.Debug("NullOutput Starting ... ")
 	for !p.MustStop {
 		log.Debug("NullOutput Reading")
-		_, err := p.ShouldRun()
+		e, err := p.ShouldRun()
 		if err != nil {
 			continue
 		}
+		e.Ack()
 
 		// Stats
 		p.StatsAddMesg()
@@ -45,3 +45,24 @@ func TestNullShouldRun(t *testing.T) {
 		t.Error("NullProc did not run, it should...")
 	}
 }
+
+func TestNullAck(t *testing.T) {
+	in, out := GetChannels()
+	e, acks := GetAckedEvent(`{"doesnt": "matter"}`)
+	in <- e
+
+	comp := NewNullOutput(in, nil, GetConfig(`{}`))
+	go comp.Run()
+
+	select {
+	case ok := <-acks:
+		if !ok {
+			t.Error("NullOutput nacked an event")
+		}
+	case <-time.After(time.Duration(1) * time.Second):
+		t.Error("NullOutput did not ack")
+	}
+	if len(out) > 0 {
+		t.Error("NullOutput did not blackhole!")
+	}
+}
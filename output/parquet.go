@@ -0,0 +1,265 @@
+/*
+   - PARQUET: Write events to parquet files with an explicit column schema. Rows
+   are written in row groups, on size or on every flush, compressed with
+   snappy, zstd or gzip. Files are handled like the file output: rotation,
+   partitions, `.tmp` and rename, pruning and the rotated hook all apply
+*/
+package output
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+func init() {
+	log.Info("Registering FileParquetOutput")
+	core.GetRegistryInstance()["FileParquetOutput"] = NewFileParquetOutput
+}
+
+// A column of the schema and the event field it is read from
+type parquetColumn struct {
+	Name     string `json:"name"`
+	Field    string `json:"field"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// The parquet (physical and converted) type of each column type
+var parquetTypes = map[string]string{
+	"string":    "type=BYTE_ARRAY, convertedtype=UTF8",
+	"bytes":     "type=BYTE_ARRAY",
+	"boolean":   "type=BOOLEAN",
+	"int32":     "type=INT32",
+	"int64":     "type=INT64",
+	"float":     "type=FLOAT",
+	"double":    "type=DOUBLE",
+	"timestamp": "type=INT64, convertedtype=TIMESTAMP_MILLIS",
+}
+
+var parquetCodecs = map[string]parquet.CompressionCodec{
+	"none":   parquet.CompressionCodec_UNCOMPRESSED,
+	"snappy": parquet.CompressionCodec_SNAPPY,
+	"gzip":   parquet.CompressionCodec_GZIP,
+	"zstd":   parquet.CompressionCodec_ZSTD,
+}
+
+type FileParquetOutput struct {
+	*FileJSONOutput
+	Columns       []parquetColumn
+	Codec         parquet.CompressionCodec
+	RowGroupBytes int64
+}
+
+func NewFileParquetOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating FileParquetOutput")
+
+	// Compression is done by parquet, not on the whole file
+	base := core.Config{
+		"file_name_format":  "gopipe-20060102-150405.parquet",
+		"flush_interval_ms": 60000.0,
+	}
+	for k, v := range cfg {
+		if k != "compression" {
+			base[k] = v
+		}
+	}
+
+	m := FileParquetOutput{NewFileJSONOutput(inQ, outQ, base).(*FileJSONOutput),
+		nil, parquet.CompressionCodec_SNAPPY, 128 * 1024 * 1024}
+
+	m.Tag = "OUT-FILE-PARQUET"
+
+	cfgbytes, _ := json.Marshal(cfg["columns"])
+	if err := json.Unmarshal(cfgbytes, &m.Columns); err != nil || len(m.Columns) == 0 {
+		panic("FileParquetOutput: 'columns' is required: a list of {name, type, field, nullable}")
+	}
+	for i, c := range m.Columns {
+		if c.Name == "" || strings.ContainsAny(c.Name, ",=") {
+			panic(fmt.Sprintf("FileParquetOutput: invalid column name '%s'", c.Name))
+		}
+		if _, ok := parquetTypes[c.Type]; !ok {
+			panic(fmt.Sprintf("FileParquetOutput: invalid type '%s' of column '%s'", c.Type, c.Name))
+		}
+		if c.Field == "" {
+			m.Columns[i].Field = c.Name
+		}
+	}
+
+	if tmp, ok := cfg["compression"].(string); ok {
+		codec, ok := parquetCodecs[tmp]
+		if !ok {
+			panic("FileParquetOutput: 'compression' must be 'none', 'snappy', 'gzip' or 'zstd'")
+		}
+		m.Codec = codec
+	}
+
+	if tmp, ok := cfg["row_group_bytes"].(float64); ok && tmp > 0 {
+		m.RowGroupBytes = int64(tmp)
+	}
+
+	// A parquet file cannot be read before its footer is written
+	m.AckOnClose = true
+	m.NewWriter = m.newWriter
+
+	return &m
+}
+
+func (p *FileParquetOutput) newWriter(w io.Writer) (fileWriter, error) {
+	md := make([]string, len(p.Columns))
+	for i, c := range p.Columns {
+		repetition := "REQUIRED"
+		if c.Nullable {
+			repetition = "OPTIONAL"
+		}
+		md[i] = fmt.Sprintf("name=%s, %s, repetitiontype=%s", c.Name, parquetTypes[c.Type], repetition)
+	}
+
+	pw, err := writer.NewCSVWriterFromWriter(md, w, 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.CompressionType = p.Codec
+	pw.RowGroupSize = p.RowGroupBytes
+
+	return &parquetWriter{pw, p.Columns}, nil
+}
+
+// Writes rows with the columns of the schema
+type parquetWriter struct {
+	pw      *writer.CSVWriter
+	columns []parquetColumn
+}
+
+// Buffer a row. Row groups are written once they reach row_group_bytes (done
+// by the parquet writer) or on flush
+func (w *parquetWriter) Write(e *core.Event) (int, error) {
+	row := make([]interface{}, len(w.columns))
+	size := 0
+	for i, c := range w.columns {
+		v, n, err := parquetValue(c, e.Data[c.Field])
+		if err != nil {
+			return 0, &fileRowError{fmt.Errorf("column %s: %s", c.Name, err.Error())}
+		}
+		row[i] = v
+		size += n
+	}
+
+	if err := w.pw.Write(row); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+func (w *parquetWriter) Flush() error {
+	return w.pw.Flush(true)
+}
+
+// Write the last row group and the footer
+func (w *parquetWriter) Close() error {
+	return w.pw.WriteStop()
+}
+
+// A number as int64 and float64
+func parquetNumber(v interface{}) (int64, float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return int64(t), float64(t), true
+	case int32:
+		return int64(t), float64(t), true
+	case int64:
+		return t, float64(t), true
+	case uint32:
+		return int64(t), float64(t), true
+	case uint64:
+		return int64(t), float64(t), true
+	case float32:
+		return int64(t), float64(t), true
+	case float64:
+		return int64(t), t, true
+	case json.Number:
+		f, err := t.Float64()
+		if err != nil {
+			return 0, 0, false
+		}
+		if i, err := t.Int64(); err == nil {
+			return i, f, true
+		}
+		return int64(f), f, true
+	}
+	return 0, 0, false
+}
+
+// Convert a field value to the Go type the parquet writer expects for the
+// column, also returning its (approximate) size
+func parquetValue(c parquetColumn, v interface{}) (interface{}, int, error) {
+	if v == nil {
+		if c.Nullable {
+			return nil, 0, nil
+		}
+		return nil, 0, fmt.Errorf("missing field '%s'", c.Field)
+	}
+
+	switch c.Type {
+	case "string":
+		s, ok := v.(string)
+		if !ok {
+			s = fmt.Sprint(v)
+		}
+		return s, len(s), nil
+	case "bytes":
+		switch t := v.(type) {
+		case string:
+			return t, len(t), nil
+		case []byte:
+			return string(t), len(t), nil
+		}
+	case "boolean":
+		if b, ok := v.(bool); ok {
+			return b, 1, nil
+		}
+	case "int32":
+		if i, _, ok := parquetNumber(v); ok {
+			if i < math.MinInt32 || i > math.MaxInt32 {
+				return nil, 0, fmt.Errorf("'%v' is out of the int32 range", v)
+			}
+			return int32(i), 4, nil
+		}
+	case "int64":
+		if i, _, ok := parquetNumber(v); ok {
+			return i, 8, nil
+		}
+	case "float":
+		if _, f, ok := parquetNumber(v); ok {
+			return float32(f), 4, nil
+		}
+	case "double":
+		if _, f, ok := parquetNumber(v); ok {
+			return f, 8, nil
+		}
+	case "timestamp":
+		// Unix milliseconds, RFC3339 or time
+		switch t := v.(type) {
+		case time.Time:
+			return t.UnixNano() / int64(time.Millisecond), 8, nil
+		case string:
+			ts, err := time.Parse(time.RFC3339Nano, t)
+			if err != nil {
+				return nil, 0, err
+			}
+			return ts.UnixNano() / int64(time.Millisecond), 8, nil
+		}
+		if i, _, ok := parquetNumber(v); ok {
+			return i, 8, nil
+		}
+	}
+	return nil, 0, fmt.Errorf("cannot convert '%v' to %s", v, c.Type)
+}
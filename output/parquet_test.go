@@ -0,0 +1,109 @@
+package output
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+type parquetTestRow struct {
+	Src   *string `parquet:"name=src, type=BYTE_ARRAY, convertedtype=UTF8, repetitiontype=OPTIONAL"`
+	Bytes int64   `parquet:"name=bytes, type=INT64"`
+	Ts    int64   `parquet:"name=ts, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+}
+
+func TestFileParquetOutput(t *testing.T) {
+	dir := t.TempDir()
+
+	in := make(chan *core.Event, 10)
+	comp := NewFileParquetOutput(in, nil, GetConfig(`{
+		"folder": "`+dir+`", "file_name_format": "flows.parquet",
+		"compression": "zstd", "flush_interval_ms": 50,
+		"columns": [
+			{"name": "src", "type": "string", "nullable": true},
+			{"name": "bytes", "type": "int64"},
+			{"name": "ts", "field": "time", "type": "timestamp"}
+		]
+	}`))
+	done := make(chan bool)
+	go func() {
+		comp.Run()
+		done <- true
+	}()
+
+	e1, ack1 := GetAckedEvent(`{"src": "10.0.0.1", "bytes": 100, "time": "2018-03-16T10:00:00Z"}`)
+	in <- e1
+	// Not a number: rejected, the file is fine
+	e2, ack2 := GetAckedEvent(`{"src": "10.0.0.2", "bytes": "many", "time": 0}`)
+	in <- e2
+	if ok := <-ack2; ok {
+		t.Error("PARQUET: invalid row acked")
+	}
+
+	// Flushed as a row group but not acked until the file is closed
+	time.Sleep(150 * time.Millisecond)
+	select {
+	case <-ack1:
+		t.Error("PARQUET: acked before the file is closed")
+	default:
+	}
+
+	e3, ack3 := GetAckedEvent(`{"bytes": 300, "time": 1521194400000}`)
+	in <- e3
+	close(in)
+	<-done
+
+	for _, ack := range []chan bool{ack1, ack3} {
+		if ok := <-ack; !ok {
+			t.Error("PARQUET: event nacked")
+		}
+	}
+
+	fr, err := local.NewLocalFileReader(filepath.Join(dir, "flows.parquet"))
+	if err != nil {
+		t.Fatal("PARQUET: missing file ", err)
+	}
+	defer fr.Close()
+	pr, err := reader.NewParquetReader(fr, new(parquetTestRow), 1)
+	if err != nil {
+		t.Fatal("PARQUET: cannot read ", err)
+	}
+	defer pr.ReadStop()
+
+	rows := make([]parquetTestRow, pr.GetNumRows())
+	if err = pr.Read(&rows); err != nil || len(rows) != 2 {
+		t.Fatal("PARQUET: wrong rows ", rows, err)
+	}
+	if rows[0].Src == nil || *rows[0].Src != "10.0.0.1" || rows[0].Bytes != 100 || rows[0].Ts != 1521194400000 {
+		t.Error("PARQUET: wrong first row ", rows[0])
+	}
+	if rows[1].Src != nil || rows[1].Bytes != 300 || rows[1].Ts != 1521194400000 {
+		t.Error("PARQUET: wrong second row ", rows[1])
+	}
+
+	// One row group per flush
+	if len(pr.Footer.RowGroups) != 2 || pr.Footer.RowGroups[0].Columns[0].MetaData.Codec != parquet.CompressionCodec_ZSTD {
+		t.Error("PARQUET: wrong row groups ", pr.Footer.RowGroups)
+	}
+}
+
+func TestParquetValueInt32(t *testing.T) {
+	c := parquetColumn{Name: "port", Field: "port", Type: "int32"}
+
+	if v, _, err := parquetValue(c, 8080.0); err != nil || v != int32(8080) {
+		t.Error("PARQUET: wrong int32 ", v, err)
+	}
+	// Out of range values are row errors, not wrapped
+	for _, v := range []interface{}{float64(math.MaxInt32 + 1), int64(math.MinInt32 - 1)} {
+		if _, _, err := parquetValue(c, v); err == nil {
+			t.Error("PARQUET: no error for ", v)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+/*
+   - PROMETHEUS: Compute metrics from events and expose them on the API server
+   for Prometheus to scrape. Counters, gauges and histograms take their values
+   and label values from event fields. Label sets that have not been updated
+   for a while are expired. Can be used in the proc section to keep the events
+*/
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering PrometheusOutput")
+	core.GetRegistryInstance()["PrometheusOutput"] = NewPrometheusOutput
+}
+
+var promMetricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+var promLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Same as the Prometheus client
+var promDefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A label and the event field it is read from
+type promLabel struct {
+	Name  string
+	Field string
+}
+
+// One label set of a metric
+type promSeries struct {
+	Values []string
+	// Counters and gauges
+	Value float64
+	// Histograms: per bucket (not cumulative), sum and count
+	Buckets []uint64
+	Sum     float64
+	Count   uint64
+	Updated time.Time
+}
+
+type promMetric struct {
+	Name    string
+	Type    string
+	Help    string
+	Field   string
+	Labels  []promLabel
+	Buckets []float64
+	series  map[string]*promSeries
+}
+
+func newPromMetric(cfg core.Config) (*promMetric, error) {
+	m := &promMetric{series: map[string]*promSeries{}}
+	m.Name, _ = cfg["name"].(string)
+	m.Type, _ = cfg["type"].(string)
+	m.Help, _ = cfg["help"].(string)
+	m.Field, _ = cfg["field"].(string)
+
+	if !promMetricName.MatchString(m.Name) {
+		return nil, fmt.Errorf("invalid metric name '%s'", m.Name)
+	}
+
+	switch m.Type {
+	case "counter":
+	case "gauge", "histogram":
+		if m.Field == "" {
+			return nil, fmt.Errorf("%s '%s' needs a 'field'", m.Type, m.Name)
+		}
+	default:
+		return nil, fmt.Errorf("'type' of '%s' must be 'counter', 'gauge' or 'histogram'", m.Name)
+	}
+
+	// Field names or {name, field}
+	labels, _ := cfg["labels"].([]interface{})
+	for _, tmp := range labels {
+		var label promLabel
+		switch l := tmp.(type) {
+		case string:
+			label = promLabel{l, l}
+		case map[string]interface{}:
+			label.Name, _ = l["name"].(string)
+			label.Field, _ = l["field"].(string)
+			if label.Field == "" {
+				label.Field = label.Name
+			}
+		}
+		if !promLabelName.MatchString(label.Name) || strings.HasPrefix(label.Name, "__") {
+			return nil, fmt.Errorf("invalid label name '%s' of '%s' (use {\"name\", \"field\"})", label.Name, m.Name)
+		}
+		m.Labels = append(m.Labels, label)
+	}
+
+	if m.Type == "histogram" {
+		m.Buckets = promDefaultBuckets
+		if tmp, ok := cfg["buckets"].([]interface{}); ok {
+			m.Buckets = nil
+			for _, b := range tmp {
+				f, ok := b.(float64)
+				if !ok || (len(m.Buckets) > 0 && f <= m.Buckets[len(m.Buckets)-1]) {
+					return nil, fmt.Errorf("'buckets' of '%s' must be increasing numbers", m.Name)
+				}
+				m.Buckets = append(m.Buckets, f)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+// Update the series of the event's label values. Returns false if the event
+// has no (valid) value
+func (m *promMetric) update(data map[string]interface{}, now time.Time) bool {
+	value := 1.0
+	if m.Field != "" {
+		var ok bool
+		if value, ok = metricValue(data[m.Field]); !ok || math.IsNaN(value) {
+			return false
+		}
+	}
+	// Counters only go up
+	if m.Type == "counter" && value < 0 {
+		return false
+	}
+
+	values := make([]string, len(m.Labels))
+	for i, label := range m.Labels {
+		if v, ok := data[label.Field]; ok && v != nil {
+			values[i] = fmt.Sprint(v)
+		}
+	}
+
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &promSeries{Values: values}
+		if m.Type == "histogram" {
+			s.Buckets = make([]uint64, len(m.Buckets))
+		}
+		m.series[key] = s
+	}
+	s.Updated = now
+
+	switch m.Type {
+	case "counter":
+		s.Value += value
+	case "gauge":
+		s.Value = value
+	case "histogram":
+		for i, b := range m.Buckets {
+			if value <= b {
+				s.Buckets[i]++
+				break
+			}
+		}
+		s.Sum += value
+		s.Count++
+	}
+	return true
+}
+
+// Remove the series not updated since the deadline
+func (m *promMetric) expire(deadline time.Time) int {
+	expired := 0
+	for key, s := range m.series {
+		if s.Updated.Before(deadline) {
+			delete(m.series, key)
+			expired++
+		}
+	}
+	return expired
+}
+
+func promEscape(v string, quote bool) string {
+	v = strings.Replace(v, `\`, `\\`, -1)
+	v = strings.Replace(v, "\n", `\n`, -1)
+	if quote {
+		v = strings.Replace(v, `"`, `\"`, -1)
+	}
+	return v
+}
+
+func promValue(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// `{a="x",b="y"}`, with an extra label (ex. `le`) if given
+func (m *promMetric) labelString(values []string, extra ...string) string {
+	pairs := []string{}
+	for i, label := range m.Labels {
+		pairs = append(pairs, label.Name+`="`+promEscape(values[i], true)+`"`)
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, extra[0]+`="`+extra[1]+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// Write the metric in the text exposition format, series sorted by labels
+func (m *promMetric) write(buf *bytes.Buffer) {
+	if m.Help != "" {
+		fmt.Fprintf(buf, "# HELP %s %s\n", m.Name, promEscape(m.Help, false))
+	}
+	fmt.Fprintf(buf, "# TYPE %s %s\n", m.Name, m.Type)
+
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s := m.series[key]
+		if m.Type != "histogram" {
+			fmt.Fprintf(buf, "%s%s %s\n", m.Name, m.labelString(s.Values), promValue(s.Value))
+			continue
+		}
+
+		cumulative := uint64(0)
+		for i, b := range m.Buckets {
+			cumulative += s.Buckets[i]
+			fmt.Fprintf(buf, "%s_bucket%s %d\n", m.Name, m.labelString(s.Values, "le", promValue(b)), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", m.Name, m.labelString(s.Values, "le", "+Inf"), s.Count)
+		fmt.Fprintf(buf, "%s_sum%s %s\n", m.Name, m.labelString(s.Values), promValue(s.Sum))
+		fmt.Fprintf(buf, "%s_count%s %d\n", m.Name, m.labelString(s.Values), s.Count)
+	}
+}
+
+// The outputs exposed on each path of the API server
+var promOutputs = map[string][]*PrometheusOutput{}
+var promLock = &sync.Mutex{}
+
+// Expose the output's metrics on the API server (the default mux). Outputs
+// can share a path but not metric names, the families of a scrape must be
+// unique
+func promRegister(path string, p *PrometheusOutput) error {
+	promLock.Lock()
+	defer promLock.Unlock()
+
+	for _, other := range promOutputs[path] {
+		for _, m := range other.Metrics {
+			for _, mine := range p.Metrics {
+				if m.Name == mine.Name {
+					return fmt.Errorf("metric '%s' is already exposed on %s", m.Name, path)
+				}
+			}
+		}
+	}
+
+	// Handlers cannot be removed from the mux, so it stays once added
+	if _, ok := promOutputs[path]; !ok {
+		http.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			promLock.Lock()
+			outputs := promOutputs[path]
+			promLock.Unlock()
+
+			var buf bytes.Buffer
+			for _, p := range outputs {
+				p.write(&buf)
+			}
+			w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+			w.Write(buf.Bytes())
+		})
+	}
+	promOutputs[path] = append(promOutputs[path], p)
+	return nil
+}
+
+// Stop exposing the output's metrics (ex it is re-created on reload)
+func promUnregister(path string, p *PrometheusOutput) {
+	promLock.Lock()
+	defer promLock.Unlock()
+
+	outputs := []*PrometheusOutput{}
+	for _, other := range promOutputs[path] {
+		if other != p {
+			outputs = append(outputs, other)
+		}
+	}
+	promOutputs[path] = outputs
+}
+
+type PrometheusOutput struct {
+	*core.ComponentBase
+	Metrics []*promMetric
+	Path    string
+	// Label sets not updated for this long are removed (0 keeps them)
+	Expire time.Duration
+	// Stats
+	Skipped uint64
+	Expired uint64
+	lock    *sync.Mutex
+}
+
+func NewPrometheusOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating PrometheusOutput")
+
+	metrics, _ := cfg["metrics"].([]interface{})
+	if len(metrics) == 0 {
+		panic("PrometheusOutput: 'metrics' is required: a list of {name, type, field, labels, help, buckets}")
+	}
+
+	path := "/metrics"
+	if tmp, ok := cfg["path"].(string); ok {
+		path = tmp
+	}
+	if !strings.HasPrefix(path, "/") || path == "/status" {
+		panic("PrometheusOutput: 'path' must start with '/' and cannot be '/status'")
+	}
+
+	expire := 300.0
+	if tmp, ok := cfg["expire_seconds"].(float64); ok {
+		expire = tmp
+	}
+
+	m := &PrometheusOutput{core.NewComponentBase(inQ, outQ, cfg),
+		nil, path, time.Duration(expire) * time.Second, 0, 0, &sync.Mutex{}}
+
+	m.Tag = "OUT-PROMETHEUS"
+
+	names := map[string]bool{}
+	for _, tmp := range metrics {
+		c, _ := tmp.(map[string]interface{})
+		metric, err := newPromMetric(c)
+		if err != nil {
+			panic("PrometheusOutput: " + err.Error())
+		}
+		if names[metric.Name] {
+			panic(fmt.Sprintf("PrometheusOutput: metric '%s' defined twice", metric.Name))
+		}
+		names[metric.Name] = true
+		m.Metrics = append(m.Metrics, metric)
+	}
+
+	if err := promRegister(path, m); err != nil {
+		panic("PrometheusOutput: " + err.Error())
+	}
+
+	return m
+}
+
+func (p *PrometheusOutput) Signal(string) {}
+
+// Add the number of label sets and the skipped/expired ones to the stats
+func (p *PrometheusOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	series := 0
+	for _, m := range p.Metrics {
+		series += len(m.series)
+	}
+	ret["Series"] = series
+	ret["Skipped"] = p.Skipped
+	ret["Expired"] = p.Expired
+	return ret
+}
+
+// Update all the metrics with an event
+func (p *PrometheusOutput) update(data map[string]interface{}) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	for _, m := range p.Metrics {
+		if !m.update(data, now) {
+			p.Skipped++
+		}
+	}
+}
+
+func (p *PrometheusOutput) expire() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	deadline := time.Now().Add(-p.Expire)
+	for _, m := range p.Metrics {
+		p.Expired += uint64(m.expire(deadline))
+	}
+}
+
+func (p *PrometheusOutput) write(buf *bytes.Buffer) {
+	if p.Expire > 0 {
+		p.expire()
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	for _, m := range p.Metrics {
+		m.write(buf)
+	}
+}
+
+func (p *PrometheusOutput) Run() {
+	p.MustStop = false
+	log.Debug("PrometheusOutput Starting ... ")
+	defer promUnregister(p.Path, p)
+
+	// Expire label sets even if nobody scrapes
+	interval := p.Expire / 2
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	eos := false
+	for !p.MustStop {
+		select {
+		case e, ok := <-p.InQ:
+			if !ok {
+				eos = true
+				p.MustStop = true
+				break
+			}
+			if p.Skip(e) {
+				continue
+			}
+
+			p.update(e.Data)
+
+			// Check if we are being used in proc!
+			if p.OutQ != nil {
+				e.Retain()
+				p.OutQ <- e
+			}
+			e.Ack()
+
+			// Stats
+			p.StatsAddMesg()
+			p.PrintStats()
+
+		case <-p.Stopping():
+		case <-ticker.C:
+			if p.Expire > 0 {
+				p.expire()
+			}
+		}
+	}
+
+	if eos {
+		p.EndOfStream()
+	}
+	log.Debug("PrometheusOutput Stopping")
+}
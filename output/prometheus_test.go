@@ -0,0 +1,147 @@
+package output
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func scrape(t *testing.T, path string) string {
+	rec := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+	body, _ := ioutil.ReadAll(rec.Body)
+	if rec.Code != 200 {
+		t.Fatal("PROMETHEUS: scrape failed ", rec.Code)
+	}
+	return string(body)
+}
+
+func TestPrometheusOutput(t *testing.T) {
+	in := make(chan *core.Event, 10)
+	out := make(chan *core.Event, 10)
+	comp := NewPrometheusOutput(in, out, GetConfig(`{
+		"path": "/metrics-test",
+		"metrics": [
+			{"name": "flow_bytes_total", "type": "counter", "field": "bytes",
+			 "labels": [{"name": "asn", "field": "_src_asn"}, "proto"],
+			 "help": "Bytes per\nsource ASN"},
+			{"name": "flows_total", "type": "counter"},
+			{"name": "queue", "type": "gauge", "field": "queue"},
+			{"name": "rtt_seconds", "type": "histogram", "field": "rtt", "buckets": [0.1, 1]}
+		]
+	}`))
+
+	in <- GetEvent(`{"_src_asn": 65001, "proto": "tcp", "bytes": 100, "queue": 3, "rtt": 0.05}`)
+	in <- GetEvent(`{"_src_asn": 65001, "proto": "tcp", "bytes": 50, "queue": 1, "rtt": 0.5}`)
+	in <- GetEvent(`{"_src_asn": 65002, "proto": "udp\"", "bytes": 10, "rtt": 5}`)
+	in <- GetEvent(`{"bytes": -5}`)
+	done := make(chan bool)
+	go func() {
+		comp.Run()
+		done <- true
+	}()
+
+	// Passed down in proc
+	for i := 0; i < 4; i++ {
+		select {
+		case <-out:
+		case <-time.After(time.Second):
+			t.Fatal("PROMETHEUS: events not passed down ", i)
+		}
+	}
+
+	expected := `# HELP flow_bytes_total Bytes per\nsource ASN
+# TYPE flow_bytes_total counter
+flow_bytes_total{asn="65001",proto="tcp"} 150
+flow_bytes_total{asn="65002",proto="udp\""} 10
+# TYPE flows_total counter
+flows_total 4
+# TYPE queue gauge
+queue 1
+# TYPE rtt_seconds histogram
+rtt_seconds_bucket{le="0.1"} 1
+rtt_seconds_bucket{le="1"} 2
+rtt_seconds_bucket{le="+Inf"} 3
+rtt_seconds_sum 5.55
+rtt_seconds_count 3
+`
+	if got := scrape(t, "/metrics-test"); got != expected {
+		t.Error("PROMETHEUS: wrong metrics ", got)
+	}
+
+	// Missing values and the negative counter
+	stats := comp.GetStatsJSON()
+	if stats["Skipped"] != uint64(4) || stats["Series"] != 5 {
+		t.Error("PROMETHEUS: wrong stats ", stats)
+	}
+
+	// No longer exposed once stopped
+	close(in)
+	<-done
+	if got := scrape(t, "/metrics-test"); got != "" {
+		t.Error("PROMETHEUS: metrics exposed after stopping ", got)
+	}
+}
+
+func TestPrometheusOutputSharedPath(t *testing.T) {
+	cfg := `{"path": "/metrics-shared", "metrics": [{"name": "flows_total", "type": "counter"}]}`
+	in := make(chan *core.Event)
+	comp := NewPrometheusOutput(in, nil, GetConfig(cfg))
+
+	// The same family twice in a scrape is rejected
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("PROMETHEUS: duplicate metric on a path accepted")
+			}
+		}()
+		NewPrometheusOutput(nil, nil, GetConfig(cfg))
+	}()
+
+	// Can be re-created once the first one is done
+	close(in)
+	comp.Run()
+	in = make(chan *core.Event)
+	comp = NewPrometheusOutput(in, nil, GetConfig(cfg))
+	close(in)
+	comp.Run()
+}
+
+func TestPrometheusOutputExpire(t *testing.T) {
+	in := make(chan *core.Event, 10)
+	comp := NewPrometheusOutput(in, nil, GetConfig(`{
+		"path": "/metrics-expire",
+		"metrics": [{"name": "flows_total", "type": "counter", "labels": ["src"]}]
+	}`))
+	comp.(*PrometheusOutput).Expire = 100 * time.Millisecond
+
+	e, ack := GetAckedEvent(`{"src": "a"}`)
+	in <- e
+	done := make(chan bool)
+	go func() {
+		comp.Run()
+		done <- true
+	}()
+	if ok := <-ack; !ok {
+		t.Error("PROMETHEUS: event nacked")
+	}
+
+	if got := scrape(t, "/metrics-expire"); got != "# TYPE flows_total counter\nflows_total{src=\"a\"} 1\n" {
+		t.Error("PROMETHEUS: wrong metrics ", got)
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if got := scrape(t, "/metrics-expire"); got != "# TYPE flows_total counter\n" {
+		t.Error("PROMETHEUS: label set not expired ", got)
+	}
+	if stats := comp.GetStatsJSON(); stats["Expired"] != uint64(1) {
+		t.Error("PROMETHEUS: wrong stats ", stats)
+	}
+	close(in)
+	<-done
+}
@@ -0,0 +1,611 @@
+/*
+   - S3: Write events to objects in S3 (or any S3-compatible storage). Events
+   are spooled to local files with the file output (JSON lines or CSV, gzip or
+   zstd, rotation and partitions) and every closed file is uploaded, with
+   multipart uploads for large ones and retries. Files stay in the spool folder
+   until the upload is confirmed, so they survive failures and restarts
+*/
+package output
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering S3JSONOutput")
+	core.GetRegistryInstance()["S3JSONOutput"] = NewS3JSONOutput
+
+	log.Info("Registering S3CSVOutput")
+	core.GetRegistryInstance()["S3CSVOutput"] = NewS3CSVOutput
+}
+
+// A minimal S3 client: object and multipart uploads signed with AWS
+// signature version 4
+type s3Client struct {
+	Endpoint     *url.URL
+	Region       string
+	Bucket       string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	// Bucket in the path (ex MinIO) instead of the host name
+	PathStyle bool
+	Client    *http.Client
+}
+
+func newS3Client(cfg core.Config) (*s3Client, error) {
+	c := &s3Client{Region: "us-east-1", PathStyle: true}
+
+	c.Bucket, _ = cfg["bucket"].(string)
+	if c.Bucket == "" {
+		return nil, errors.New("'bucket' is required")
+	}
+	if tmp, ok := cfg["region"].(string); ok {
+		c.Region = tmp
+	}
+
+	endpoint := "https://s3." + c.Region + ".amazonaws.com"
+	if tmp, ok := cfg["endpoint"].(string); ok {
+		endpoint = tmp
+	}
+	var err error
+	if c.Endpoint, err = url.Parse(endpoint); err != nil || c.Endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint '%s'", endpoint)
+	}
+	if tmp, ok := cfg["path_style"].(bool); ok {
+		c.PathStyle = tmp
+	}
+
+	// From the environment unless set
+	c.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	c.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if tmp, ok := cfg["access_key"].(string); ok {
+		c.AccessKey = tmp
+	}
+	if tmp, ok := cfg["secret_key"].(string); ok {
+		c.SecretKey = tmp
+	}
+	if tmp, ok := cfg["session_token"].(string); ok {
+		c.SessionToken = tmp
+	}
+
+	timeout := 60000.0
+	if tmp, ok := cfg["timeout_ms"].(float64); ok {
+		timeout = tmp
+	}
+	c.Client = &http.Client{Timeout: time.Duration(timeout) * time.Millisecond}
+
+	return c, nil
+}
+
+// URI encoding as S3 expects it: everything but unreserved characters (and
+// slashes in paths)
+func s3Escape(v string, path bool) string {
+	var buf bytes.Buffer
+	for _, b := range []byte(v) {
+		if (b >= 'A' && b <= 'Z') || (b >= 'a' && b <= 'z') || (b >= '0' && b <= '9') ||
+			b == '-' || b == '_' || b == '.' || b == '~' || (path && b == '/') {
+			buf.WriteByte(b)
+		} else {
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+// The sorted, encoded query string
+func s3Query(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = s3Escape(k, false) + "=" + s3Escape(query[k], false)
+	}
+	return strings.Join(pairs, "&")
+}
+
+func (c *s3Client) newRequest(method string, key string, query map[string]string, body []byte) (*http.Request, error) {
+	u := *c.Endpoint
+	path := strings.TrimSuffix(u.Path, "/") + "/" + key
+	if c.PathStyle {
+		path = strings.TrimSuffix(u.Path, "/") + "/" + c.Bucket + "/" + key
+	} else {
+		u.Host = c.Bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = s3Escape(path, true)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Sign a request (with all its headers) for the payload
+func (c *s3Client) sign(req *http.Request, payload []byte, now time.Time) {
+	sum := sha256.Sum256(payload)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	req.Header.Set("X-Amz-Date", now.UTC().Format("20060102T150405Z"))
+	if c.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.SessionToken)
+	}
+	if c.AccessKey == "" {
+		// Anonymous
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonical bytes.Buffer
+	canonical.WriteString(req.Method + "\n" + req.URL.EscapedPath() + "\n" + req.URL.RawQuery + "\n")
+	for _, k := range names {
+		canonical.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical.WriteString("\n" + signed + "\n" + hex.EncodeToString(sum[:]))
+
+	date := now.UTC().Format("20060102")
+	scope := date + "/" + c.Region + "/s3/aws4_request"
+	hash := sha256.Sum256(canonical.Bytes())
+	to_sign := "AWS4-HMAC-SHA256\n" + now.UTC().Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.SecretKey), date)
+	key = hmacSHA256(key, c.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.AccessKey, scope, signed, hex.EncodeToString(hmacSHA256(key, to_sign))))
+}
+
+// An error response of S3
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Send one request. Returns the response headers and body and whether a
+// failure is worth retrying
+func (c *s3Client) do(method string, key string, query map[string]string, headers map[string]string, body []byte) (http.Header, []byte, bool, error) {
+	req, err := c.newRequest(method, key, query, body)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	c.sign(req, body, time.Now())
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, nil, true, err
+	}
+	defer resp.Body.Close()
+	msg, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, true, err
+	}
+
+	// Completing a multipart upload can fail with a 200 (worth retrying)
+	failed := bytes.Contains(msg, []byte("<Error>"))
+	if resp.StatusCode < 300 && !failed {
+		return resp.Header, msg, false, nil
+	}
+
+	var s3err s3Error
+	if xml.Unmarshal(msg, &s3err) == nil && s3err.Code != "" {
+		err = fmt.Errorf("status %d: %s: %s", resp.StatusCode, s3err.Code, s3err.Message)
+	} else {
+		err = fmt.Errorf("status %d: %s", resp.StatusCode, bytes.TrimSpace(msg))
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == 429 || resp.StatusCode < 300
+	return nil, nil, retry, err
+}
+
+// S3 rejects smaller parts (except the last one)
+const s3MinPartSize = 5 * 1024 * 1024
+
+type S3Output struct {
+	*FileJSONOutput
+	Client *s3Client
+	// Added to the path of the files under the spool folder
+	Prefix      string
+	ContentType string
+	// Files above the part size are uploaded in parts
+	PartSize int64
+	// Retries with exponential backoff
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxBackoff   time.Duration
+	// Failed uploads are retried on this interval
+	RetryInterval time.Duration
+	// Closed files waiting to be uploaded
+	queue  []string
+	queued map[string]bool
+	wake   chan bool
+	stop   chan bool
+	done   chan bool
+	// Stats
+	Uploaded uint64
+	Failed   uint64
+	Bytes    uint64
+	lock     *sync.Mutex
+}
+
+func NewS3JSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating S3JSONOutput")
+
+	client, err := newS3Client(cfg)
+	if err != nil {
+		panic("S3JSONOutput: " + err.Error())
+	}
+
+	spool, _ := cfg["spool_folder"].(string)
+	if spool == "" {
+		panic("S3JSONOutput: 'spool_folder' is required")
+	}
+	if err = os.MkdirAll(spool, 0755); err != nil {
+		panic("S3JSONOutput: cannot create the spool folder: " + err.Error())
+	}
+
+	// Spooled files are deleted once uploaded: no pruning, no rotated hook
+	base := core.Config{
+		"file_name_format": "gopipe-20060102-150405.json",
+		"rotate_seconds":   300.0,
+	}
+	for k, v := range cfg {
+		switch k {
+		case "folder", "keep_files", "keep_seconds", "on_rotate":
+		default:
+			base[k] = v
+		}
+	}
+	base["folder"] = spool
+
+	prefix, _ := cfg["prefix"].(string)
+
+	part_size := 16.0 * 1024 * 1024
+	if tmp, ok := cfg["part_size"].(float64); ok {
+		part_size = tmp
+	}
+	if part_size < s3MinPartSize {
+		panic("S3JSONOutput: 'part_size' must be at least 5MB")
+	}
+	max_retries := 3
+	if tmp, ok := cfg["max_retries"].(float64); ok {
+		max_retries = int(tmp)
+	}
+	retry_backoff := 500.0
+	if tmp, ok := cfg["retry_backoff_ms"].(float64); ok {
+		retry_backoff = tmp
+	}
+	max_backoff := 30000.0
+	if tmp, ok := cfg["max_backoff_ms"].(float64); ok {
+		max_backoff = tmp
+	}
+	retry_interval := 60.0
+	if tmp, ok := cfg["retry_interval_seconds"].(float64); ok && tmp > 0 {
+		retry_interval = tmp
+	}
+
+	m := &S3Output{NewFileJSONOutput(inQ, outQ, base).(*FileJSONOutput),
+		client, prefix, "application/x-ndjson", int64(part_size),
+		max_retries, time.Duration(retry_backoff) * time.Millisecond,
+		time.Duration(max_backoff) * time.Millisecond,
+		time.Duration(retry_interval) * time.Second,
+		[]string{}, map[string]bool{}, make(chan bool, 1), make(chan bool), make(chan bool),
+		0, 0, 0, &sync.Mutex{}}
+
+	m.Tag = "OUT-S3-JSON"
+	m.Closed = m.enqueue
+
+	return m
+}
+
+// Add the upload stats
+func (p *S3Output) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Uploaded"] = p.Uploaded
+	ret["UploadFailed"] = p.Failed
+	ret["UploadedBytes"] = p.Bytes
+	ret["Queued"] = len(p.queued)
+	return ret
+}
+
+// Queue a closed file for upload
+func (p *S3Output) enqueue(fname string) {
+	p.lock.Lock()
+	if !p.queued[fname] {
+		p.queued[fname] = true
+		p.queue = append(p.queue, fname)
+	}
+	p.lock.Unlock()
+
+	select {
+	case p.wake <- true:
+	default:
+	}
+}
+
+// Queue the files left in the spool folder (ex by a previous run)
+func (p *S3Output) scan() {
+	filepath.Walk(p.Folder, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && p.isOurs(info.Name()) {
+			p.enqueue(path)
+		}
+		return nil
+	})
+}
+
+// The object key of a spooled file
+func (p *S3Output) key(fname string) string {
+	rel, err := filepath.Rel(p.Folder, fname)
+	if err != nil {
+		rel = filepath.Base(fname)
+	}
+	return p.Prefix + filepath.ToSlash(rel)
+}
+
+// Send a request, retrying on network errors and retryable statuses
+func (p *S3Output) request(method string, key string, query map[string]string, headers map[string]string, body []byte) (http.Header, []byte, error) {
+	backoff := p.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, msg, retry, err := p.Client.do(method, key, query, headers, body)
+		if err == nil || !retry || attempt >= p.MaxRetries {
+			return resp, msg, err
+		}
+
+		log.Warnf("S3-OUT: Retrying in %v: %s", backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// The content type of the objects
+func (p *S3Output) contentType() string {
+	switch p.Compression {
+	case "gzip":
+		return "application/gzip"
+	case "zstd":
+		return "application/zstd"
+	}
+	return p.ContentType
+}
+
+type s3InitiateResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3Part `xml:"Part"`
+}
+
+// Upload a file in parts. The upload is aborted on failure
+func (p *S3Output) uploadParts(fd *os.File, key string) error {
+	headers := map[string]string{"Content-Type": p.contentType()}
+	_, msg, err := p.request("POST", key, map[string]string{"uploads": ""}, headers, nil)
+	if err != nil {
+		return err
+	}
+	var initiate s3InitiateResult
+	if err = xml.Unmarshal(msg, &initiate); err != nil || initiate.UploadId == "" {
+		return fmt.Errorf("no upload id in '%s'", msg)
+	}
+	id := initiate.UploadId
+
+	complete := s3CompleteUpload{}
+	buf := make([]byte, p.PartSize)
+	for n := 1; ; n++ {
+		size, err := io.ReadFull(fd, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			p.abort(key, id)
+			return err
+		}
+
+		query := map[string]string{"partNumber": strconv.Itoa(n), "uploadId": id}
+		resp, _, err := p.request("PUT", key, query, nil, buf[:size])
+		if err != nil {
+			p.abort(key, id)
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3Part{n, resp.Get("ETag")})
+	}
+
+	body, _ := xml.Marshal(complete)
+	_, _, err = p.request("POST", key, map[string]string{"uploadId": id}, nil, body)
+	if err != nil {
+		p.abort(key, id)
+	}
+	return err
+}
+
+// Abort a multipart upload so its parts are not kept (and billed)
+func (p *S3Output) abort(key string, id string) {
+	if _, _, err := p.request("DELETE", key, map[string]string{"uploadId": id}, nil, nil); err != nil {
+		log.Error("S3-OUT: Failed to abort the upload of ", key, ": ", err.Error())
+	}
+}
+
+// Upload a spooled file and delete it once confirmed
+func (p *S3Output) upload(fname string) error {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	info, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	key := p.key(fname)
+	log.Info("S3-OUT: Uploading ", fname, " to ", key)
+
+	if info.Size() > p.PartSize {
+		err = p.uploadParts(fd, key)
+	} else {
+		var body []byte
+		if body, err = ioutil.ReadAll(fd); err == nil {
+			headers := map[string]string{"Content-Type": p.contentType()}
+			_, _, err = p.request("PUT", key, nil, headers, body)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	p.lock.Lock()
+	p.Bytes += uint64(info.Size())
+	p.lock.Unlock()
+
+	return os.Remove(fname)
+}
+
+// Upload the queued files. Failed ones stay in the spool folder and are
+// retried on the next scan
+func (p *S3Output) uploadQueued() {
+	p.lock.Lock()
+	queue := p.queue
+	p.queue = []string{}
+	p.lock.Unlock()
+
+	for _, fname := range queue {
+		err := p.upload(fname)
+
+		p.lock.Lock()
+		delete(p.queued, fname)
+		if err != nil {
+			p.Failed++
+		} else {
+			p.Uploaded++
+		}
+		p.lock.Unlock()
+
+		if err != nil {
+			log.Error("S3-OUT: Failed to upload ", fname, ": ", err.Error())
+		}
+	}
+}
+
+// Upload files as they are closed and retry the failed ones periodically,
+// until stopped
+func (p *S3Output) uploader() {
+	ticker := time.NewTicker(p.RetryInterval)
+	defer ticker.Stop()
+
+	for {
+		stopping := false
+		select {
+		case <-p.wake:
+		case <-ticker.C:
+			p.scan()
+		case <-p.stop:
+			stopping = true
+		}
+
+		p.uploadQueued()
+		if stopping {
+			close(p.done)
+			return
+		}
+	}
+}
+
+func (p *S3Output) Run() {
+	// Leftovers first: the .tmp files of a previous run that did not close
+	// them are renamed (and queued by the closed hook), then the rest
+	p.recoverFiles()
+	p.scan()
+	go p.uploader()
+
+	p.FileJSONOutput.Run()
+
+	// Upload the last files before returning
+	p.stop <- true
+	<-p.done
+	log.Info("S3-OUT: Stopped")
+}
+
+// S3 CSV implementation
+type S3CSVOutput struct {
+	*S3Output
+}
+
+func NewS3CSVOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating S3CSVOutput")
+
+	base := core.Config{"file_name_format": "gopipe-20060102-150405.csv"}
+	for k, v := range cfg {
+		base[k] = v
+	}
+	m := S3CSVOutput{NewS3JSONOutput(inQ, outQ, base).(*S3Output)}
+
+	m.Tag = "OUT-S3-CSV"
+	m.ContentType = "text/csv"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Encoder = c
+
+	return &m
+}
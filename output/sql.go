@@ -0,0 +1,332 @@
+/*
+   - SQL: Insert events into a database table through `database/sql` (SQLite
+   and Postgres drivers are included). Event fields are mapped to columns and
+   rows are inserted in batches, one transaction per batch. Each row is
+   inserted in its own savepoint, so a failing row does not fail the batch.
+   Optionally the table is created and rows are upserted on a key.
+*/
+package output
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering SqlOutput")
+	core.GetRegistryInstance()["SqlOutput"] = NewSqlOutput
+}
+
+type SqlOutput struct {
+	*core.ComponentBase
+	Driver string
+	DB     *sql.DB
+	Table  string
+	// Column names (sorted) and the field each one is taken from
+	Columns []string
+	Fields  []string
+	// Upsert on these columns (optional)
+	UpsertKey []string
+	// Flush thresholds
+	BatchSize     int
+	FlushInterval time.Duration
+	// The insert statement
+	query string
+	// Stats
+	Inserted uint64
+	Failed   uint64
+	lock     *sync.Mutex
+}
+
+// Quote an identifier (table/column name)
+func sqlQuote(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+func NewSqlOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating SqlOutput")
+
+	driver, ok := cfg["driver"].(string)
+	if !ok {
+		panic("SqlOutput: 'driver' is required (sqlite3 or postgres)")
+	}
+	dsn, ok := cfg["dsn"].(string)
+	if !ok {
+		panic("SqlOutput: 'dsn' is required")
+	}
+	table, ok := cfg["table"].(string)
+	if !ok || table == "" {
+		panic("SqlOutput: 'table' is required")
+	}
+
+	mapping, ok := cfg["columns"].(map[string]interface{})
+	if !ok || len(mapping) == 0 {
+		panic("SqlOutput: 'columns' is required")
+	}
+	columns := []string{}
+	for col := range mapping {
+		columns = append(columns, col)
+	}
+	sort.Strings(columns)
+	fields := []string{}
+	for _, col := range columns {
+		field, ok := mapping[col].(string)
+		if !ok {
+			panic("SqlOutput: The field of column '" + col + "' must be a string")
+		}
+		fields = append(fields, field)
+	}
+
+	upsert_key := []string{}
+	if tmp, ok := cfg["upsert_key"].([]interface{}); ok {
+		upsert_key = core.InterfaceToStringArray(tmp)
+	}
+	for _, key := range upsert_key {
+		if _, ok := mapping[key]; !ok {
+			panic("SqlOutput: Upsert key '" + key + "' is not a column")
+		}
+	}
+
+	batch_size := 100
+	if tmp, ok := cfg["batch_size"].(float64); ok {
+		batch_size = int(tmp)
+	}
+	flush_interval := 1000.0
+	if tmp, ok := cfg["flush_interval_ms"].(float64); ok {
+		flush_interval = tmp
+	}
+	if flush_interval <= 0 {
+		panic("SqlOutput: 'flush_interval_ms' must be positive")
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		panic("SqlOutput: Failed to open the database: " + err.Error())
+	}
+
+	m := &SqlOutput{core.NewComponentBase(inQ, outQ, cfg), driver, db, table,
+		columns, fields, upsert_key,
+		batch_size, time.Duration(flush_interval) * time.Millisecond,
+		"", 0, 0, &sync.Mutex{}}
+	m.query = m.insertQuery()
+
+	if create, _ := cfg["create_table"].(bool); create {
+		types, _ := cfg["column_types"].(map[string]interface{})
+		if _, err := db.Exec(m.createQuery(types)); err != nil {
+			panic("SqlOutput: Failed to create table: " + err.Error())
+		}
+	}
+
+	m.Tag = "OUT-SQL"
+
+	return m
+}
+
+func (p *SqlOutput) Signal(string) {}
+
+// Add the inserted/failed rows to the component stats
+func (p *SqlOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Inserted"] = p.Inserted
+	ret["Failed"] = p.Failed
+	return ret
+}
+
+// Postgres uses numbered placeholders
+func (p *SqlOutput) placeholder(i int) string {
+	if p.Driver == "postgres" {
+		return fmt.Sprintf("$%d", i+1)
+	}
+	return "?"
+}
+
+func (p *SqlOutput) insertQuery() string {
+	cols := []string{}
+	values := []string{}
+	for i, col := range p.Columns {
+		cols = append(cols, sqlQuote(col))
+		values = append(values, p.placeholder(i))
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", sqlQuote(p.Table),
+		strings.Join(cols, ", "), strings.Join(values, ", "))
+	if len(p.UpsertKey) == 0 {
+		return query
+	}
+
+	keys := []string{}
+	iskey := map[string]bool{}
+	for _, key := range p.UpsertKey {
+		keys = append(keys, sqlQuote(key))
+		iskey[key] = true
+	}
+	updates := []string{}
+	for _, col := range p.Columns {
+		if !iskey[col] {
+			updates = append(updates, sqlQuote(col)+" = excluded."+sqlQuote(col))
+		}
+	}
+	if len(updates) == 0 {
+		return query + fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(keys, ", "))
+	}
+	return query + fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s",
+		strings.Join(keys, ", "), strings.Join(updates, ", "))
+}
+
+// Columns are TEXT unless given in types. The upsert key is the primary key
+func (p *SqlOutput) createQuery(types map[string]interface{}) string {
+	defs := []string{}
+	for _, col := range p.Columns {
+		t := "TEXT"
+		if tmp, ok := types[col].(string); ok {
+			t = tmp
+		}
+		defs = append(defs, sqlQuote(col)+" "+t)
+	}
+	if len(p.UpsertKey) > 0 {
+		keys := []string{}
+		for _, key := range p.UpsertKey {
+			keys = append(keys, sqlQuote(key))
+		}
+		defs = append(defs, fmt.Sprintf("PRIMARY KEY (%s)", strings.Join(keys, ", ")))
+	}
+	return fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", sqlQuote(p.Table),
+		strings.Join(defs, ", "))
+}
+
+// The column values of an event. Lists and objects are stored as JSON
+func (p *SqlOutput) values(data map[string]interface{}) []interface{} {
+	ret := []interface{}{}
+	for _, field := range p.Fields {
+		switch v := data[field].(type) {
+		case json.Number:
+			if i, err := v.Int64(); err == nil {
+				ret = append(ret, i)
+			} else if f, err := v.Float64(); err == nil {
+				ret = append(ret, f)
+			} else {
+				ret = append(ret, v.String())
+			}
+		case map[string]interface{}, []interface{}:
+			b, _ := json.Marshal(v)
+			ret = append(ret, string(b))
+		default:
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+func (p *SqlOutput) Run() {
+	p.MustStop = false
+	defer p.DB.Close()
+
+	batch := []*core.Event{}
+	b := &batcher{
+		Queue: func(e *core.Event) bool {
+			batch = append(batch, e)
+			return true
+		},
+		Full: func() bool {
+			return len(batch) >= p.BatchSize
+		},
+		Flush: func() {
+			p.Flush(batch)
+			batch = batch[:0]
+		},
+		FlushInterval: p.FlushInterval,
+	}
+	b.run(p.ComponentBase)
+
+	log.Info("SQL-OUT: Stopped")
+}
+
+// Insert a batch in one transaction. Every event is done once this returns
+func (p *SqlOutput) Flush(batch []*core.Event) {
+	errs, err := p.insert(batch)
+	if err != nil {
+		log.Errorf("SQL-OUT: Failed to insert %d rows: %s", len(batch), err.Error())
+	}
+
+	inserted, failed := 0, 0
+	for i, e := range batch {
+		rowerr := err
+		if rowerr == nil {
+			rowerr = errs[i]
+		}
+		if rowerr != nil {
+			e.Data["_sql_error"] = rowerr.Error()
+			failed++
+		} else {
+			inserted++
+		}
+
+		// Check if we are being used in proc! The next components hold their
+		// own reference
+		if p.OutQ != nil {
+			e.Retain()
+			p.OutQ <- e
+		}
+		if rowerr != nil {
+			e.Nack()
+		} else {
+			e.Ack()
+		}
+	}
+
+	p.lock.Lock()
+	p.Inserted += uint64(inserted)
+	p.Failed += uint64(failed)
+	p.lock.Unlock()
+}
+
+// Returns the error of every row, or an error failing the whole batch
+func (p *SqlOutput) insert(batch []*core.Event) ([]error, error) {
+	tx, err := p.DB.Begin()
+	if err != nil {
+		return nil, err
+	}
+	stmt, err := tx.Prepare(p.query)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	defer stmt.Close()
+
+	// A failed statement aborts the transaction in Postgres: use a savepoint
+	// per row so the rest of the batch goes through
+	errs := make([]error, len(batch))
+	for i, e := range batch {
+		if _, err := tx.Exec("SAVEPOINT gopipe_row"); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+		if _, errs[i] = stmt.Exec(p.values(e.Data)...); errs[i] != nil {
+			log.Warn("SQL-OUT: Failed to insert row: ", errs[i].Error())
+			if _, err := tx.Exec("ROLLBACK TO SAVEPOINT gopipe_row"); err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT gopipe_row"); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	return errs, tx.Commit()
+}
@@ -0,0 +1,75 @@
+package output
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestSqlQueries(t *testing.T) {
+	p := &SqlOutput{Driver: "postgres", Table: "flows",
+		Columns: []string{"bytes", "dst", "src"}, UpsertKey: []string{"src", "dst"}}
+
+	q := p.insertQuery()
+	if q != `INSERT INTO "flows" ("bytes", "dst", "src") VALUES ($1, $2, $3) ON CONFLICT ("src", "dst") DO UPDATE SET "bytes" = excluded."bytes"` {
+		t.Error("SQL: wrong insert query ", q)
+	}
+	q = p.createQuery(map[string]interface{}{"bytes": "BIGINT"})
+	if q != `CREATE TABLE IF NOT EXISTS "flows" ("bytes" BIGINT, "dst" TEXT, "src" TEXT, PRIMARY KEY ("src", "dst"))` {
+		t.Error("SQL: wrong create query ", q)
+	}
+}
+
+func TestSqlOutput(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("", "gopipe-sql")
+	defer os.RemoveAll(tmpdir)
+	dsn := filepath.Join(tmpdir, "test.db")
+
+	in := make(chan *core.Event, 10)
+	comp := NewSqlOutput(in, nil, GetConfig(`{
+		"driver": "sqlite3", "dsn": "`+dsn+`", "table": "flows",
+		"columns": {"src_ip": "src", "bytes": "bytes", "tags": "tags"},
+		"column_types": {"bytes": "INTEGER NOT NULL"},
+		"create_table": true, "upsert_key": ["src_ip"]
+	}`))
+
+	acks := []chan bool{}
+	for _, data := range []string{
+		`{"src": "10.0.0.1", "bytes": 100, "tags": ["a"]}`,
+		`{"src": "10.0.0.2"}`,
+		`{"src": "10.0.0.1", "bytes": 200}`,
+	} {
+		e, ack := GetAckedEvent(data)
+		in <- e
+		acks = append(acks, ack)
+	}
+	close(in)
+	comp.Run()
+
+	// The row without bytes fails on its own
+	for i, expected := range []bool{true, false, true} {
+		if ok := <-acks[i]; ok != expected {
+			t.Error("SQL: wrong ack of row ", i, ": ", ok)
+		}
+	}
+	if stats := comp.GetStatsJSON(); stats["Inserted"] != uint64(2) || stats["Failed"] != uint64(1) {
+		t.Error("SQL: wrong stats ", stats)
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var count, bytes int64
+	db.QueryRow(`SELECT COUNT(*), MAX(bytes) FROM flows`).Scan(&count, &bytes)
+	if count != 1 || bytes != 200 {
+		t.Error("SQL: not upserted ", count, bytes)
+	}
+}
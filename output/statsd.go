@@ -0,0 +1,465 @@
+/*
+   - STATSD/GRAPHITE: Turn events into metrics instead of sending the events.
+   Each event updates counters, gauges or timings whose names are templates of
+   the event's fields and whose values come from fields. Metrics are aggregated
+   locally and sent every flush interval as StatsD lines (UDP or TCP) or
+   Graphite plaintext lines (TCP or UDP). Events can be sampled.
+*/
+package output
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering StatsdOutput")
+	core.GetRegistryInstance()["StatsdOutput"] = NewStatsdOutput
+
+	log.Info("Registering GraphiteOutput")
+	core.GetRegistryInstance()["GraphiteOutput"] = NewGraphiteOutput
+}
+
+// A metric updated by every event
+type metricConfig struct {
+	// Name template
+	Name string `json:"name"`
+	// counter, gauge or timing
+	Type string `json:"type"`
+	// The value (counters count events without it)
+	Field      string  `json:"field"`
+	SampleRate float64 `json:"sample_rate"`
+}
+
+// A metric aggregated over the flush interval
+type metricAggregate struct {
+	Name string
+	Type string
+	Rate float64
+	// Counters: sum, gauges: last value, timings: sum
+	Value float64
+	// Timings are summarised, so memory does not grow with the events
+	Count    int
+	Min, Max float64
+}
+
+// Metric names cannot contain the separators of the formats. Dots in values
+// (ex IP addresses) would add levels to the hierarchy
+func sanitiseMetricValue(v string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '.' || r == ':' || r == '|' || r == '@' || r == '/' || r <= ' ':
+			return '_'
+		}
+		return r
+	}, v)
+}
+
+// A numeric field value
+func metricValue(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case float64:
+		return t, true
+	case float32:
+		return float64(t), true
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case uint32:
+		return float64(t), true
+	case uint64:
+		return float64(t), true
+	case bool:
+		if t {
+			return 1, true
+		}
+		return 0, true
+	case json.Number:
+		f, err := t.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(t, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func formatMetricValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+type StatsdOutput struct {
+	*core.ComponentBase
+	Metrics []metricConfig
+	Prefix  string
+	// Graphite plaintext instead of StatsD lines
+	Graphite bool
+	// udp or tcp and host:port
+	Protocol string
+	Target   string
+	// Maximum datagram size over UDP
+	MaxPacket     int
+	FlushInterval time.Duration
+	Timeout       time.Duration
+	// Aggregates by name and type
+	aggregates map[string]*metricAggregate
+	conn       net.Conn
+	rand       *rand.Rand
+	// Stats
+	Sent    uint64
+	Failed  uint64
+	Skipped uint64
+	lock    *sync.Mutex
+}
+
+func NewStatsdOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StatsdOutput")
+
+	var metrics []metricConfig
+	cfgbytes, _ := json.Marshal(cfg["metrics"])
+	if err := json.Unmarshal(cfgbytes, &metrics); err != nil || len(metrics) == 0 {
+		panic("StatsdOutput: 'metrics' is required: a list of {name, type, field, sample_rate}")
+	}
+
+	sample_rate := 1.0
+	if tmp, ok := cfg["sample_rate"].(float64); ok {
+		sample_rate = tmp
+	}
+	for i, metric := range metrics {
+		if metric.Name == "" {
+			panic("StatsdOutput: every metric needs a 'name'")
+		}
+		switch metric.Type {
+		case "counter":
+		case "gauge", "timing":
+			if metric.Field == "" {
+				panic(fmt.Sprintf("StatsdOutput: %s '%s' needs a 'field'", metric.Type, metric.Name))
+			}
+		default:
+			panic(fmt.Sprintf("StatsdOutput: 'type' of '%s' must be 'counter', 'gauge' or 'timing'", metric.Name))
+		}
+		if metric.SampleRate == 0 {
+			metrics[i].SampleRate = sample_rate
+		}
+		if metrics[i].SampleRate <= 0 || metrics[i].SampleRate > 1 {
+			panic(fmt.Sprintf("StatsdOutput: 'sample_rate' of '%s' must be in (0, 1]", metric.Name))
+		}
+	}
+
+	prefix, _ := cfg["prefix"].(string)
+
+	protocol := "udp"
+	if tmp, ok := cfg["protocol"].(string); ok {
+		protocol = tmp
+	}
+	if protocol != "udp" && protocol != "tcp" {
+		panic("StatsdOutput: 'protocol' must be 'udp' or 'tcp'")
+	}
+
+	target, _ := cfg["target"].(string)
+	if port, ok := cfg["port"].(float64); ok {
+		target = net.JoinHostPort(target, strconv.Itoa(int(port)))
+	}
+	if target == "" {
+		panic("StatsdOutput: 'target' (host:port, or host and 'port') is required")
+	}
+
+	max_packet := 1432
+	if tmp, ok := cfg["max_packet_size"].(float64); ok {
+		max_packet = int(tmp)
+	}
+	flush_interval := 10000.0
+	if tmp, ok := cfg["flush_interval_ms"].(float64); ok {
+		flush_interval = tmp
+	}
+	if flush_interval <= 0 {
+		panic("StatsdOutput: 'flush_interval_ms' must be positive")
+	}
+	timeout := 5000.0
+	if tmp, ok := cfg["timeout_ms"].(float64); ok {
+		timeout = tmp
+	}
+
+	m := &StatsdOutput{core.NewComponentBase(inQ, outQ, cfg),
+		metrics, prefix, false, protocol, target, max_packet,
+		time.Duration(flush_interval) * time.Millisecond,
+		time.Duration(timeout) * time.Millisecond,
+		map[string]*metricAggregate{}, nil,
+		rand.New(rand.NewSource(time.Now().UnixNano())),
+		0, 0, 0, &sync.Mutex{}}
+
+	m.Tag = "OUT-STATSD"
+
+	return m
+}
+
+func (p *StatsdOutput) Signal(string) {}
+
+// Add the sent/failed metrics and the events without values to the stats
+func (p *StatsdOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Sent"] = p.Sent
+	ret["Failed"] = p.Failed
+	ret["Skipped"] = p.Skipped
+	return ret
+}
+
+// Update the metrics with an event
+func (p *StatsdOutput) aggregate(data map[string]interface{}) {
+	for _, metric := range p.Metrics {
+		if metric.SampleRate < 1 && p.rand.Float64() >= metric.SampleRate {
+			continue
+		}
+
+		value := 1.0
+		if metric.Field != "" {
+			var ok bool
+			if value, ok = metricValue(data[metric.Field]); !ok {
+				p.lock.Lock()
+				p.Skipped++
+				p.lock.Unlock()
+				continue
+			}
+		}
+
+		name := p.Prefix + expand(metric.Name, data, time.Time{}, sanitiseMetricValue)
+		key := metric.Type + " " + name
+		agg, ok := p.aggregates[key]
+		if !ok {
+			agg = &metricAggregate{Name: name, Type: metric.Type, Rate: metric.SampleRate,
+				Min: math.Inf(1), Max: math.Inf(-1)}
+			p.aggregates[key] = agg
+		}
+
+		switch metric.Type {
+		case "counter":
+			agg.Value += value
+		case "gauge":
+			agg.Value = value
+		case "timing":
+			agg.Value += value
+			agg.Count++
+			agg.Min = math.Min(agg.Min, value)
+			agg.Max = math.Max(agg.Max, value)
+		}
+	}
+}
+
+// StatsD lines: name:value|type[|@rate]. Timings are summarised as a count
+// (carrying the rate) and min, max and mean gauges
+func (p *StatsdOutput) statsdLines(agg *metricAggregate) []string {
+	rate := ""
+	if agg.Rate < 1 {
+		rate = "|@" + formatMetricValue(agg.Rate)
+	}
+
+	// A signed gauge is a change, so set negative values from 0
+	gauge := func(name string, v float64) []string {
+		line := name + ":" + formatMetricValue(v) + "|g"
+		if v < 0 {
+			return []string{name + ":0|g", line}
+		}
+		return []string{line}
+	}
+
+	switch agg.Type {
+	case "counter":
+		return []string{agg.Name + ":" + formatMetricValue(agg.Value) + "|c" + rate}
+	case "gauge":
+		return gauge(agg.Name, agg.Value)
+	}
+
+	ret := []string{agg.Name + ".count:" + strconv.Itoa(agg.Count) + "|c" + rate}
+	ret = append(ret, gauge(agg.Name+".min", agg.Min)...)
+	ret = append(ret, gauge(agg.Name+".max", agg.Max)...)
+	return append(ret, gauge(agg.Name+".mean", agg.Value/float64(agg.Count))...)
+}
+
+// Graphite lines: name value timestamp. Counters are scaled by the sample
+// rate and timings are summarised as count, min, max and mean
+func (p *StatsdOutput) graphiteLines(agg *metricAggregate, ts int64) []string {
+	line := func(name string, v float64) string {
+		return fmt.Sprintf("%s %s %d", name, formatMetricValue(v), ts)
+	}
+
+	switch agg.Type {
+	case "counter":
+		return []string{line(agg.Name, agg.Value/agg.Rate)}
+	case "gauge":
+		return []string{line(agg.Name, agg.Value)}
+	}
+
+	return []string{
+		line(agg.Name+".count", float64(agg.Count)/agg.Rate),
+		line(agg.Name+".min", agg.Min),
+		line(agg.Name+".max", agg.Max),
+		line(agg.Name+".mean", agg.Value/float64(agg.Count)),
+	}
+}
+
+// All the lines of the aggregated metrics (sorted by name)
+func (p *StatsdOutput) lines() []string {
+	keys := make([]string, 0, len(p.aggregates))
+	for key := range p.aggregates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	ts := time.Now().Unix()
+	ret := []string{}
+	for _, key := range keys {
+		if p.Graphite {
+			ret = append(ret, p.graphiteLines(p.aggregates[key], ts)...)
+		} else {
+			ret = append(ret, p.statsdLines(p.aggregates[key])...)
+		}
+	}
+	return ret
+}
+
+// Send the lines: packed in datagrams over UDP, as a stream over TCP. The
+// connection is dropped on failure and re-established on the next flush
+func (p *StatsdOutput) send(lines []string) error {
+	if p.conn == nil {
+		conn, err := net.DialTimeout(p.Protocol, p.Target, p.Timeout)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+
+	var err error
+	var buf bytes.Buffer
+	for _, line := range lines {
+		if p.Protocol == "udp" && buf.Len() > 0 && buf.Len()+len(line) > p.MaxPacket {
+			if err = p.write(buf.Bytes()); err != nil {
+				break
+			}
+			buf.Reset()
+		}
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	if err == nil && buf.Len() > 0 {
+		err = p.write(buf.Bytes())
+	}
+
+	if err != nil {
+		p.conn.Close()
+		p.conn = nil
+	}
+	return err
+}
+
+func (p *StatsdOutput) write(data []byte) error {
+	// No trailing new line in datagrams
+	if p.Protocol == "udp" {
+		data = data[:len(data)-1]
+	}
+	p.conn.SetWriteDeadline(time.Now().Add(p.Timeout))
+	_, err := p.conn.Write(data)
+	return err
+}
+
+// Send the aggregated metrics and start over. The events that made them are
+// acked once sent
+func (p *StatsdOutput) Flush(pending []*core.Event) {
+	lines := p.lines()
+	p.aggregates = map[string]*metricAggregate{}
+
+	var err error
+	if len(lines) > 0 {
+		err = p.send(lines)
+	}
+
+	p.lock.Lock()
+	if err != nil {
+		log.Errorf("STATSD-OUT: Failed to send %d metrics: %s", len(lines), err.Error())
+		p.Failed += uint64(len(lines))
+	} else {
+		p.Sent += uint64(len(lines))
+	}
+	p.lock.Unlock()
+
+	for _, e := range pending {
+		if err != nil {
+			e.Nack()
+		} else {
+			e.Ack()
+		}
+	}
+}
+
+func (p *StatsdOutput) Run() {
+	p.MustStop = false
+
+	pending := []*core.Event{}
+	b := &batcher{
+		Queue: func(e *core.Event) bool {
+			p.aggregate(e.Data)
+
+			// Check if we are being used in proc! The next components hold
+			// their own reference, ours is released once the metrics are sent
+			if p.OutQ != nil {
+				e.Retain()
+				p.OutQ <- e
+			}
+			pending = append(pending, e)
+			return true
+		},
+		// Aggregated: sent on time only
+		Full: func() bool {
+			return false
+		},
+		Flush: func() {
+			p.Flush(pending)
+			pending = pending[:0]
+		},
+		FlushInterval: p.FlushInterval,
+	}
+	b.run(p.ComponentBase)
+
+	if p.conn != nil {
+		p.conn.Close()
+	}
+	log.Info("STATSD-OUT: Stopped")
+}
+
+// Graphite plaintext, over TCP by default
+type GraphiteOutput struct {
+	*StatsdOutput
+}
+
+func NewGraphiteOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating GraphiteOutput")
+
+	tmp := core.Config{"protocol": "tcp"}
+	for k, v := range cfg {
+		tmp[k] = v
+	}
+
+	m := GraphiteOutput{NewStatsdOutput(inQ, outQ, tmp).(*StatsdOutput)}
+	m.Tag = "OUT-GRAPHITE"
+	m.Graphite = true
+
+	return &m
+}
@@ -0,0 +1,144 @@
+package output
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestStatsdOutput(t *testing.T) {
+	conns, addrs := udpReceivers(t, 1)
+	defer conns[0].Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewStatsdOutput(in, nil, GetConfig(`{
+		"target": "`+addrs[0]+`", "prefix": "gopipe.",
+		"metrics": [
+			{"name": "flows.{src}", "type": "counter"},
+			{"name": "bytes", "type": "counter", "field": "bytes"},
+			{"name": "rtt", "type": "timing", "field": "rtt", "sample_rate": 0.5},
+			{"name": "queue", "type": "gauge", "field": "queue"},
+			{"name": "size", "type": "timing", "field": "bytes"}
+		]
+	}`))
+	// Samples the first rtt only
+	comp.(*StatsdOutput).rand.Seed(6)
+
+	e1, ack1 := GetAckedEvent(`{"src": "10.0.0.1", "bytes": 100, "rtt": 12, "queue": 3}`)
+	in <- e1
+	in <- GetEvent(`{"src": "10.0.0.1", "bytes": "50", "rtt": 20.5, "queue": -2}`)
+	// No value: the counter without a field is still updated
+	in <- GetEvent(`{"src": "10.0.0.2"}`)
+	close(in)
+	comp.Run()
+
+	if ok := <-ack1; !ok {
+		t.Error("STATSD: event nacked")
+	}
+
+	// One datagram, sorted by type and name. Timings are summarised
+	got := udpReceived(conns[0])
+	expected := strings.Join([]string{
+		"gopipe.bytes:150|c",
+		"gopipe.flows.10_0_0_1:2|c",
+		"gopipe.flows.10_0_0_2:1|c",
+		"gopipe.queue:0|g",
+		"gopipe.queue:-2|g",
+		"gopipe.rtt.count:1|c|@0.5",
+		"gopipe.rtt.min:12|g",
+		"gopipe.rtt.max:12|g",
+		"gopipe.rtt.mean:12|g",
+		"gopipe.size.count:2|c",
+		"gopipe.size.min:50|g",
+		"gopipe.size.max:100|g",
+		"gopipe.size.mean:75|g",
+	}, "\n")
+	if len(got) != 1 || got[0] != expected {
+		t.Error("STATSD: wrong datagrams ", got)
+	}
+
+	stats := comp.GetStatsJSON()
+	if stats["Sent"] != uint64(13) || stats["Skipped"] != uint64(3) {
+		t.Error("STATSD: wrong stats ", stats)
+	}
+}
+
+func TestStatsdOutputPackets(t *testing.T) {
+	conns, addrs := udpReceivers(t, 1)
+	defer conns[0].Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewStatsdOutput(in, nil, GetConfig(`{
+		"target": "`+addrs[0]+`", "max_packet_size": 24,
+		"metrics": [{"name": "flows.{src}", "type": "counter"}]
+	}`))
+	for _, src := range []string{"a", "b", "c"} {
+		in <- GetEvent(`{"src": "` + src + `"}`)
+	}
+	close(in)
+	comp.Run()
+
+	got := udpReceived(conns[0])
+	if len(got) != 2 || got[0] != "flows.a:1|c\nflows.b:1|c" || got[1] != "flows.c:1|c" {
+		t.Error("STATSD: wrong packets ", got)
+	}
+}
+
+func TestGraphiteOutput(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	received := tcpReceiver(l, readLine)
+
+	in := make(chan *core.Event, 10)
+	comp := NewGraphiteOutput(in, nil, GetConfig(`{
+		"target": "`+l.Addr().String()+`", "flush_interval_ms": 50,
+		"metrics": [
+			{"name": "flows", "type": "counter", "sample_rate": 0.5},
+			{"name": "rtt", "type": "timing", "field": "rtt"}
+		]
+	}`))
+	// Samples both events
+	comp.(*GraphiteOutput).rand.Seed(2)
+
+	done := make(chan bool)
+	go func() {
+		comp.Run()
+		done <- true
+	}()
+
+	e, ack := GetAckedEvent(`{"rtt": 10}`)
+	in <- e
+	// Acked once sent, on the flush interval
+	if ok := <-ack; !ok {
+		t.Error("GRAPHITE: event nacked")
+	}
+	in <- GetEvent(`{"rtt": 20}`)
+	close(in)
+	<-done
+
+	lines := []string{}
+	for {
+		select {
+		case line := <-received:
+			// Without the timestamp
+			lines = append(lines, line[:strings.LastIndex(line, " ")])
+			continue
+		case <-time.After(200 * time.Millisecond):
+		}
+		break
+	}
+
+	// The sampled counter is scaled by the sample rate, timings are
+	// summarised
+	expected := []string{
+		"flows 2", "rtt.count 1", "rtt.min 10", "rtt.max 10", "rtt.mean 10",
+		"flows 2", "rtt.count 1", "rtt.min 20", "rtt.max 20", "rtt.mean 20",
+	}
+	if strings.Join(lines, ",") != strings.Join(expected, ",") {
+		t.Error("GRAPHITE: wrong lines ", lines)
+	}
+}
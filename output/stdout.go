@@ -0,0 +1,198 @@
+/*
+   - STDOUT: Write events to the standard output, one per line. Output is
+   buffered and flushed whenever the input queue is empty and at the end of the
+   stream
+*/
+package output
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering StdoutJSONOutput")
+	core.GetRegistryInstance()["StdoutJSONOutput"] = NewStdoutJSONOutput
+
+	log.Info("Registering StdoutCSVOutput")
+	core.GetRegistryInstance()["StdoutCSVOutput"] = NewStdoutCSVOutput
+
+	log.Info("Registering StdoutRawOutput")
+	core.GetRegistryInstance()["StdoutRawOutput"] = NewStdoutRawOutput
+
+	log.Info("Registering StdoutStrOutput")
+	core.GetRegistryInstance()["StdoutStrOutput"] = NewStdoutStrOutput
+
+	log.Info("Registering StdoutInfluxOutput")
+	core.GetRegistryInstance()["StdoutInfluxOutput"] = NewStdoutInfluxOutput
+}
+
+// The base structure for writing to stdout
+type StdoutJSONOutput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for encoding...
+	Encoder core.LineCodec
+	// Where we write to (os.Stdout unless testing)
+	Writer io.Writer
+}
+
+func NewStdoutJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdoutJSONOutput")
+	m := StdoutJSONOutput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, os.Stdout}
+
+	m.Tag = "OUT-STDOUT-JSON"
+
+	return &m
+}
+
+func (p *StdoutJSONOutput) Signal(string) {}
+
+func (p *StdoutJSONOutput) Run() {
+	p.MustStop = false
+	writer := bufio.NewWriter(p.Writer)
+
+	// Avoid alloc in loops
+	var data []byte
+	// Written but not flushed yet
+	pending := []*core.Event{}
+
+	for !p.MustStop {
+		e, err := p.ShouldRun()
+		if err != nil {
+			continue
+		}
+
+		data, err = encodeLine(p.Encoder, e)
+		if err != nil {
+			log.Error("STDOUT: Failed to encode data: ", err.Error())
+			e.Nack()
+			continue
+		}
+
+		writer.Write(data)
+		if len(data) == 0 || data[len(data)-1] != '\n' {
+			writer.WriteByte('\n')
+		}
+		pending = append(pending, e)
+
+		// Nothing else to write for now
+		if len(p.InQ) == 0 {
+			p.flush(writer, pending)
+			pending = pending[:0]
+		}
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	// Stopped with events left in the inQ
+	p.flush(writer, pending)
+}
+
+// Flush the writer, then ack (and pass on) or nack the written events
+func (p *StdoutJSONOutput) flush(writer *bufio.Writer, pending []*core.Event) {
+	err := writer.Flush()
+	if err != nil {
+		log.Error("STDOUT: Failed to write data: ", err.Error())
+	}
+
+	for _, e := range pending {
+		// Check if we are being used in proc!
+		if err == nil && p.OutQ != nil {
+			e.Retain()
+			p.OutQ <- e
+		}
+		if err != nil {
+			e.Nack()
+		} else {
+			e.Ack()
+		}
+	}
+}
+
+// Stdout CSV Implementation
+type StdoutCSVOutput struct {
+	*StdoutJSONOutput
+}
+
+func NewStdoutCSVOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdoutCSVOutput")
+
+	// Defaults...
+	m := StdoutCSVOutput{NewStdoutJSONOutput(inQ, outQ, cfg).(*StdoutJSONOutput)}
+
+	m.Tag = "OUT-STDOUT-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Encoder = c
+
+	return &m
+}
+
+// Stdout Raw Implementation
+type StdoutRawOutput struct {
+	*StdoutJSONOutput
+}
+
+func NewStdoutRawOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdoutRawOutput")
+
+	// Defaults...
+	m := StdoutRawOutput{NewStdoutJSONOutput(inQ, outQ, cfg).(*StdoutJSONOutput)}
+
+	m.Tag = "OUT-STDOUT-RAW"
+
+	m.Encoder = &core.RawLineCodec{}
+
+	return &m
+}
+
+// Stdout String implementation
+type StdoutStrOutput struct {
+	*StdoutJSONOutput
+}
+
+func NewStdoutStrOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdoutStrOutput")
+
+	// Defaults...
+	m := StdoutStrOutput{NewStdoutJSONOutput(inQ, outQ, cfg).(*StdoutJSONOutput)}
+
+	m.Tag = "OUT-STDOUT-STR"
+
+	m.Encoder = &core.StringLineCodec{}
+
+	return &m
+}
+
+// Stdout Influx line protocol implementation
+type StdoutInfluxOutput struct {
+	*StdoutJSONOutput
+}
+
+func NewStdoutInfluxOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating StdoutInfluxOutput")
+
+	// Defaults...
+	m := StdoutInfluxOutput{NewStdoutJSONOutput(inQ, outQ, cfg).(*StdoutJSONOutput)}
+
+	m.Tag = "OUT-STDOUT-INFLUX"
+
+	c, err := core.NewInfluxLineCodec(cfg)
+	if err != nil {
+		panic(err.Error())
+	}
+	m.Encoder = c
+
+	return &m
+}
@@ -0,0 +1,53 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// Stops the component once it has encoded an event
+type stoppingCodec struct {
+	core.JSONLineCodec
+	comp core.Component
+}
+
+func (c *stoppingCodec) ToBytes(data map[string]interface{}) ([]byte, error) {
+	c.comp.Stop()
+	return c.JSONLineCodec.ToBytes(data)
+}
+
+func TestStdoutOutputStop(t *testing.T) {
+	in := make(chan *core.Event, 10)
+	out := make(chan *core.Event, 10)
+	comp := NewStdoutJSONOutput(in, out, GetConfig(`{}`)).(*StdoutJSONOutput)
+
+	var buf bytes.Buffer
+	comp.Writer = &buf
+	comp.Encoder = &stoppingCodec{comp: comp}
+
+	e, ack := GetAckedEvent(`{"a": 1}`)
+	in <- e
+	in <- GetEvent(`{"a": 2}`)
+	comp.Run()
+
+	// Stopped with an event left in the inQ: the written one is still done
+	if buf.String() != "{\"a\":1}\n" {
+		t.Error("STDOUT: unexpected output ", buf.String())
+	}
+	if len(out) != 1 {
+		t.Fatal("STDOUT: written event not passed on")
+	}
+	// Acked once the next component is done with it
+	(<-out).Ack()
+	select {
+	case ok := <-ack:
+		if !ok {
+			t.Error("STDOUT: event nacked")
+		}
+	default:
+		t.Error("STDOUT: written event not acked")
+	}
+}
@@ -0,0 +1,245 @@
+/*
+   - SYSLOG: Send events as syslog messages (RFC 5424 or RFC 3164) over UDP,
+   TCP or TLS. Facility, severity, hostname, app-name etc are static or
+   templates of event fields and the message is a template or the JSON of the
+   event. Over TCP/TLS messages use octet counting framing (RFC 6587) and the
+   TCP output handles reconnects and buffering
+*/
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering SyslogOutput")
+	core.GetRegistryInstance()["SyslogOutput"] = NewSyslogOutput
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"ntp": 12, "security": 13, "console": 14, "solaris-cron": 15,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	"emerg": 0, "alert": 1, "crit": 2, "err": 3, "error": 3,
+	"warning": 4, "warn": 4, "notice": 5, "info": 6, "debug": 7,
+}
+
+// Formats events as syslog messages. All header fields are templates
+type syslogCodec struct {
+	RFC3164   bool
+	Facility  string
+	Severity  string
+	Hostname  string
+	AppName   string
+	ProcID    string
+	MsgID     string
+	Message   string
+	TimeField string
+}
+
+func newSyslogCodec(cfg core.Config) (*syslogCodec, error) {
+	hostname, _ := os.Hostname()
+
+	c := &syslogCodec{false, "user", "info", hostname, "gopipe", "", "", "", "timestamp"}
+
+	if tmp, ok := cfg["format"].(string); ok {
+		switch tmp {
+		case "rfc5424":
+		case "rfc3164":
+			c.RFC3164 = true
+		default:
+			return nil, errors.New("'format' must be 'rfc5424' or 'rfc3164'")
+		}
+	}
+
+	for key, field := range map[string]*string{
+		"facility": &c.Facility, "severity": &c.Severity,
+		"hostname": &c.Hostname, "app_name": &c.AppName,
+		"procid": &c.ProcID, "msgid": &c.MsgID,
+		"message": &c.Message, "timestamp_field": &c.TimeField,
+	} {
+		switch tmp := cfg[key].(type) {
+		case string:
+			*field = tmp
+		case float64:
+			*field = strconv.Itoa(int(tmp))
+		}
+	}
+
+	// Catch static typos early
+	if _, err := c.priority(map[string]interface{}{}); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *syslogCodec) FromBytes(data []byte) (map[string]interface{}, error) {
+	return nil, errors.New("syslogCodec: decoding is not supported")
+}
+
+// A facility or severity: number or name
+func syslogCode(value string, names map[string]int, max int) (int, bool) {
+	if n, err := strconv.Atoi(value); err == nil {
+		return n, n >= 0 && n <= max
+	}
+	n, ok := names[strings.ToLower(value)]
+	return n, ok
+}
+
+// The PRI of an event. Empty values fall back to user/info
+func (c *syslogCodec) priority(data map[string]interface{}) (int, error) {
+	facility, severity := 1, 6
+
+	if tmp := expandFields(c.Facility, data); tmp != "" {
+		var ok bool
+		if facility, ok = syslogCode(tmp, syslogFacilities, 23); !ok {
+			return 0, fmt.Errorf("invalid facility '%s'", tmp)
+		}
+	}
+	if tmp := expandFields(c.Severity, data); tmp != "" {
+		var ok bool
+		if severity, ok = syslogCode(tmp, syslogSeverities, 7); !ok {
+			return 0, fmt.Errorf("invalid severity '%s'", tmp)
+		}
+	}
+	return facility*8 + severity, nil
+}
+
+// The message time: the time field (RFC 3339 or time) or now
+func (c *syslogCodec) timestamp(data map[string]interface{}) time.Time {
+	switch t := data[c.TimeField].(type) {
+	case time.Time:
+		return t
+	case string:
+		if ts, err := time.Parse(time.RFC3339Nano, t); err == nil {
+			return ts
+		}
+	}
+	return time.Now()
+}
+
+// Header fields are printable ASCII without spaces, limited in length. Empty
+// values are "-" (nil value) in RFC 5424
+func syslogHeaderValue(value string, max int, nilValue string) string {
+	value = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' {
+			return '_'
+		}
+		return r
+	}, value)
+	if len(value) > max {
+		value = value[:max]
+	}
+	if value == "" {
+		return nilValue
+	}
+	return value
+}
+
+func (c *syslogCodec) ToBytes(data map[string]interface{}) ([]byte, error) {
+	pri, err := c.priority(data)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := expandFields(c.Message, data)
+	if c.Message == "" {
+		tmp, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		msg = string(tmp)
+	}
+
+	ts := c.timestamp(data)
+	hostname := expandFields(c.Hostname, data)
+	app_name := expandFields(c.AppName, data)
+	procid := expandFields(c.ProcID, data)
+
+	// <PRI>Mmm dd hh:mm:ss HOSTNAME TAG[PROCID]: MSG
+	if c.RFC3164 {
+		tag := syslogHeaderValue(app_name, 32, "")
+		if procid != "" {
+			tag += "[" + syslogHeaderValue(procid, 128, "") + "]"
+		}
+		return []byte(fmt.Sprintf("<%d>%s %s %s: %s", pri, ts.Local().Format(time.Stamp),
+			syslogHeaderValue(hostname, 255, "-"), tag, msg)), nil
+	}
+
+	// <PRI>1 TIMESTAMP HOSTNAME APP-NAME PROCID MSGID - MSG
+	return []byte(fmt.Sprintf("<%d>1 %s %s %s %s %s - %s", pri,
+		ts.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderValue(hostname, 255, "-"),
+		syslogHeaderValue(app_name, 48, "-"),
+		syslogHeaderValue(procid, 128, "-"),
+		syslogHeaderValue(expandFields(c.MsgID, data), 32, "-"),
+		msg)), nil
+}
+
+// Syslog over UDP: one message per datagram
+type SyslogUDPOutput struct {
+	*UDPJSONOutput
+}
+
+// Syslog over TCP/TLS
+type SyslogTCPOutput struct {
+	*TCPJSONOutput
+}
+
+func NewSyslogOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating SyslogOutput")
+
+	codec, err := newSyslogCodec(cfg)
+	if err != nil {
+		panic("SyslogOutput: " + err.Error())
+	}
+
+	protocol := "udp"
+	if tmp, ok := cfg["protocol"].(string); ok {
+		protocol = tmp
+	}
+
+	switch protocol {
+	case "udp":
+		m := SyslogUDPOutput{NewUDPJSONOutput(inQ, outQ, cfg).(*UDPJSONOutput)}
+		m.Tag = "OUT-SYSLOG-UDP"
+		m.Encoder = codec
+		return &m
+
+	case "tcp", "tls":
+		// Octet counting by default, TLS with the system CAs unless set
+		tcp_cfg := core.Config{"framing": "octet"}
+		for k, v := range cfg {
+			tcp_cfg[k] = v
+		}
+		if _, ok := tcp_cfg["tls"]; protocol == "tls" && !ok {
+			tcp_cfg["tls"] = map[string]interface{}{}
+		}
+		if protocol == "tcp" {
+			delete(tcp_cfg, "tls")
+		}
+
+		m := SyslogTCPOutput{NewTCPJSONOutput(inQ, outQ, tcp_cfg).(*TCPJSONOutput)}
+		m.Tag = "OUT-SYSLOG-TCP"
+		m.Encoder = codec
+		m.TrimNewLine = false
+		return &m
+	}
+
+	panic("SyslogOutput: 'protocol' must be 'udp', 'tcp' or 'tls'")
+}
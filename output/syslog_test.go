@@ -0,0 +1,104 @@
+package output
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestSyslogCodec(t *testing.T) {
+	c, err := newSyslogCodec(GetConfig(`{
+		"facility": "local0", "severity": "{level}", "hostname": "{host}",
+		"app_name": "gopipe", "procid": "{pid}", "msgid": "flow",
+		"message": "{src} -> {dst}"
+	}`))
+	if err != nil {
+		t.Fatal("SYSLOG: ", err)
+	}
+
+	data := GetConfig(`{
+		"level": "warning", "host": "router 1", "pid": 42,
+		"src": "10.0.0.1", "dst": "10.0.0.2", "timestamp": "2018-03-16T10:00:00.5Z"
+	}`)
+	msg, _ := c.ToBytes(data)
+	if string(msg) != "<132>1 2018-03-16T10:00:00.500000Z router_1 gopipe 42 flow - 10.0.0.1 -> 10.0.0.2" {
+		t.Error("SYSLOG: wrong RFC 5424 message ", string(msg))
+	}
+
+	c.RFC3164 = true
+	msg, _ = c.ToBytes(data)
+	ts, _ := time.Parse(time.RFC3339, "2018-03-16T10:00:00Z")
+	if string(msg) != "<132>"+ts.Local().Format(time.Stamp)+" router_1 gopipe[42]: 10.0.0.1 -> 10.0.0.2" {
+		t.Error("SYSLOG: wrong RFC 3164 message ", string(msg))
+	}
+
+	// Invalid severity
+	if _, err = c.ToBytes(GetConfig(`{"level": "loud"}`)); err == nil {
+		t.Error("SYSLOG: invalid severity accepted")
+	}
+	if _, err = newSyslogCodec(GetConfig(`{"facility": "nope"}`)); err == nil {
+		t.Error("SYSLOG: invalid facility accepted")
+	}
+}
+
+func TestSyslogOutputUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("SYSLOG: cannot listen ", err)
+	}
+	defer conn.Close()
+
+	in := make(chan *core.Event, 10)
+	comp := NewSyslogOutput(in, nil, GetConfig(`{
+		"targets": ["`+conn.LocalAddr().String()+`"],
+		"hostname": "gw", "severity": 3
+	}`))
+	in <- GetEvent(`{"a": 1, "timestamp": "2018-03-16T10:00:00Z"}`)
+	close(in)
+	comp.Run()
+
+	// The JSON of the event by default
+	got := udpReceived(conn)
+	if len(got) != 1 || got[0] != `<11>1 2018-03-16T10:00:00.000000Z gw gopipe - - - {"a":1,"timestamp":"2018-03-16T10:00:00Z"}` {
+		t.Error("SYSLOG: wrong datagrams ", got)
+	}
+}
+
+func readOctetCounted(r *bufio.Reader) (string, error) {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.Atoi(size[:len(size)-1])
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func TestSyslogOutputTCP(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	received := tcpReceiver(l, readOctetCounted)
+
+	in := make(chan *core.Event, 10)
+	comp := NewSyslogOutput(in, nil, GetConfig(`{
+		"protocol": "tcp", "targets": ["`+l.Addr().String()+`"],
+		"hostname": "gw", "message": "{message}"
+	}`))
+	in <- GetEvent(`{"message": "multi\nline", "timestamp": "2018-03-16T10:00:00Z"}`)
+	close(in)
+	comp.Run()
+
+	if msg := <-received; msg != "<14>1 2018-03-16T10:00:00.000000Z gw gopipe - - - multi\nline" {
+		t.Error("SYSLOG: wrong message ", msg)
+	}
+}
@@ -0,0 +1,459 @@
+/*
+   - TCP: Send events over TCP (optionally TLS), framed with a new line, a
+   4-byte length prefix or octet counting (syslog). Connections are
+   re-established with exponential backoff. While all targets are down events
+   are kept in a bounded buffer; when it fills up the backpressure reaches the
+   input. With a list of targets events go to the first one that works
+   (failover) or are spread over them (round robin).
+*/
+package output
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering TCPJSONOutput")
+	core.GetRegistryInstance()["TCPJSONOutput"] = NewTCPJSONOutput
+
+	log.Info("Registering TCPCSVOutput")
+	core.GetRegistryInstance()["TCPCSVOutput"] = NewTCPCSVOutput
+
+	log.Info("Registering TCPRawOutput")
+	core.GetRegistryInstance()["TCPRawOutput"] = NewTCPRawOutput
+
+	log.Info("Registering TCPStrOutput")
+	core.GetRegistryInstance()["TCPStrOutput"] = NewTCPStrOutput
+}
+
+// An encoded event waiting to be sent
+type tcpFrame struct {
+	e    *core.Event
+	data []byte
+}
+
+// The base structure for common TCP Ops
+type TCPJSONOutput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for encoding...
+	Encoder core.LineCodec
+	// Drop the new line the JSON/CSV encoders add (length/octet framing)
+	TrimNewLine bool
+	// host:port of every target and whether to spread events over them
+	Targets    []string
+	RoundRobin bool
+	// End frames with a new line (newline), prefix them with their length as
+	// 4 bytes (length) or as text and a space (octet, RFC 6587)
+	Framing string
+	TLS     *tls.Config
+	// Connection settings
+	ConnectTimeout time.Duration
+	WriteTimeout   time.Duration
+	KeepAlive      time.Duration
+	// Reconnect backoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Events waiting to be sent (bounded)
+	buffer chan *tcpFrame
+	conns  []net.Conn
+	// The target in use (failover) or the next one (round robin)
+	current int
+	// Closed by Stop, the pending events are failed if not connected
+	quit chan bool
+	// Stats
+	Sent     uint64
+	Failed   uint64
+	Connects uint64
+	lock     *sync.Mutex
+}
+
+// Create a TLS config out of the `tls` settings
+func tcpTLSConfig(cfg map[string]interface{}) (*tls.Config, error) {
+	ret := &tls.Config{}
+	ret.ServerName, _ = cfg["server_name"].(string)
+	ret.InsecureSkipVerify, _ = cfg["insecure_skip_verify"].(bool)
+
+	if ca, ok := cfg["ca"].(string); ok {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return nil, err
+		}
+		ret.RootCAs = x509.NewCertPool()
+		if !ret.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificates found in " + ca)
+		}
+	}
+
+	cert, _ := cfg["cert"].(string)
+	key, _ := cfg["key"].(string)
+	if cert != "" || key != "" {
+		pair, err := tls.LoadX509KeyPair(cert, key)
+		if err != nil {
+			return nil, err
+		}
+		ret.Certificates = []tls.Certificate{pair}
+	}
+	return ret, nil
+}
+
+func NewTCPJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating TCPJSONOutput")
+
+	// A list of targets, or a single one like the UDP output
+	targets := []string{}
+	if tmp, ok := cfg["targets"].([]interface{}); ok {
+		targets = core.InterfaceToStringArray(tmp)
+	} else if target, ok := cfg["target"].(string); ok {
+		port, _ := cfg["port"].(float64)
+		targets = append(targets, net.JoinHostPort(target, strconv.Itoa(int(port))))
+	}
+	if len(targets) == 0 {
+		panic("TCPJSONOutput: 'targets' (or 'target' and 'port') is required")
+	}
+
+	round_robin := false
+	if tmp, ok := cfg["mode"].(string); ok {
+		switch tmp {
+		case "failover":
+		case "round_robin":
+			round_robin = true
+		default:
+			panic("TCPJSONOutput: 'mode' must be either 'failover' or 'round_robin'")
+		}
+	}
+
+	framing := "newline"
+	if tmp, ok := cfg["framing"].(string); ok {
+		framing = tmp
+	}
+	if framing != "newline" && framing != "length" && framing != "octet" {
+		panic("TCPJSONOutput: 'framing' must be 'newline', 'length' or 'octet'")
+	}
+
+	var tls_config *tls.Config
+	if tmp, ok := cfg["tls"].(map[string]interface{}); ok {
+		var err error
+		if tls_config, err = tcpTLSConfig(tmp); err != nil {
+			panic("TCPJSONOutput: Invalid 'tls': " + err.Error())
+		}
+	}
+
+	ms := func(name string, def float64) time.Duration {
+		if tmp, ok := cfg[name].(float64); ok {
+			def = tmp
+		}
+		return time.Duration(def) * time.Millisecond
+	}
+
+	buffer_size := 10000
+	if tmp, ok := cfg["buffer_size"].(float64); ok {
+		buffer_size = int(tmp)
+	}
+
+	m := &TCPJSONOutput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, true, targets, round_robin, framing, tls_config,
+		ms("connect_timeout_ms", 5000), ms("write_timeout_ms", 10000), ms("keepalive_ms", 30000),
+		ms("reconnect_backoff_ms", 500), ms("max_backoff_ms", 30000),
+		make(chan *tcpFrame, buffer_size), make([]net.Conn, len(targets)), 0,
+		make(chan bool), 0, 0, 0, &sync.Mutex{}}
+
+	m.Tag = "OUT-TCP-JSON"
+
+	return m
+}
+
+func (p *TCPJSONOutput) Signal(string) {}
+
+// Add the sent/failed/buffered events to the component stats
+func (p *TCPJSONOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["Sent"] = p.Sent
+	ret["Failed"] = p.Failed
+	ret["Connects"] = p.Connects
+	ret["Buffered"] = len(p.buffer)
+	return ret
+}
+
+// Stop reconnecting: buffered events are failed if no target is up
+func (p *TCPJSONOutput) Stop() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.ComponentBase.Stop()
+	select {
+	case <-p.quit:
+	default:
+		close(p.quit)
+	}
+}
+
+// Frame the encoded event
+func (p *TCPJSONOutput) frame(data []byte) []byte {
+	if p.TrimNewLine && len(data) > 0 && data[len(data)-1] == '\n' {
+		data = data[:len(data)-1]
+	}
+
+	switch p.Framing {
+	case "length":
+		ret := make([]byte, 4, 4+len(data))
+		binary.BigEndian.PutUint32(ret, uint32(len(data)))
+		return append(ret, data...)
+	case "octet":
+		ret := append([]byte(strconv.Itoa(len(data))), ' ')
+		return append(ret, data...)
+	}
+	return append(data, '\n')
+}
+
+func (p *TCPJSONOutput) Run() {
+	p.MustStop = false
+
+	// Events are passed down by the writer, so we cannot let Receive() close
+	// the outQ: read the inQ ourselves
+	done := make(chan bool)
+	go p.writer(done)
+
+	eos := false
+	for !p.MustStop {
+		var e *core.Event
+		var ok bool
+		select {
+		case e, ok = <-p.InQ:
+		case <-p.Stopping():
+			continue
+		}
+		if !ok {
+			eos = true
+			break
+		}
+		if p.Skip(e) {
+			continue
+		}
+
+		data, err := p.Encoder.ToBytes(e.Data)
+		if err != nil {
+			log.Error("TCP-OUT: Failed to encode data: ", err.Error())
+			e.Nack()
+			continue
+		}
+
+		// Blocks when the buffer is full
+		p.buffer <- &tcpFrame{e, p.frame(data)}
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	close(p.buffer)
+	<-done
+
+	if eos {
+		p.EndOfStream()
+	}
+	log.Info("TCP-OUT: Stopped")
+}
+
+// Send the buffered events, waiting for a target to come back when all are
+// down
+func (p *TCPJSONOutput) writer(done chan bool) {
+	defer close(done)
+	defer func() {
+		for _, conn := range p.conns {
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}()
+
+	backoff := p.Backoff
+	for f := range p.buffer {
+		for !p.write(f) {
+			log.Warnf("TCP-OUT: All targets are down, retrying in %v", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-p.quit:
+				// Give up on what is left
+				p.done(f, false)
+				for f := range p.buffer {
+					p.done(f, false)
+				}
+				return
+			}
+			if backoff *= 2; backoff > p.MaxBackoff {
+				backoff = p.MaxBackoff
+			}
+		}
+		backoff = p.Backoff
+		p.done(f, true)
+	}
+}
+
+// Try every target once, starting from the current one
+func (p *TCPJSONOutput) write(f *tcpFrame) bool {
+	start := p.current
+	if p.RoundRobin {
+		p.current = (p.current + 1) % len(p.Targets)
+	}
+
+	for i := range p.Targets {
+		idx := (start + i) % len(p.Targets)
+		conn, err := p.connect(idx)
+		if err != nil {
+			log.Error("TCP-OUT: Failed to connect to ", p.Targets[idx], ": ", err.Error())
+			continue
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+		if n, err := conn.Write(f.data); err != nil {
+			log.Error("TCP-OUT: Failed to send to ", p.Targets[idx], ": ", err.Error())
+			// Part of the frame may have been sent: the stream is out of sync,
+			// so the connection is never written to again. The frame is sent
+			// whole on a new one, the receiver may get it twice
+			if n > 0 {
+				log.Warnf("TCP-OUT: Sent %d of %d bytes to %s, resending on a new connection",
+					n, len(f.data), p.Targets[idx])
+			}
+			conn.Close()
+			p.conns[idx] = nil
+			continue
+		}
+
+		if !p.RoundRobin {
+			p.current = idx
+		}
+		return true
+	}
+	return false
+}
+
+// Get the connection to a target, connecting if needed
+func (p *TCPJSONOutput) connect(idx int) (net.Conn, error) {
+	if p.conns[idx] != nil {
+		return p.conns[idx], nil
+	}
+
+	dialer := &net.Dialer{Timeout: p.ConnectTimeout, KeepAlive: p.KeepAlive}
+	var conn net.Conn
+	var err error
+	if p.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.Targets[idx], p.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", p.Targets[idx])
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("TCP-OUT: Connected to ", p.Targets[idx])
+	p.lock.Lock()
+	p.Connects++
+	p.lock.Unlock()
+
+	p.conns[idx] = conn
+	return conn, nil
+}
+
+// An event has been sent or given up on
+func (p *TCPJSONOutput) done(f *tcpFrame, ok bool) {
+	p.lock.Lock()
+	if ok {
+		p.Sent++
+	} else {
+		p.Failed++
+	}
+	p.lock.Unlock()
+
+	if !ok {
+		f.e.Data["_tcp_error"] = fmt.Sprintf("no target reachable out of %v", p.Targets)
+	}
+
+	// Check if we are being used in proc! The next components hold their
+	// own reference
+	if p.OutQ != nil {
+		f.e.Retain()
+		p.OutQ <- f.e
+	}
+	if !ok {
+		f.e.Nack()
+	} else {
+		f.e.Ack()
+	}
+}
+
+// TCP CSV Implementation
+type TCPCSVOutput struct {
+	*TCPJSONOutput
+}
+
+func NewTCPCSVOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating TCPCSVOutput")
+
+	// Defaults...
+	m := TCPCSVOutput{NewTCPJSONOutput(inQ, outQ, cfg).(*TCPJSONOutput)}
+
+	m.Tag = "OUT-TCP-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Encoder = c
+
+	return &m
+}
+
+// TCP Raw Implementation
+type TCPRawOutput struct {
+	*TCPJSONOutput
+}
+
+func NewTCPRawOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating TCPRawOutput")
+
+	// Defaults...
+	m := TCPRawOutput{NewTCPJSONOutput(inQ, outQ, cfg).(*TCPJSONOutput)}
+
+	m.Tag = "OUT-TCP-RAW"
+
+	m.Encoder = &core.RawLineCodec{}
+	m.TrimNewLine = false
+
+	return &m
+}
+
+// TCP String implementation
+type TCPStrOutput struct {
+	*TCPJSONOutput
+}
+
+func NewTCPStrOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating TCPStrOutput")
+
+	// Defaults...
+	m := TCPStrOutput{NewTCPJSONOutput(inQ, outQ, cfg).(*TCPJSONOutput)}
+
+	m.Tag = "OUT-TCP-STR"
+
+	m.Encoder = &core.StringLineCodec{}
+	m.TrimNewLine = false
+
+	return &m
+}
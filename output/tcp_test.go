@@ -0,0 +1,141 @@
+package output
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// Accept one connection and send what is read (framed by read) to the channel
+func tcpReceiver(l net.Listener, read func(*bufio.Reader) (string, error)) chan string {
+	ch := make(chan string, 10)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			msg, err := read(reader)
+			if err != nil {
+				return
+			}
+			ch <- msg
+		}
+	}()
+	return ch
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	return line, err
+}
+
+func readLengthPrefixed(r *bufio.Reader) (string, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+		return "", err
+	}
+	buf := make([]byte, size)
+	_, err := io.ReadFull(r, buf)
+	return string(buf), err
+}
+
+func TestTCPOutputFailover(t *testing.T) {
+	// The first target is down
+	down, _ := net.Listen("tcp", "127.0.0.1:0")
+	down.Close()
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	received := tcpReceiver(l, readLine)
+
+	in := make(chan *core.Event, 10)
+	comp := NewTCPJSONOutput(in, nil, GetConfig(`{
+		"targets": ["`+down.Addr().String()+`", "`+l.Addr().String()+`"]
+	}`))
+
+	e, ack := GetAckedEvent(`{"a": 1}`)
+	in <- e
+	close(in)
+	comp.Run()
+
+	if msg := <-received; msg != "{\"a\":1}\n" {
+		t.Error("TCP: wrong message ", msg)
+	}
+	if ok := <-ack; !ok {
+		t.Error("TCP: event nacked")
+	}
+}
+
+func TestTCPOutputLengthPrefix(t *testing.T) {
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer l.Close()
+	received := tcpReceiver(l, readLengthPrefixed)
+
+	in := make(chan *core.Event, 10)
+	comp := NewTCPStrOutput(in, nil, GetConfig(`{
+		"targets": ["`+l.Addr().String()+`"], "framing": "length"
+	}`))
+
+	in <- GetEvent(`{"message": "multi\nline"}`)
+	in <- GetEvent(`{"message": "two"}`)
+	close(in)
+	comp.Run()
+
+	if msg := <-received; msg != "multi\nline" {
+		t.Error("TCP: wrong message ", msg)
+	}
+	if msg := <-received; msg != "two" {
+		t.Error("TCP: wrong message ", msg)
+	}
+}
+
+func TestTCPOutputBuffering(t *testing.T) {
+	// Reserve a port nobody listens on (yet)
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := l.Addr().String()
+	l.Close()
+
+	in := make(chan *core.Event, 10)
+	out := make(chan *core.Event, 10)
+	comp := NewTCPJSONOutput(in, out, GetConfig(`{
+		"targets": ["`+addr+`"], "reconnect_backoff_ms": 20, "max_backoff_ms": 50
+	}`))
+	go comp.Run()
+
+	in <- GetEvent(`{"a": 1}`)
+	in <- GetEvent(`{"a": 2}`)
+	time.Sleep(100 * time.Millisecond)
+	if len(out) != 0 {
+		t.Error("TCP: passed down while the target is down")
+	}
+
+	// The target comes up: buffered events are sent in order
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip("Port taken: ", err)
+	}
+	defer l.Close()
+	received := tcpReceiver(l, readLine)
+
+	for _, expected := range []string{"{\"a\":1}\n", "{\"a\":2}\n"} {
+		select {
+		case msg := <-received:
+			if msg != expected {
+				t.Error("TCP: wrong message ", msg)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("TCP: buffered event not sent")
+		}
+		<-out
+	}
+
+	close(in)
+}
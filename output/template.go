@@ -0,0 +1,76 @@
+package output
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Placeholders in templates (ex. topics, keys, index names)
+var fieldPlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Replace `{field}` placeholders with the event's values. Missing fields are
+// replaced with an empty string
+func expandFields(tmpl string, data map[string]interface{}) string {
+	return expandTemplate(tmpl, data, time.Time{})
+}
+
+// Same as expandFields, also replacing `{+layout}` placeholders with the (UTC)
+// time formatted with the Go layout, ex. `flows-{+2006.01.02}`
+func expandTemplate(tmpl string, data map[string]interface{}, ts time.Time) string {
+	return expand(tmpl, data, ts, nil)
+}
+
+// Same as expandTemplate for file paths: field values cannot add path
+// separators or `..`, so they cannot escape the folder they are meant for
+func expandPath(tmpl string, data map[string]interface{}, ts time.Time) string {
+	return expand(tmpl, data, ts, sanitisePathValue)
+}
+
+// Same as expandFields for URLs: values are escaped for the path (before the
+// `?` of the template) or the query (after it), so they cannot change the
+// path, add query parameters or point to another host
+func expandURL(tmpl string, data map[string]interface{}) string {
+	path, query := tmpl, ""
+	if idx := strings.Index(tmpl, "?"); idx >= 0 {
+		path, query = tmpl[:idx], tmpl[idx:]
+	}
+	return expand(path, data, time.Time{}, url.PathEscape) +
+		expand(query, data, time.Time{}, url.QueryEscape)
+}
+
+// Replace separators (and NUL) in a path value and values made of dots only
+func sanitisePathValue(v string) string {
+	v = strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == 0 {
+			return '_'
+		}
+		return r
+	}, v)
+	if v != "" && strings.Trim(v, ".") == "" {
+		return "_"
+	}
+	return v
+}
+
+func expand(tmpl string, data map[string]interface{}, ts time.Time, escape func(string) string) string {
+	if !strings.Contains(tmpl, "{") {
+		return tmpl
+	}
+	return fieldPlaceholder.ReplaceAllStringFunc(tmpl, func(m string) string {
+		name := m[1 : len(m)-1]
+		if strings.HasPrefix(name, "+") {
+			return ts.UTC().Format(name[1:])
+		}
+		v, ok := data[name]
+		if !ok || v == nil {
+			return ""
+		}
+		if escape != nil {
+			return escape(fmt.Sprint(v))
+		}
+		return fmt.Sprint(v)
+	})
+}
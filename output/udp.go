@@ -1,13 +1,19 @@
 /*
    - UDP: Send UDP datagrams out ... Particularly useful for flow sampler and
-   replication configurations
+   replication configurations. With a list of targets, datagrams are sent to
+   all of them (replicate), one after the other (round robin) or to the one
+   picked by hashing some fields (hash), so the same source always goes to the
+   same target. Each target can be sampled and has its own stats
 */
 package output
 
 import (
 	"encoding/json"
+	"fmt"
+	"hash/fnv"
 	"net"
 	"strconv"
+	"sync"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/urban-1/gopipe/core"
@@ -27,21 +33,76 @@ func init() {
 	core.GetRegistryInstance()["UDPStrOutput"] = NewUDPStrOutput
 }
 
+// A target and its stats
+type udpTarget struct {
+	Addr string
+	// Send one every Every datagrams routed to this target
+	Every uint64
+	conn  net.Conn
+	seen  uint64
+	// Stats
+	Packets uint64
+	Sampled uint64
+	Errors  uint64
+}
+
 // The base structure for common UDP Ops
 type UDPJSONOutput struct {
 	*core.ComponentBase
 	// Keep a referece to the struct responsible for decoding...
 	Encoder core.LineCodec
-	target  string
-	port    uint32
-	Sock    net.Conn
+	Targets []*udpTarget
+	// replicate, round_robin or hash
+	Mode       string
+	HashFields []string
+	// The next target (round robin)
+	next int
+	lock *sync.Mutex
 }
 
 func NewUDPJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
 	log.Info("Creating UDPJSONOutput")
+
+	// A list of "host:port" or {"address": "host:port", "every": N}, or a
+	// single target and port
+	targets := []*udpTarget{}
+	if tmp, ok := cfg["targets"].([]interface{}); ok {
+		for _, t := range tmp {
+			switch v := t.(type) {
+			case string:
+				targets = append(targets, &udpTarget{Addr: v, Every: 1})
+			case map[string]interface{}:
+				addr, _ := v["address"].(string)
+				every := 1.0
+				if tmp, ok := v["every"].(float64); ok && tmp >= 1 {
+					every = tmp
+				}
+				targets = append(targets, &udpTarget{Addr: addr, Every: uint64(every)})
+			}
+		}
+	} else if target, ok := cfg["target"].(string); ok {
+		port, _ := cfg["port"].(float64)
+		targets = append(targets, &udpTarget{
+			Addr: net.JoinHostPort(target, strconv.Itoa(int(port))), Every: 1})
+	}
+	if len(targets) == 0 {
+		panic("UDPJSONOutput: 'targets' (or 'target' and 'port') is required")
+	}
+
+	mode := "replicate"
+	if tmp, ok := cfg["mode"].(string); ok {
+		mode = tmp
+	}
+	if mode != "replicate" && mode != "round_robin" && mode != "hash" {
+		panic("UDPJSONOutput: 'mode' must be 'replicate', 'round_robin' or 'hash'")
+	}
+	hash_fields := []string{"_from_addr"}
+	if tmp, ok := cfg["hash_fields"].([]interface{}); ok {
+		hash_fields = core.InterfaceToStringArray(tmp)
+	}
+
 	m := UDPJSONOutput{core.NewComponentBase(inQ, outQ, cfg),
-		&core.JSONLineCodec{},
-		cfg["target"].(string), uint32(cfg["port"].(float64)), nil}
+		&core.JSONLineCodec{}, targets, mode, hash_fields, 0, &sync.Mutex{}}
 
 	m.Tag = "OUT-UDP-JSON"
 
@@ -50,21 +111,115 @@ func NewUDPJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Conf
 
 func (p *UDPJSONOutput) Signal(string) {}
 
-func (p *UDPJSONOutput) Run() {
-	pstr := strconv.FormatInt(int64(p.port), 10)
+// Add the stats of every target
+func (p *UDPJSONOutput) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	targets := map[string]interface{}{}
+	for _, t := range p.Targets {
+		targets[t.Addr] = map[string]interface{}{
+			"Packets": t.Packets, "Sampled": t.Sampled, "Errors": t.Errors}
+	}
+	ret["Targets"] = targets
+	return ret
+}
+
+// Pick the target of an event with rendezvous hashing: adding or removing a
+// target only moves the sources of that target
+func (p *UDPJSONOutput) hashTarget(data map[string]interface{}) *udpTarget {
+	key := ""
+	for _, f := range p.HashFields {
+		key += fmt.Sprint(data[f]) + "\x00"
+	}
+
+	var best *udpTarget
+	var max uint64
+	for _, t := range p.Targets {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte(t.Addr))
+		if w := h.Sum64(); best == nil || w > max {
+			best, max = t, w
+		}
+	}
+	return best
+}
+
+// The targets of an event
+func (p *UDPJSONOutput) route(data map[string]interface{}) []*udpTarget {
+	switch p.Mode {
+	case "round_robin":
+		t := p.Targets[p.next]
+		p.next = (p.next + 1) % len(p.Targets)
+		return []*udpTarget{t}
+	case "hash":
+		return []*udpTarget{p.hashTarget(data)}
+	}
+	return p.Targets
+}
+
+// Send a datagram to its targets. Fails if a write failed and none succeeded
+// (targets sampling it out do not count)
+func (p *UDPJSONOutput) send(targets []*udpTarget, data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var err error
+	sent := false
+	for _, t := range targets {
+		t.seen++
+		if t.seen%t.Every != 0 {
+			t.Sampled++
+			continue
+		}
+
+		if t.conn == nil {
+			err = fmt.Errorf("not connected to %s", t.Addr)
+			t.Errors++
+			continue
+		}
+		if _, werr := t.conn.Write(data); werr != nil {
+			log.Error("UDP-OUT: Failed to send data to ", t.Addr, ": ", werr.Error())
+			err = werr
+			t.Errors++
+			continue
+		}
+		t.Packets++
+		sent = true
+	}
 
+	if sent {
+		return nil
+	}
+	return err
+}
+
+func (p *UDPJSONOutput) Run() {
 	//Connect udp
-	conn, err := net.Dial("udp", p.target+":"+pstr)
-	if err != nil {
-		log.Error("UDP-OUT: Failed to connect: ", err.Error())
+	connected := 0
+	for _, t := range p.Targets {
+		conn, err := net.Dial("udp", t.Addr)
+		if err != nil {
+			log.Error("UDP-OUT: Failed to connect to ", t.Addr, ": ", err.Error())
+			continue
+		}
+		defer conn.Close()
+		t.conn = conn
+		connected++
+	}
+	// Giving up: not the end of the stream
+	if connected == 0 {
+		log.Error("UDP-OUT: No target to send to, stopping")
 		return
 	}
-	defer conn.Close()
 
 	// Avoid alloc in loops
 	var data []byte
 
-	for {
+	for !p.MustStop {
 		e, err := p.ShouldRun()
 		if err != nil {
 			continue
@@ -73,16 +228,26 @@ func (p *UDPJSONOutput) Run() {
 		data, err = p.Encoder.ToBytes(e.Data)
 		if err != nil {
 			log.Error("UDP-OUT: Failed to encode data: ", err.Error())
+			e.Nack()
 			continue
 		}
 
-		//simple write
-		conn.Write(data)
+		err = p.send(p.route(e.Data), data)
+		if err != nil {
+			e.Data["_udp_error"] = err.Error()
+		}
 
-		// Check if we are being used in proc!
+		// Check if we are being used in proc! The next components hold their
+		// own reference
 		if p.OutQ != nil {
+			e.Retain()
 			p.OutQ <- e
 		}
+		if err != nil {
+			e.Nack()
+		} else {
+			e.Ack()
+		}
 
 		// Stats
 		p.StatsAddMesg()
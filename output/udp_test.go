@@ -0,0 +1,162 @@
+package output
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// Count the datagrams received by each of n local listeners
+func udpReceivers(t *testing.T, n int) ([]net.PacketConn, []string) {
+	conns := []net.PacketConn{}
+	addrs := []string{}
+	for i := 0; i < n; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal("UDP: cannot listen ", err)
+		}
+		conns = append(conns, conn)
+		addrs = append(addrs, conn.LocalAddr().String())
+	}
+	return conns, addrs
+}
+
+func udpReceived(conn net.PacketConn) []string {
+	ret := []string{}
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return ret
+		}
+		ret = append(ret, string(buf[:n]))
+	}
+}
+
+func runUDPOutput(cfg string, events ...string) core.Component {
+	in := make(chan *core.Event, len(events))
+	comp := NewUDPStrOutput(in, nil, GetConfig(cfg))
+	for _, data := range events {
+		in <- GetEvent(data)
+	}
+	close(in)
+	comp.Run()
+	return comp
+}
+
+func TestUDPOutputReplicate(t *testing.T) {
+	conns, addrs := udpReceivers(t, 2)
+
+	comp := runUDPOutput(`{
+		"targets": ["`+addrs[0]+`", {"address": "`+addrs[1]+`", "every": 2}]
+	}`, `{"message": "a"}`, `{"message": "b"}`, `{"message": "c"}`)
+
+	if got := udpReceived(conns[0]); len(got) != 3 {
+		t.Error("UDP: wrong datagrams on the first target ", got)
+	}
+	// Sampled one every two
+	if got := udpReceived(conns[1]); len(got) != 1 || got[0] != "b" {
+		t.Error("UDP: wrong datagrams on the sampled target ", got)
+	}
+
+	stats := comp.GetStatsJSON()["Targets"].(map[string]interface{})
+	if s := stats[addrs[1]].(map[string]interface{}); s["Packets"] != uint64(1) ||
+		s["Sampled"] != uint64(2) || s["Errors"] != uint64(0) {
+		t.Error("UDP: wrong target stats ", s)
+	}
+}
+
+func TestUDPOutputNoTarget(t *testing.T) {
+	comp := runUDPOutput(`{"targets": ["127.0.0.1:99999"]}`, `{"message": "a"}`)
+
+	// Gave up: not the end of the stream
+	if comp.(*UDPStrOutput).AtEndOfStream() {
+		t.Error("UDP: giving up reported as end of stream")
+	}
+}
+
+func TestUDPOutputSampledFailure(t *testing.T) {
+	conns, addrs := udpReceivers(t, 1)
+
+	in := make(chan *core.Event, 2)
+	out := make(chan *core.Event, 2)
+	comp := NewUDPStrOutput(in, out, GetConfig(`{
+		"targets": [{"address": "`+addrs[0]+`", "every": 2}, "127.0.0.1:99999"]
+	}`))
+	first, ack1 := GetAckedEvent(`{"message": "a"}`)
+	second, ack2 := GetAckedEvent(`{"message": "b"}`)
+	in <- first
+	in <- second
+	close(in)
+	comp.Run()
+
+	// Failed ones are passed down in proc too, with the error
+	if e := <-out; e.Data["_udp_error"] == nil {
+		t.Error("UDP: failed datagram without _udp_error ", e.Data)
+	}
+	if e := <-out; e.Data["_udp_error"] != nil {
+		t.Error("UDP: sent datagram with _udp_error ", e.Data)
+	}
+	first.Ack()
+	second.Ack()
+
+	// Sampled out and failed: not sent anywhere
+	if ok := <-ack1; ok {
+		t.Error("UDP: datagram sent nowhere acked")
+	}
+	if ok := <-ack2; !ok {
+		t.Error("UDP: datagram sent to one target nacked")
+	}
+	if got := udpReceived(conns[0]); len(got) != 1 || got[0] != "b" {
+		t.Error("UDP: wrong datagrams ", got)
+	}
+}
+
+func TestUDPOutputRoundRobin(t *testing.T) {
+	conns, addrs := udpReceivers(t, 2)
+
+	runUDPOutput(`{
+		"targets": ["`+addrs[0]+`", "`+addrs[1]+`"], "mode": "round_robin"
+	}`, `{"message": "a"}`, `{"message": "b"}`, `{"message": "c"}`)
+
+	if got := udpReceived(conns[0]); len(got) != 2 || got[0] != "a" || got[1] != "c" {
+		t.Error("UDP: wrong datagrams on the first target ", got)
+	}
+	if got := udpReceived(conns[1]); len(got) != 1 || got[0] != "b" {
+		t.Error("UDP: wrong datagrams on the second target ", got)
+	}
+}
+
+func TestUDPOutputHash(t *testing.T) {
+	conns, addrs := udpReceivers(t, 3)
+
+	events := []string{}
+	for _, src := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"} {
+		for i := 0; i < 3; i++ {
+			events = append(events, `{"message": "`+src+`", "_from_addr": "`+src+`"}`)
+		}
+	}
+	runUDPOutput(`{
+		"targets": ["`+addrs[0]+`", "`+addrs[1]+`", "`+addrs[2]+`"], "mode": "hash"
+	}`, events...)
+
+	// Every source lands on one target only
+	seen := map[string]int{}
+	total := 0
+	for i, conn := range conns {
+		for _, src := range udpReceived(conn) {
+			if target, ok := seen[src]; ok && target != i {
+				t.Error("UDP: ", src, " sent to more than one target")
+			}
+			seen[src] = i
+			total++
+		}
+	}
+	if total != len(events) || len(seen) != 4 {
+		t.Error("UDP: wrong datagrams ", total, seen)
+	}
+}
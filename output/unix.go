@@ -0,0 +1,221 @@
+/*
+   - UNIX: Send events to a Unix domain socket. In "stream" mode each event is
+   written as a line (a new line is appended if the codec does not add one). In
+   "datagram" mode each event is sent as a separate datagram
+*/
+package output
+
+import (
+	"encoding/json"
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering UnixJSONOutput")
+	core.GetRegistryInstance()["UnixJSONOutput"] = NewUnixJSONOutput
+
+	log.Info("Registering UnixCSVOutput")
+	core.GetRegistryInstance()["UnixCSVOutput"] = NewUnixCSVOutput
+
+	log.Info("Registering UnixRawOutput")
+	core.GetRegistryInstance()["UnixRawOutput"] = NewUnixRawOutput
+
+	log.Info("Registering UnixStrOutput")
+	core.GetRegistryInstance()["UnixStrOutput"] = NewUnixStrOutput
+}
+
+// The base structure for common Unix socket Ops
+type UnixJSONOutput struct {
+	*core.ComponentBase
+	// Keep a referece to the struct responsible for encoding...
+	Encoder  core.LineCodec
+	Path     string
+	Datagram bool
+	Sock     net.Conn
+}
+
+func NewUnixJSONOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixJSONOutput")
+
+	path, ok := cfg["path"].(string)
+	if !ok {
+		panic("UnixJSONOutput: 'path' is required")
+	}
+
+	datagram := false
+	if tmp, ok := cfg["socket_type"].(string); ok {
+		switch tmp {
+		case "stream":
+		case "datagram":
+			datagram = true
+		default:
+			panic("UnixJSONOutput: 'socket_type' must be either 'stream' or 'datagram'")
+		}
+	}
+
+	m := UnixJSONOutput{core.NewComponentBase(inQ, outQ, cfg),
+		&core.JSONLineCodec{}, path, datagram, nil}
+
+	m.Tag = "OUT-UNIX-JSON"
+
+	return &m
+}
+
+func (p *UnixJSONOutput) Signal(string) {}
+
+// Connect to the socket. Any previous connection is closed
+func (p *UnixJSONOutput) connect() error {
+	if p.Sock != nil {
+		p.Sock.Close()
+		p.Sock = nil
+	}
+
+	network := "unix"
+	if p.Datagram {
+		network = "unixgram"
+	}
+
+	conn, err := net.Dial(network, p.Path)
+	if err != nil {
+		return err
+	}
+	p.Sock = conn
+	return nil
+}
+
+// Write the data, reconnecting once if the socket is gone (ex the listener
+// restarted)
+func (p *UnixJSONOutput) write(data []byte) error {
+	if p.Sock == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+
+	if _, err := p.Sock.Write(data); err == nil {
+		return nil
+	}
+
+	if err := p.connect(); err != nil {
+		return err
+	}
+	_, err := p.Sock.Write(data)
+	return err
+}
+
+func (p *UnixJSONOutput) Run() {
+	p.MustStop = false
+	if err := p.connect(); err != nil {
+		log.Warn("UNIX-OUT: Failed to connect (will retry): ", err.Error())
+	}
+
+	defer func() {
+		if p.Sock != nil {
+			p.Sock.Close()
+		}
+	}()
+
+	// Avoid alloc in loops
+	var data []byte
+
+	for !p.MustStop {
+		e, err := p.ShouldRun()
+		if err != nil {
+			continue
+		}
+
+		data, err = p.Encoder.ToBytes(e.Data)
+		if err != nil {
+			log.Error("UNIX-OUT: Failed to encode data: ", err.Error())
+			e.Nack()
+			continue
+		}
+
+		// Stream sockets are line framed
+		if !p.Datagram && (len(data) == 0 || data[len(data)-1] != '\n') {
+			data = append(data, '\n')
+		}
+
+		if err = p.write(data); err != nil {
+			log.Error("UNIX-OUT: Failed to write data: ", err.Error())
+			e.Data["_unix_error"] = err.Error()
+		}
+
+		// Check if we are being used in proc! The next components hold their
+		// own reference
+		if p.OutQ != nil {
+			e.Retain()
+			p.OutQ <- e
+		}
+		if err != nil {
+			e.Nack()
+		} else {
+			e.Ack()
+		}
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+}
+
+// Unix CSV Implementation
+type UnixCSVOutput struct {
+	*UnixJSONOutput
+}
+
+func NewUnixCSVOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixCSVOutput")
+
+	// Defaults...
+	m := UnixCSVOutput{NewUnixJSONOutput(inQ, outQ, cfg).(*UnixJSONOutput)}
+
+	m.Tag = "OUT-UNIX-CSV"
+
+	// Change to CSV
+	c := &core.CSVLineCodec{Headers: nil, Separator: ","[0], Convert: true}
+	cfgbytes, _ := json.Marshal(cfg)
+	json.Unmarshal(cfgbytes, c)
+	m.Encoder = c
+
+	return &m
+}
+
+// Unix Raw Implementation
+type UnixRawOutput struct {
+	*UnixJSONOutput
+}
+
+func NewUnixRawOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixRawOutput")
+
+	// Defaults...
+	m := UnixRawOutput{NewUnixJSONOutput(inQ, outQ, cfg).(*UnixJSONOutput)}
+
+	m.Tag = "OUT-UNIX-RAW"
+
+	m.Encoder = &core.RawLineCodec{}
+
+	return &m
+}
+
+// Unix String implementation
+type UnixStrOutput struct {
+	*UnixJSONOutput
+}
+
+func NewUnixStrOutput(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating UnixStrOutput")
+
+	// Defaults...
+	m := UnixStrOutput{NewUnixJSONOutput(inQ, outQ, cfg).(*UnixJSONOutput)}
+
+	m.Tag = "OUT-UNIX-STR"
+
+	m.Encoder = &core.StringLineCodec{}
+
+	return &m
+}
@@ -63,7 +63,10 @@ func (p *IfProc) Run() {
 	p.MustStop = false
 	for !p.MustStop {
 		log.Debug("IfProc Reading")
-		e := <-p.InQ
+		e, err := p.Receive()
+		if err != nil {
+			continue
+		}
 
 		// Evaluate the expression against the data of the event!
 		result, err := p.Expr.Evaluate(e.Data)
@@ -117,7 +120,10 @@ func (p *ElseProc) Run() {
 	p.MustStop = false
 	for !p.MustStop {
 		log.Debug("ElseProc Reading")
-		e := <-p.InQ
+		e, err := p.Receive()
+		if err != nil {
+			continue
+		}
 
 		result, err := e.ShouldRun.Pop()
 		if err != nil {
@@ -163,7 +169,10 @@ func (p *EndIfProc) Run() {
 	p.MustStop = false
 	for !p.MustStop {
 		log.Debug("EndIfProc Reading")
-		e := <-p.InQ
+		e, err := p.Receive()
+		if err != nil {
+			continue
+		}
 
 		// In any case pop one out...
 		_, _ = e.ShouldRun.Pop()
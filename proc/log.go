@@ -66,6 +66,8 @@ func (p *LogProc) Run() {
 		if p.OutQ != nil {
 			log.Debug("LogProc Pushing")
 			p.OutQ <- e
+		} else {
+			e.Ack()
 		}
 
 		// Stats
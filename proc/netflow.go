@@ -0,0 +1,623 @@
+/*
+   - NETFLOW: Decode NetFlow v5, v9 and IPFIX datagrams into one event per flow
+   record. The datagram is read from `Data["bytes"]` (ex from UDPRawInput) and
+   the exporter is identified by `Data["_from_addr"]`. Templates (v9/IPFIX) are
+   cached per exporter and observation domain (source id). Data sets for which
+   no template has been seen yet are dropped and reported in the stats.
+
+       {
+           "module": "NetflowProc",
+           "emit_options": false
+       }
+*/
+package proc
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering NetflowProc")
+	core.GetRegistryInstance()["NetflowProc"] = NewNetflowProc
+}
+
+// Kinds of values we know how to decode
+const (
+	nfUint = iota
+	nfIPv4
+	nfIPv6
+	nfMAC
+	nfString
+)
+
+type netflowField struct {
+	Name string
+	Kind int
+}
+
+// Well known information elements (shared by v9 and IPFIX). Anything not in
+// here is stored as `field_<id>`
+var netflowFields = map[uint16]netflowField{
+	1:   {"in_bytes", nfUint},
+	2:   {"in_pkts", nfUint},
+	3:   {"flows", nfUint},
+	4:   {"proto", nfUint},
+	5:   {"tos", nfUint},
+	6:   {"tcp_flags", nfUint},
+	7:   {"src_port", nfUint},
+	8:   {"src", nfIPv4},
+	9:   {"src_mask", nfUint},
+	10:  {"input_if", nfUint},
+	11:  {"dst_port", nfUint},
+	12:  {"dst", nfIPv4},
+	13:  {"dst_mask", nfUint},
+	14:  {"output_if", nfUint},
+	15:  {"next_hop", nfIPv4},
+	16:  {"src_as", nfUint},
+	17:  {"dst_as", nfUint},
+	18:  {"bgp_next_hop", nfIPv4},
+	21:  {"last_switched", nfUint},
+	22:  {"first_switched", nfUint},
+	23:  {"out_bytes", nfUint},
+	24:  {"out_pkts", nfUint},
+	27:  {"src", nfIPv6},
+	28:  {"dst", nfIPv6},
+	29:  {"src_mask", nfUint},
+	30:  {"dst_mask", nfUint},
+	31:  {"flow_label", nfUint},
+	32:  {"icmp_type", nfUint},
+	34:  {"sampling_interval", nfUint},
+	35:  {"sampling_algorithm", nfUint},
+	56:  {"src_mac", nfMAC},
+	57:  {"post_dst_mac", nfMAC},
+	58:  {"vlan", nfUint},
+	59:  {"post_vlan", nfUint},
+	60:  {"ip_version", nfUint},
+	61:  {"direction", nfUint},
+	62:  {"next_hop", nfIPv6},
+	63:  {"bgp_next_hop", nfIPv6},
+	80:  {"dst_mac", nfMAC},
+	81:  {"post_src_mac", nfMAC},
+	82:  {"if_name", nfString},
+	83:  {"if_desc", nfString},
+	85:  {"total_bytes", nfUint},
+	86:  {"total_pkts", nfUint},
+	136: {"flow_end_reason", nfUint},
+	148: {"flow_id", nfUint},
+	150: {"flow_start_sec", nfUint},
+	151: {"flow_end_sec", nfUint},
+	152: {"flow_start_ms", nfUint},
+	153: {"flow_end_ms", nfUint},
+	176: {"icmp_type_v4", nfUint},
+	177: {"icmp_code_v4", nfUint},
+	225: {"post_nat_src", nfIPv4},
+	226: {"post_nat_dst", nfIPv4},
+	227: {"post_napt_src_port", nfUint},
+	228: {"post_napt_dst_port", nfUint},
+	234: {"ingress_vrf", nfUint},
+	235: {"egress_vrf", nfUint},
+}
+
+// A field of a template
+type nfTemplateField struct {
+	ID         uint16
+	Length     uint16
+	Enterprise uint32
+}
+
+type nfTemplate struct {
+	Fields []nfTemplateField
+	// Options templates describe meta-data (ex sampling) not flows
+	Options bool
+}
+
+type NetflowProc struct {
+	*core.ComponentBase
+	EmitOptions bool
+	// Key: exporter/domain/template
+	Templates map[string]*nfTemplate
+	// Key: exporter/domain/template, value: data sets dropped
+	UnknownTemplates map[string]uint64
+	TemplateMisses   uint64
+	Records          uint64
+	Errors           uint64
+	lock             *sync.Mutex
+}
+
+func NewNetflowProc(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating NetflowProc")
+
+	emit_options, _ := cfg["emit_options"].(bool)
+
+	m := &NetflowProc{core.NewComponentBase(inQ, outQ, cfg), emit_options,
+		map[string]*nfTemplate{}, map[string]uint64{}, 0, 0, 0, &sync.Mutex{}}
+	m.Tag = "PROC-NETFLOW"
+	return m
+}
+
+func (p *NetflowProc) Signal(string) {}
+
+// Add the decoder counters to the component stats
+func (p *NetflowProc) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	unknown := map[string]uint64{}
+	for k, v := range p.UnknownTemplates {
+		unknown[k] = v
+	}
+	ret["Records"] = p.Records
+	ret["Errors"] = p.Errors
+	ret["Templates"] = len(p.Templates)
+	ret["TemplateMisses"] = p.TemplateMisses
+	ret["UnknownTemplates"] = unknown
+	return ret
+}
+
+func (p *NetflowProc) Run() {
+	log.Debug("NetflowProc Starting ... ")
+	p.MustStop = false
+	for !p.MustStop {
+		log.Debug("NetflowProc Reading")
+		e, err := p.ShouldRun()
+		if err != nil {
+			continue
+		}
+
+		payload, ok := e.Data["bytes"].([]byte)
+		if !ok {
+			log.Error("NetflowProc: No raw data (bytes) in event. Use a Raw input")
+			e.Ack()
+			continue
+		}
+
+		exporter, _ := e.Data["_from_addr"].(string)
+		records, err := p.Decode(exporter, payload)
+		if err != nil {
+			p.lock.Lock()
+			p.Errors++
+			p.lock.Unlock()
+			log.Warn("NetflowProc: Failed to decode datagram from ", exporter, ": ", err.Error())
+		}
+
+		for _, record := range records {
+			record["_from_addr"] = e.Data["_from_addr"]
+			if port, ok := e.Data["_from_port"]; ok {
+				record["_from_port"] = port
+			}
+			p.OutQ <- e.Derive(record)
+		}
+		// Acked once all its records are
+		e.Ack()
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	log.Info("NetflowProc Stopping!?")
+}
+
+// Decode a datagram into flow records. Records decoded before an error are
+// still returned
+func (p *NetflowProc) Decode(exporter string, payload []byte) ([]map[string]interface{}, error) {
+	if len(payload) < 2 {
+		return nil, errors.New("datagram too short")
+	}
+
+	var records []map[string]interface{}
+	var err error
+	switch version := binary.BigEndian.Uint16(payload); version {
+	case 5:
+		records, err = decodeNetflowV5(payload)
+	case 9:
+		records, err = p.decodeNetflowV9(exporter, payload)
+	case 10:
+		records, err = p.decodeIPFIX(exporter, payload)
+	default:
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	p.lock.Lock()
+	p.Records += uint64(len(records))
+	p.lock.Unlock()
+
+	return records, err
+}
+
+// NetFlow v5: fixed format
+func decodeNetflowV5(b []byte) ([]map[string]interface{}, error) {
+	if len(b) < 24 {
+		return nil, errors.New("v5 header too short")
+	}
+
+	count := int(binary.BigEndian.Uint16(b[2:]))
+	uptime := binary.BigEndian.Uint32(b[4:])
+	secs := binary.BigEndian.Uint32(b[8:])
+	nsecs := binary.BigEndian.Uint32(b[12:])
+	seq := binary.BigEndian.Uint32(b[16:])
+	sampling := binary.BigEndian.Uint16(b[22:]) & 0x3fff
+	exportMs := int64(secs)*1000 + int64(nsecs)/1000000
+
+	records := []map[string]interface{}{}
+	for i := 0; i < count; i++ {
+		r := b[24+i*48:]
+		if len(r) < 48 {
+			return records, errors.New("v5 record truncated")
+		}
+
+		records = append(records, map[string]interface{}{
+			"flow_version":      uint64(5),
+			"sequence":          uint64(seq),
+			"engine_type":       uint64(b[20]),
+			"engine_id":         uint64(b[21]),
+			"sampling_interval": uint64(sampling),
+			"src":               net.IP(r[0:4]).String(),
+			"dst":               net.IP(r[4:8]).String(),
+			"next_hop":          net.IP(r[8:12]).String(),
+			"input_if":          uint64(binary.BigEndian.Uint16(r[12:])),
+			"output_if":         uint64(binary.BigEndian.Uint16(r[14:])),
+			"in_pkts":           uint64(binary.BigEndian.Uint32(r[16:])),
+			"in_bytes":          uint64(binary.BigEndian.Uint32(r[20:])),
+			"first":             uptimeToMs(exportMs, uptime, binary.BigEndian.Uint32(r[24:])),
+			"last":              uptimeToMs(exportMs, uptime, binary.BigEndian.Uint32(r[28:])),
+			"src_port":          uint64(binary.BigEndian.Uint16(r[32:])),
+			"dst_port":          uint64(binary.BigEndian.Uint16(r[34:])),
+			"tcp_flags":         uint64(r[37]),
+			"proto":             uint64(r[38]),
+			"tos":               uint64(r[39]),
+			"src_as":            uint64(binary.BigEndian.Uint16(r[40:])),
+			"dst_as":            uint64(binary.BigEndian.Uint16(r[42:])),
+			"src_mask":          uint64(r[44]),
+			"dst_mask":          uint64(r[45]),
+		})
+	}
+	return records, nil
+}
+
+// Convert a sysUptime relative time to unix milliseconds
+func uptimeToMs(exportMs int64, uptime uint32, t uint32) int64 {
+	return exportMs - int64(uptime) + int64(t)
+}
+
+func nfTemplateKey(exporter string, domain uint32, id uint16) string {
+	return fmt.Sprintf("%s/%d/%d", exporter, domain, id)
+}
+
+// NetFlow v9 (RFC 3954)
+func (p *NetflowProc) decodeNetflowV9(exporter string, b []byte) ([]map[string]interface{}, error) {
+	if len(b) < 20 {
+		return nil, errors.New("v9 header too short")
+	}
+
+	uptime := binary.BigEndian.Uint32(b[4:])
+	secs := binary.BigEndian.Uint32(b[8:])
+	seq := binary.BigEndian.Uint32(b[12:])
+	domain := binary.BigEndian.Uint32(b[16:])
+
+	records := []map[string]interface{}{}
+	for s := b[20:]; len(s) >= 4; {
+		id := binary.BigEndian.Uint16(s)
+		length := int(binary.BigEndian.Uint16(s[2:]))
+		if length < 4 || length > len(s) {
+			return records, errors.New("v9 invalid flowset length")
+		}
+		body := s[4:length]
+		s = s[length:]
+
+		switch {
+		case id == 0:
+			if err := p.parseV9Templates(exporter, domain, body, false); err != nil {
+				return records, err
+			}
+		case id == 1:
+			if err := p.parseV9Templates(exporter, domain, body, true); err != nil {
+				return records, err
+			}
+		case id >= 256:
+			data, err := p.decodeDataSet(exporter, domain, id, body)
+			for _, r := range data {
+				r["flow_version"] = uint64(9)
+				r["sequence"] = uint64(seq)
+				r["observation_domain"] = uint64(domain)
+				convertUptimes(r, int64(secs)*1000, uptime)
+				records = append(records, r)
+			}
+			if err != nil {
+				return records, err
+			}
+		}
+	}
+	return records, nil
+}
+
+// Replace the uptime relative first/last switched with unix milliseconds
+func convertUptimes(r map[string]interface{}, exportMs int64, uptime uint32) {
+	if v, ok := r["first_switched"].(uint64); ok {
+		r["first"] = uptimeToMs(exportMs, uptime, uint32(v))
+	}
+	if v, ok := r["last_switched"].(uint64); ok {
+		r["last"] = uptimeToMs(exportMs, uptime, uint32(v))
+	}
+}
+
+func (p *NetflowProc) parseV9Templates(exporter string, domain uint32, b []byte, options bool) error {
+	for len(b) >= 4 {
+		id := binary.BigEndian.Uint16(b)
+		var n int
+		if options {
+			// Scope and option lengths are in bytes (4 per field)
+			if len(b) < 6 {
+				return nil
+			}
+			n = int(binary.BigEndian.Uint16(b[2:])+binary.BigEndian.Uint16(b[4:])) / 4
+			b = b[6:]
+		} else {
+			n = int(binary.BigEndian.Uint16(b[2:]))
+			b = b[4:]
+		}
+
+		// Padding at the end of the flowset
+		if id < 256 {
+			return nil
+		}
+
+		if len(b) < n*4 {
+			return errors.New("v9 template truncated")
+		}
+		t := &nfTemplate{make([]nfTemplateField, n), options}
+		for i := 0; i < n; i++ {
+			t.Fields[i] = nfTemplateField{binary.BigEndian.Uint16(b[i*4:]), binary.BigEndian.Uint16(b[i*4+2:]), 0}
+		}
+		b = b[n*4:]
+
+		p.setTemplate(nfTemplateKey(exporter, domain, id), t)
+	}
+	return nil
+}
+
+// IPFIX (RFC 7011)
+func (p *NetflowProc) decodeIPFIX(exporter string, b []byte) ([]map[string]interface{}, error) {
+	if len(b) < 16 {
+		return nil, errors.New("IPFIX header too short")
+	}
+
+	total := int(binary.BigEndian.Uint16(b[2:]))
+	if total < 16 || total > len(b) {
+		return nil, errors.New("IPFIX invalid message length")
+	}
+	secs := binary.BigEndian.Uint32(b[4:])
+	seq := binary.BigEndian.Uint32(b[8:])
+	domain := binary.BigEndian.Uint32(b[12:])
+
+	records := []map[string]interface{}{}
+	for s := b[16:total]; len(s) >= 4; {
+		id := binary.BigEndian.Uint16(s)
+		length := int(binary.BigEndian.Uint16(s[2:]))
+		if length < 4 || length > len(s) {
+			return records, errors.New("IPFIX invalid set length")
+		}
+		body := s[4:length]
+		s = s[length:]
+
+		switch {
+		case id == 2:
+			if err := p.parseIPFIXTemplates(exporter, domain, body, false); err != nil {
+				return records, err
+			}
+		case id == 3:
+			if err := p.parseIPFIXTemplates(exporter, domain, body, true); err != nil {
+				return records, err
+			}
+		case id >= 256:
+			data, err := p.decodeDataSet(exporter, domain, id, body)
+			for _, r := range data {
+				r["flow_version"] = uint64(10)
+				r["sequence"] = uint64(seq)
+				r["observation_domain"] = uint64(domain)
+				r["export_time"] = uint64(secs)
+				if v, ok := r["flow_start_ms"].(uint64); ok {
+					r["first"] = int64(v)
+				} else if v, ok := r["flow_start_sec"].(uint64); ok {
+					r["first"] = int64(v) * 1000
+				}
+				if v, ok := r["flow_end_ms"].(uint64); ok {
+					r["last"] = int64(v)
+				} else if v, ok := r["flow_end_sec"].(uint64); ok {
+					r["last"] = int64(v) * 1000
+				}
+				records = append(records, r)
+			}
+			if err != nil {
+				return records, err
+			}
+		}
+	}
+	return records, nil
+}
+
+func (p *NetflowProc) parseIPFIXTemplates(exporter string, domain uint32, b []byte, options bool) error {
+	for len(b) >= 4 {
+		id := binary.BigEndian.Uint16(b)
+		n := int(binary.BigEndian.Uint16(b[2:]))
+		b = b[4:]
+
+		// Padding at the end of the set
+		if id < 256 {
+			return nil
+		}
+
+		key := nfTemplateKey(exporter, domain, id)
+
+		// Template withdrawal
+		if n == 0 {
+			p.lock.Lock()
+			delete(p.Templates, key)
+			p.lock.Unlock()
+			continue
+		}
+
+		if options {
+			// Skip the scope field count, scope fields are just fields
+			if len(b) < 2 {
+				return errors.New("IPFIX options template truncated")
+			}
+			b = b[2:]
+		}
+
+		t := &nfTemplate{make([]nfTemplateField, n), options}
+		for i := 0; i < n; i++ {
+			if len(b) < 4 {
+				return errors.New("IPFIX template truncated")
+			}
+			f := nfTemplateField{binary.BigEndian.Uint16(b), binary.BigEndian.Uint16(b[2:]), 0}
+			b = b[4:]
+			if f.ID&0x8000 != 0 {
+				if len(b) < 4 {
+					return errors.New("IPFIX template truncated")
+				}
+				f.ID &= 0x7fff
+				f.Enterprise = binary.BigEndian.Uint32(b)
+				b = b[4:]
+			}
+			t.Fields[i] = f
+		}
+
+		p.setTemplate(key, t)
+	}
+	return nil
+}
+
+func (p *NetflowProc) setTemplate(key string, t *nfTemplate) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.Templates[key] = t
+	if _, ok := p.UnknownTemplates[key]; ok {
+		log.Info("NetflowProc: Received missing template ", key)
+		delete(p.UnknownTemplates, key)
+	}
+}
+
+// Decode all records of a data set using its template
+func (p *NetflowProc) decodeDataSet(exporter string, domain uint32, id uint16, b []byte) ([]map[string]interface{}, error) {
+	key := nfTemplateKey(exporter, domain, id)
+
+	p.lock.Lock()
+	t, ok := p.Templates[key]
+	if !ok {
+		p.TemplateMisses++
+		if p.UnknownTemplates[key] == 0 {
+			log.Warn("NetflowProc: No template ", key, " (yet), dropping data")
+		}
+		p.UnknownTemplates[key]++
+	}
+	p.lock.Unlock()
+
+	if !ok {
+		return nil, nil
+	}
+
+	// Smallest possible record, anything less is padding
+	minLen := 0
+	for _, f := range t.Fields {
+		if f.Length != 0xffff {
+			minLen += int(f.Length)
+		} else {
+			minLen++
+		}
+	}
+	if minLen == 0 {
+		return nil, errors.New("empty template " + key)
+	}
+
+	records := []map[string]interface{}{}
+	for len(b) >= minLen {
+		r := map[string]interface{}{"template_id": uint64(id)}
+		for _, f := range t.Fields {
+			length := int(f.Length)
+
+			// IPFIX variable length
+			if f.Length == 0xffff {
+				if len(b) < 1 {
+					return records, errors.New("record truncated")
+				}
+				length = int(b[0])
+				b = b[1:]
+				if length == 255 {
+					if len(b) < 2 {
+						return records, errors.New("record truncated")
+					}
+					length = int(binary.BigEndian.Uint16(b))
+					b = b[2:]
+				}
+			}
+
+			if len(b) < length {
+				return records, errors.New("record truncated")
+			}
+			name, value := decodeNetflowField(f, b[:length])
+			r[name] = value
+			b = b[length:]
+		}
+
+		if t.Options && !p.EmitOptions {
+			continue
+		}
+		if t.Options {
+			r["options"] = true
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// Name and decode a single field value
+func decodeNetflowField(f nfTemplateField, b []byte) (string, interface{}) {
+	if f.Enterprise != 0 {
+		return fmt.Sprintf("e%d_%d", f.Enterprise, f.ID), decodeNetflowValue(nfUint, b)
+	}
+
+	def, ok := netflowFields[f.ID]
+	if !ok {
+		return fmt.Sprintf("field_%d", f.ID), decodeNetflowValue(nfUint, b)
+	}
+	return def.Name, decodeNetflowValue(def.Kind, b)
+}
+
+func decodeNetflowValue(kind int, b []byte) interface{} {
+	switch {
+	case kind == nfIPv4 && len(b) == 4, kind == nfIPv6 && len(b) == 16:
+		return net.IP(b).String()
+	case kind == nfMAC && len(b) == 6:
+		return net.HardwareAddr(b).String()
+	case kind == nfString:
+		return string(trimNul(b))
+	case len(b) > 0 && len(b) <= 8:
+		var v uint64
+		for _, c := range b {
+			v = v<<8 | uint64(c)
+		}
+		return v
+	}
+	return hex.EncodeToString(b)
+}
+
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,163 @@
+package proc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/urban-1/gopipe/core"
+	. "github.com/urban-1/gopipe/tests"
+)
+
+// Helper to write big endian values
+func be(vals ...interface{}) []byte {
+	var buf bytes.Buffer
+	for _, v := range vals {
+		binary.Write(&buf, binary.BigEndian, v)
+	}
+	return buf.Bytes()
+}
+
+func netflowV5Packet() []byte {
+	hdr := be(uint16(5), uint16(1), uint32(10000), uint32(1500000000), uint32(0),
+		uint32(42), uint8(0), uint8(1), uint16(100))
+	rec := be([4]byte{10, 0, 0, 1}, [4]byte{192, 168, 1, 1}, [4]byte{0, 0, 0, 0},
+		uint16(1), uint16(2), uint32(10), uint32(1500), uint32(9000), uint32(9500),
+		uint16(12345), uint16(80), uint8(0), uint8(0x18), uint8(6), uint8(0),
+		uint16(64512), uint16(15169), uint8(24), uint8(16), uint16(0))
+	return append(hdr, rec...)
+}
+
+func TestNetflowV5(t *testing.T) {
+	in, out := GetChannels()
+	e := GetRawEvent(netflowV5Packet())
+	e.Data["_from_addr"] = "127.0.0.1"
+	in <- e
+
+	comp := NewNetflowProc(in, out, GetConfig(`{}`))
+	go comp.Run()
+
+	r := (<-out).Data
+	if r["src"] != "10.0.0.1" || r["dst"] != "192.168.1.1" {
+		t.Error("Netflow v5: wrong addresses ", r)
+	}
+	if r["in_bytes"] != uint64(1500) || r["dst_port"] != uint64(80) || r["proto"] != uint64(6) {
+		t.Error("Netflow v5: wrong counters ", r)
+	}
+	if r["sampling_interval"] != uint64(100) || r["src_as"] != uint64(64512) {
+		t.Error("Netflow v5: wrong header/AS ", r)
+	}
+	// export time - uptime + first
+	if r["first"] != int64(1500000000000-10000+9000) {
+		t.Error("Netflow v5: wrong first ", r["first"])
+	}
+	if r["_from_addr"] != "127.0.0.1" {
+		t.Error("Netflow v5: missing exporter ", r)
+	}
+}
+
+func TestNetflowV9(t *testing.T) {
+	p := NewNetflowProc(nil, nil, GetConfig(`{}`)).(*NetflowProc)
+
+	hdr := be(uint16(9), uint16(2), uint32(10000), uint32(1500000000), uint32(1), uint32(7))
+	data := be(uint16(256), uint16(4+12*2),
+		[4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2}, uint32(1000),
+		[4]byte{10, 0, 0, 3}, [4]byte{10, 0, 0, 4}, uint32(2000))
+
+	// Data before template: dropped and counted
+	records, err := p.Decode("1.1.1.1", append(hdr, data...))
+	if err != nil || len(records) != 0 {
+		t.Error("Netflow v9: decoded data without a template ", records, err)
+	}
+	if p.TemplateMisses != 1 || p.UnknownTemplates["1.1.1.1/7/256"] != 1 {
+		t.Error("Netflow v9: template miss not counted ", p.UnknownTemplates)
+	}
+
+	tmpl := be(uint16(0), uint16(4+4+3*4), uint16(256), uint16(3),
+		uint16(8), uint16(4), uint16(12), uint16(4), uint16(1), uint16(4))
+	pkt := append(append(hdr, tmpl...), data...)
+
+	records, err = p.Decode("1.1.1.1", pkt)
+	if err != nil || len(records) != 2 {
+		t.Fatal("Netflow v9: expected 2 records ", records, err)
+	}
+	if records[1]["src"] != "10.0.0.3" || records[1]["in_bytes"] != uint64(2000) {
+		t.Error("Netflow v9: wrong record ", records[1])
+	}
+	if len(p.UnknownTemplates) != 0 {
+		t.Error("Netflow v9: template still reported as unknown")
+	}
+
+	// Same template id from another exporter is not known
+	p.Decode("2.2.2.2", append(hdr, data...))
+	if p.TemplateMisses != 2 {
+		t.Error("Netflow v9: templates are not per exporter")
+	}
+
+	stats := p.GetStatsJSON()
+	if stats["Records"] != uint64(2) || stats["TemplateMisses"] != uint64(2) {
+		t.Error("Netflow v9: wrong stats ", stats)
+	}
+}
+
+func TestNetflowIPFIX(t *testing.T) {
+	p := NewNetflowProc(nil, nil, GetConfig(`{}`)).(*NetflowProc)
+
+	// src (v6), enterprise 9/100 (4 bytes), variable length if_name
+	tmpl := be(uint16(2), uint16(4+4+4+8+4), uint16(300), uint16(3),
+		uint16(27), uint16(16), uint16(0x8000|100), uint16(4), uint32(9), uint16(82), uint16(0xffff))
+	src := [16]byte{0x20, 0x01, 0x0d, 0xb8, 15: 1}
+	data := be(uint16(300), uint16(4+16+4+1+4), src, uint32(77), uint8(4), []byte("eth0"))
+
+	body := append(tmpl, data...)
+	pkt := append(be(uint16(10), uint16(16+len(body)), uint32(1500000000), uint32(1), uint32(3)), body...)
+
+	records, err := p.Decode("1.1.1.1", pkt)
+	if err != nil || len(records) != 1 {
+		t.Fatal("IPFIX: expected 1 record ", records, err)
+	}
+	r := records[0]
+	if r["src"] != "2001:db8::1" || r["e9_100"] != uint64(77) || r["if_name"] != "eth0" {
+		t.Error("IPFIX: wrong record ", r)
+	}
+	if r["flow_version"] != uint64(10) || r["observation_domain"] != uint64(3) {
+		t.Error("IPFIX: wrong header fields ", r)
+	}
+}
+
+func TestNetflowNoBytes(t *testing.T) {
+	in := make(chan *core.Event, 2)
+	out := make(chan *core.Event, 1)
+	in <- GetEvent(`{"a": 1}`)
+	in <- GetRawEvent(netflowV5Packet())
+
+	comp := NewNetflowProc(in, out, GetConfig(`{}`))
+	go comp.Run()
+
+	// The first event is dropped, the second decoded
+	e := <-out
+	if e.Data["src"] != "10.0.0.1" {
+		t.Error("Netflow: unexpected event ", e.Data)
+	}
+}
+
+func TestNetflowAck(t *testing.T) {
+	in, out := GetChannels()
+	e := GetRawEvent(netflowV5Packet())
+	acks := make(chan bool, 1)
+	e.OnAck(func(ok bool) { acks <- ok })
+	in <- e
+
+	comp := NewNetflowProc(in, out, GetConfig(`{}`))
+	go comp.Run()
+
+	// The datagram is acked once its flow records are
+	r := <-out
+	if len(acks) != 0 {
+		t.Error("Netflow: datagram acked before its records")
+	}
+	r.Ack()
+	if ok := <-acks; !ok {
+		t.Error("Netflow: datagram nacked")
+	}
+}
@@ -74,6 +74,7 @@ func (p *RegexProc) Run() {
 
 		if !allok {
 			log.Warn("Skipping non-mathching line: ", e.Data["message"].(string))
+			e.Ack()
 			continue
 		}
 
@@ -41,7 +41,8 @@ func (p *SamplerProc) Run() {
 
 		if (p.Stats.MsgCount % p.Every) != 0 {
 			log.Debug("SamplerProc Dropping")
-			e = nil
+			// Dropped on purpose: nothing more to do with it
+			e.Ack()
 			continue
 		}
 
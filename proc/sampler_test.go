@@ -0,0 +1,31 @@
+package proc
+
+import (
+	"testing"
+
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func TestSamplerAck(t *testing.T) {
+	in, out := GetChannels()
+	comp := NewSamplerProc(in, out, GetConfig(`{"every": 2}`))
+	go comp.Run()
+
+	// One is kept, the other is dropped and acked
+	acked := 0
+	for i := 0; i < 2; i++ {
+		e, acks := GetAckedEvent(`{"a": 1}`)
+		in <- e
+		select {
+		case <-out:
+		case ok := <-acks:
+			if !ok {
+				t.Error("Sampler: dropped event nacked")
+			}
+			acked++
+		}
+	}
+	if acked != 1 {
+		t.Error("Sampler: expected 1 dropped event, got ", acked)
+	}
+}
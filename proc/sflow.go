@@ -0,0 +1,454 @@
+/*
+   - SFLOW: Decode sFlow v5 datagrams. Each flow sample becomes an event with
+   the fields of the sampled packet header (Ethernet/IPv4/IPv6/TCP/UDP) and
+   byte/packet counts scaled by the sampling rate. Each counter sample becomes
+   an event with the interface counters. The datagram is read from
+   `Data["bytes"]` (ex from UDPRawInput).
+
+       {
+           "module": "SFlowProc"
+       }
+*/
+package proc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/urban-1/gopipe/core"
+)
+
+func init() {
+	log.Info("Registering SFlowProc")
+	core.GetRegistryInstance()["SFlowProc"] = NewSFlowProc
+}
+
+type SFlowProc struct {
+	*core.ComponentBase
+	FlowSamples    uint64
+	CounterSamples uint64
+	Errors         uint64
+	lock           *sync.Mutex
+}
+
+func NewSFlowProc(inQ chan *core.Event, outQ chan *core.Event, cfg core.Config) core.Component {
+	log.Info("Creating SFlowProc")
+	m := &SFlowProc{core.NewComponentBase(inQ, outQ, cfg), 0, 0, 0, &sync.Mutex{}}
+	m.Tag = "PROC-SFLOW"
+	return m
+}
+
+func (p *SFlowProc) Signal(string) {}
+
+// Add the decoder counters to the component stats
+func (p *SFlowProc) GetStatsJSON() map[string]interface{} {
+	ret := p.ComponentBase.GetStatsJSON()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	ret["FlowSamples"] = p.FlowSamples
+	ret["CounterSamples"] = p.CounterSamples
+	ret["Errors"] = p.Errors
+	return ret
+}
+
+func (p *SFlowProc) Run() {
+	log.Debug("SFlowProc Starting ... ")
+	p.MustStop = false
+	for !p.MustStop {
+		log.Debug("SFlowProc Reading")
+		e, err := p.ShouldRun()
+		if err != nil {
+			continue
+		}
+
+		payload, ok := e.Data["bytes"].([]byte)
+		if !ok {
+			log.Error("SFlowProc: No raw data (bytes) in event. Use a Raw input")
+			e.Ack()
+			continue
+		}
+
+		samples, err := p.Decode(payload)
+		if err != nil {
+			p.lock.Lock()
+			p.Errors++
+			p.lock.Unlock()
+			log.Warn("SFlowProc: Failed to decode datagram from ", e.Data["_from_addr"], ": ", err.Error())
+		}
+
+		for _, sample := range samples {
+			sample["_from_addr"] = e.Data["_from_addr"]
+			if port, ok := e.Data["_from_port"]; ok {
+				sample["_from_port"] = port
+			}
+			p.OutQ <- e.Derive(sample)
+		}
+		// Acked once all its samples are
+		e.Ack()
+
+		// Stats
+		p.StatsAddMesg()
+		p.PrintStats()
+	}
+
+	log.Info("SFlowProc Stopping!?")
+}
+
+// Big endian XDR reader
+type xdrReader struct {
+	b   []byte
+	err error
+}
+
+var errSFlowTruncated = errors.New("datagram truncated")
+
+func (r *xdrReader) u32() uint32 {
+	if r.err != nil || len(r.b) < 4 {
+		r.err = errSFlowTruncated
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.b)
+	r.b = r.b[4:]
+	return v
+}
+
+func (r *xdrReader) u64() uint64 {
+	return uint64(r.u32())<<32 | uint64(r.u32())
+}
+
+// Read n bytes (and skip the XDR padding)
+func (r *xdrReader) bytes(n int) []byte {
+	padded := (n + 3) &^ 3
+	if r.err != nil || n < 0 || len(r.b) < padded {
+		r.err = errSFlowTruncated
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[padded:]
+	return v
+}
+
+func (r *xdrReader) address() string {
+	switch r.u32() {
+	case 1:
+		return net.IP(r.bytes(4)).String()
+	case 2:
+		return net.IP(r.bytes(16)).String()
+	}
+	return ""
+}
+
+// Decode a datagram into flow and counter sample records. Samples decoded
+// before an error are still returned
+func (p *SFlowProc) Decode(payload []byte) ([]map[string]interface{}, error) {
+	r := &xdrReader{b: payload}
+
+	if version := r.u32(); version != 5 {
+		if r.err != nil {
+			return nil, r.err
+		}
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+
+	agent := r.address()
+	subAgent := r.u32()
+	seq := r.u32()
+	uptime := r.u32()
+	count := int(r.u32())
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	samples := []map[string]interface{}{}
+	for i := 0; i < count; i++ {
+		format := r.u32()
+		data := r.bytes(int(r.u32()))
+		if r.err != nil {
+			return samples, r.err
+		}
+
+		// Only standard (enterprise 0) samples
+		var sample map[string]interface{}
+		var err error
+		switch format {
+		case 1, 3:
+			sample, err = decodeFlowSample(&xdrReader{b: data}, format == 3)
+		case 2, 4:
+			sample, err = decodeCounterSample(&xdrReader{b: data}, format == 4)
+		default:
+			continue
+		}
+		if err != nil {
+			return samples, err
+		}
+
+		sample["agent"] = agent
+		sample["sub_agent_id"] = uint64(subAgent)
+		sample["datagram_sequence"] = uint64(seq)
+		sample["uptime"] = uint64(uptime)
+
+		p.lock.Lock()
+		if sample["sample_type"] == "flow" {
+			p.FlowSamples++
+		} else {
+			p.CounterSamples++
+		}
+		p.lock.Unlock()
+
+		samples = append(samples, sample)
+	}
+	return samples, nil
+}
+
+func decodeFlowSample(r *xdrReader, expanded bool) (map[string]interface{}, error) {
+	s := map[string]interface{}{"sample_type": "flow"}
+
+	s["sequence"] = uint64(r.u32())
+	if expanded {
+		s["source_id_type"] = uint64(r.u32())
+		s["source_id_index"] = uint64(r.u32())
+	} else {
+		id := r.u32()
+		s["source_id_type"] = uint64(id >> 24)
+		s["source_id_index"] = uint64(id & 0xffffff)
+	}
+
+	rate := uint64(r.u32())
+	s["sampling_rate"] = rate
+	s["sample_pool"] = uint64(r.u32())
+	s["drops"] = uint64(r.u32())
+
+	if expanded {
+		r.u32()
+		s["input_if"] = uint64(r.u32())
+		r.u32()
+		s["output_if"] = uint64(r.u32())
+	} else {
+		s["input_if"] = uint64(r.u32() & 0x3fffffff)
+		s["output_if"] = uint64(r.u32() & 0x3fffffff)
+	}
+
+	count := int(r.u32())
+	for i := 0; i < count && r.err == nil; i++ {
+		format := r.u32()
+		data := r.bytes(int(r.u32()))
+		if r.err != nil {
+			break
+		}
+		rec := &xdrReader{b: data}
+
+		switch format {
+		case 1:
+			// Raw packet header
+			proto := rec.u32()
+			frameLength := uint64(rec.u32())
+			rec.u32() // stripped
+			header := rec.bytes(int(rec.u32()))
+			if rec.err != nil {
+				return s, rec.err
+			}
+
+			s["frame_length"] = frameLength
+			// Each sample represents `rate` packets
+			s["in_bytes"] = frameLength * rate
+			s["in_pkts"] = rate
+
+			var err error
+			switch proto {
+			case 1:
+				err = decodeEthernet(header, s)
+			case 11:
+				err = decodeIPv4(header, s)
+			case 12:
+				decodeIPv6(header, s)
+			}
+			if err != nil {
+				return s, err
+			}
+		case 1001:
+			// Extended switch
+			s["src_vlan"] = uint64(rec.u32())
+			rec.u32()
+			s["dst_vlan"] = uint64(rec.u32())
+		case 1002:
+			// Extended router
+			s["next_hop"] = rec.address()
+			s["src_mask"] = uint64(rec.u32())
+			s["dst_mask"] = uint64(rec.u32())
+		}
+	}
+
+	return s, r.err
+}
+
+func decodeCounterSample(r *xdrReader, expanded bool) (map[string]interface{}, error) {
+	s := map[string]interface{}{"sample_type": "counter"}
+
+	s["sequence"] = uint64(r.u32())
+	if expanded {
+		s["source_id_type"] = uint64(r.u32())
+		s["source_id_index"] = uint64(r.u32())
+	} else {
+		id := r.u32()
+		s["source_id_type"] = uint64(id >> 24)
+		s["source_id_index"] = uint64(id & 0xffffff)
+	}
+
+	count := int(r.u32())
+	for i := 0; i < count && r.err == nil; i++ {
+		format := r.u32()
+		data := r.bytes(int(r.u32()))
+		if r.err != nil {
+			break
+		}
+		rec := &xdrReader{b: data}
+
+		switch format {
+		case 1:
+			// Generic interface counters
+			s["if_index"] = uint64(rec.u32())
+			s["if_type"] = uint64(rec.u32())
+			s["if_speed"] = rec.u64()
+			s["if_direction"] = uint64(rec.u32())
+			s["if_status"] = uint64(rec.u32())
+			s["if_in_octets"] = rec.u64()
+			s["if_in_ucast_pkts"] = uint64(rec.u32())
+			s["if_in_multicast_pkts"] = uint64(rec.u32())
+			s["if_in_broadcast_pkts"] = uint64(rec.u32())
+			s["if_in_discards"] = uint64(rec.u32())
+			s["if_in_errors"] = uint64(rec.u32())
+			s["if_in_unknown_protos"] = uint64(rec.u32())
+			s["if_out_octets"] = rec.u64()
+			s["if_out_ucast_pkts"] = uint64(rec.u32())
+			s["if_out_multicast_pkts"] = uint64(rec.u32())
+			s["if_out_broadcast_pkts"] = uint64(rec.u32())
+			s["if_out_discards"] = uint64(rec.u32())
+			s["if_out_errors"] = uint64(rec.u32())
+			s["if_promiscuous_mode"] = uint64(rec.u32())
+		case 2:
+			// Ethernet counters
+			names := []string{"dot3_alignment_errors", "dot3_fcs_errors",
+				"dot3_single_collision_frames", "dot3_multiple_collision_frames",
+				"dot3_sqe_test_errors", "dot3_deferred_transmissions",
+				"dot3_late_collisions", "dot3_excessive_collisions",
+				"dot3_internal_mac_transmit_errors", "dot3_carrier_sense_errors",
+				"dot3_frame_too_longs", "dot3_internal_mac_receive_errors",
+				"dot3_symbol_errors"}
+			for _, n := range names {
+				s[n] = uint64(rec.u32())
+			}
+		}
+		if rec.err != nil {
+			return s, rec.err
+		}
+	}
+
+	return s, r.err
+}
+
+// Decode what we can from a (truncated) Ethernet frame. Fails on headers that
+// cannot be valid
+func decodeEthernet(b []byte, s map[string]interface{}) error {
+	if len(b) < 14 {
+		return nil
+	}
+	s["dst_mac"] = net.HardwareAddr(b[0:6]).String()
+	s["src_mac"] = net.HardwareAddr(b[6:12]).String()
+
+	etype := binary.BigEndian.Uint16(b[12:])
+	b = b[14:]
+
+	// 802.1Q / 802.1ad tags
+	for (etype == 0x8100 || etype == 0x88a8) && len(b) >= 4 {
+		s["vlan"] = uint64(binary.BigEndian.Uint16(b) & 0x0fff)
+		etype = binary.BigEndian.Uint16(b[2:])
+		b = b[4:]
+	}
+
+	switch etype {
+	case 0x0800:
+		return decodeIPv4(b, s)
+	case 0x86dd:
+		decodeIPv6(b, s)
+	}
+	return nil
+}
+
+func decodeIPv4(b []byte, s map[string]interface{}) error {
+	if len(b) < 20 || b[0]>>4 != 4 {
+		return nil
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 {
+		return fmt.Errorf("invalid IPv4 header length %d", ihl)
+	}
+	s["ip_version"] = uint64(4)
+	s["tos"] = uint64(b[1])
+	s["ip_length"] = uint64(binary.BigEndian.Uint16(b[2:]))
+	s["ttl"] = uint64(b[8])
+	s["proto"] = uint64(b[9])
+	s["src"] = net.IP(b[12:16]).String()
+	s["dst"] = net.IP(b[16:20]).String()
+
+	// Only the first fragment has the transport header
+	if binary.BigEndian.Uint16(b[6:])&0x1fff != 0 || len(b) < ihl {
+		return nil
+	}
+	decodeTransport(b[9], b[ihl:], s)
+	return nil
+}
+
+func decodeIPv6(b []byte, s map[string]interface{}) {
+	if len(b) < 40 || b[0]>>4 != 6 {
+		return
+	}
+	s["ip_version"] = uint64(6)
+	s["tos"] = uint64(binary.BigEndian.Uint16(b) >> 4 & 0xff)
+	s["flow_label"] = uint64(binary.BigEndian.Uint32(b) & 0xfffff)
+	s["ip_length"] = uint64(binary.BigEndian.Uint16(b[4:])) + 40
+	s["ttl"] = uint64(b[7])
+	s["src"] = net.IP(b[8:24]).String()
+	s["dst"] = net.IP(b[24:40]).String()
+
+	next := b[6]
+	b = b[40:]
+
+	// Skip the common extension headers
+	for (next == 0 || next == 43 || next == 60) && len(b) >= 8 {
+		l := (int(b[1]) + 1) * 8
+		if len(b) < l {
+			return
+		}
+		next = b[0]
+		b = b[l:]
+	}
+	s["proto"] = uint64(next)
+	decodeTransport(next, b, s)
+}
+
+func decodeTransport(proto byte, b []byte, s map[string]interface{}) {
+	switch proto {
+	case 6:
+		if len(b) >= 14 {
+			s["src_port"] = uint64(binary.BigEndian.Uint16(b))
+			s["dst_port"] = uint64(binary.BigEndian.Uint16(b[2:]))
+			s["tcp_flags"] = uint64(b[13])
+		}
+	case 17:
+		if len(b) >= 4 {
+			s["src_port"] = uint64(binary.BigEndian.Uint16(b))
+			s["dst_port"] = uint64(binary.BigEndian.Uint16(b[2:]))
+		}
+	case 1, 58:
+		if len(b) >= 2 {
+			s["icmp_type"] = uint64(b[0])
+			s["icmp_code"] = uint64(b[1])
+		}
+	}
+}
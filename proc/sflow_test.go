@@ -0,0 +1,126 @@
+package proc
+
+import (
+	"testing"
+
+	. "github.com/urban-1/gopipe/tests"
+)
+
+func sflowDatagram(samples ...[]byte) []byte {
+	pkt := be(uint32(5), uint32(1), [4]byte{10, 1, 1, 1}, uint32(0), uint32(99),
+		uint32(123456), uint32(len(samples)))
+	for _, s := range samples {
+		pkt = append(pkt, s...)
+	}
+	return pkt
+}
+
+// Wrap data in a format/length record, padding to 4 bytes
+func sflowRecord(format uint32, data []byte) []byte {
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+	return append(be(format, uint32(len(data))), data...)
+}
+
+func sflowFlowSample() []byte {
+	// Ethernet + 802.1Q + IPv4 + TCP
+	hdr := be([6]byte{0, 1, 2, 3, 4, 5}, [6]byte{6, 7, 8, 9, 10, 11}, uint16(0x8100),
+		uint16(100), uint16(0x0800),
+		uint8(0x45), uint8(0), uint16(1500), uint16(1), uint16(0x4000), uint8(64), uint8(6),
+		uint16(0), [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2},
+		uint16(12345), uint16(443), uint32(1), uint32(0), uint8(0x50), uint8(0x12))
+	raw := sflowRecord(1, append(be(uint32(1), uint32(1518), uint32(4), uint32(len(hdr))), hdr...))
+	sw := sflowRecord(1001, be(uint32(100), uint32(0), uint32(200), uint32(0)))
+
+	sample := be(uint32(7), uint32(3), uint32(512), uint32(1024), uint32(0),
+		uint32(3), uint32(5), uint32(2))
+	sample = append(append(sample, raw...), sw...)
+	return sflowRecord(1, sample)
+}
+
+func sflowCounterSample() []byte {
+	generic := be(uint32(3), uint32(6), uint64(1000000000), uint32(1), uint32(3),
+		uint64(5000), uint32(10), uint32(0), uint32(0), uint32(0), uint32(0), uint32(0),
+		uint64(6000), uint32(20), uint32(0), uint32(0), uint32(0), uint32(2), uint32(0))
+	sample := append(be(uint32(8), uint32(3), uint32(1)), sflowRecord(1, generic)...)
+	return sflowRecord(2, sample)
+}
+
+func TestSFlowFlowSample(t *testing.T) {
+	in, out := GetChannels()
+	e := GetRawEvent(sflowDatagram(sflowFlowSample()))
+	e.Data["_from_addr"] = "127.0.0.1"
+	in <- e
+
+	comp := NewSFlowProc(in, out, GetConfig(`{}`))
+	go comp.Run()
+
+	r := (<-out).Data
+	if r["sample_type"] != "flow" || r["agent"] != "10.1.1.1" || r["_from_addr"] != "127.0.0.1" {
+		t.Error("sFlow: wrong sample header ", r)
+	}
+	if r["src"] != "10.0.0.1" || r["dst"] != "10.0.0.2" || r["proto"] != uint64(6) {
+		t.Error("sFlow: wrong IP header ", r)
+	}
+	if r["src_port"] != uint64(12345) || r["dst_port"] != uint64(443) || r["tcp_flags"] != uint64(0x12) {
+		t.Error("sFlow: wrong TCP header ", r)
+	}
+	if r["src_mac"] != "06:07:08:09:0a:0b" || r["vlan"] != uint64(100) || r["dst_vlan"] != uint64(200) {
+		t.Error("sFlow: wrong Ethernet header ", r)
+	}
+	if r["in_bytes"] != uint64(1518*512) || r["in_pkts"] != uint64(512) {
+		t.Error("sFlow: counts not scaled by the sampling rate ", r)
+	}
+	if r["input_if"] != uint64(3) || r["output_if"] != uint64(5) {
+		t.Error("sFlow: wrong interfaces ", r)
+	}
+}
+
+func TestSFlowCounterSample(t *testing.T) {
+	p := NewSFlowProc(nil, nil, GetConfig(`{}`)).(*SFlowProc)
+
+	samples, err := p.Decode(sflowDatagram(sflowCounterSample(), sflowFlowSample()))
+	if err != nil || len(samples) != 2 {
+		t.Fatal("sFlow: expected 2 samples ", samples, err)
+	}
+	r := samples[0]
+	if r["sample_type"] != "counter" || r["if_index"] != uint64(3) {
+		t.Error("sFlow: wrong counter sample ", r)
+	}
+	if r["if_in_octets"] != uint64(5000) || r["if_out_octets"] != uint64(6000) || r["if_out_errors"] != uint64(2) {
+		t.Error("sFlow: wrong counters ", r)
+	}
+
+	// Truncated datagram: first sample still returned
+	pkt := sflowDatagram(sflowCounterSample(), sflowFlowSample())
+	samples, err = p.Decode(pkt[:len(pkt)-10])
+	if err == nil || len(samples) != 1 {
+		t.Error("sFlow: truncated datagram ", samples, err)
+	}
+
+	if _, err = p.Decode(be(uint32(4))); err == nil {
+		t.Error("sFlow: accepted v4 datagram")
+	}
+
+	stats := p.GetStatsJSON()
+	if stats["CounterSamples"] != uint64(2) || stats["FlowSamples"] != uint64(1) {
+		t.Error("sFlow: wrong stats ", stats)
+	}
+}
+
+func TestSFlowInvalidIPv4(t *testing.T) {
+	p := NewSFlowProc(nil, nil, GetConfig(`{}`)).(*SFlowProc)
+
+	// IPv4 header (protocol 11) with a header length of 8 bytes
+	hdr := be(uint8(0x42), uint8(0), uint16(40), uint16(1), uint16(0), uint8(64), uint8(6),
+		uint16(0), [4]byte{10, 0, 0, 1}, [4]byte{10, 0, 0, 2})
+	raw := sflowRecord(1, append(be(uint32(11), uint32(40), uint32(0), uint32(len(hdr))), hdr...))
+	sample := be(uint32(7), uint32(3), uint32(1), uint32(1), uint32(0),
+		uint32(3), uint32(5), uint32(1))
+
+	samples, err := p.Decode(sflowDatagram(sflowRecord(1, append(sample, raw...))))
+	if err == nil || len(samples) != 0 {
+		t.Error("sFlow: accepted an invalid IPv4 header ", samples, err)
+	}
+}
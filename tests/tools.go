@@ -69,3 +69,12 @@ func GetRawEvent(s []byte) *Event {
 
 	return NewEvent(json_data)
 }
+
+// Create an event whose ack result (true: acked, false: nacked) is sent to the
+// returned channel
+func GetAckedEvent(s string) (*Event, chan bool) {
+	e := GetEvent(s)
+	acks := make(chan bool, 1)
+	e.OnAck(func(ok bool) { acks <- ok })
+	return e, acks
+}